@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errArchiveTimeout = errors.New("archive timeout")
+
+// archiveWriter writes the entries of one archive format.
+type archiveWriter interface {
+	// create starts an entry of size bytes; its content must be written to
+	// the returned writer before the next call.
+	create(name string, size int64) (io.Writer, error)
+	// flush pushes buffered data to the underlying writer between entries.
+	flush() error
+	close() error
+}
+
+// archiveFormat describes a supported value of the request's format option.
+type archiveFormat struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer, mode os.FileMode) archiveWriter
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {"application/zip", ".zip", newZipArchive},
+	"tar":    {"application/x-tar", ".tar", newTarArchive},
+	"tar.gz": {"application/gzip", ".tar.gz", newTarGzipArchive},
+}
+
+// archiveFormatFor returns the format requested by name, defaulting to zip.
+func archiveFormatFor(name string) (archiveFormat, bool) {
+	if name == "" {
+		name = "zip"
+	}
+	format, ok := archiveFormats[name]
+	return format, ok
+}
+
+// maxArchiveCommentBytes caps the zip comment taken from a request.
+const maxArchiveCommentBytes = 1024
+
+// sanitizeComment drops control characters other than tabs and newlines
+// from a requested zip comment and caps its length.
+func sanitizeComment(comment string) string {
+	comment = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(comment, ""))
+	return truncateUTF8(comment, maxArchiveCommentBytes)
+}
+
+// defaultEntryMode is the permission of archive entries unless a request's
+// fileMode sets another.
+const defaultEntryMode os.FileMode = 0644
+
+// parseEntryMode parses a request's fileMode, an octal permission such as
+// "0444". Only permission bits are accepted, and at least one must be set.
+func parseEntryMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission between 0001 and 0777", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+type zipArchive struct {
+	zw   *zip.Writer
+	mode os.FileMode
+}
+
+func newZipArchive(w io.Writer, mode os.FileMode) archiveWriter {
+	return zipArchive{zip.NewWriter(w), mode}
+}
+
+func (a zipArchive) create(name string, size int64) (io.Writer, error) {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetMode(a.mode)
+	return a.zw.CreateHeader(header)
+}
+
+func (a zipArchive) flush() error { return a.zw.Flush() }
+func (a zipArchive) close() error { return a.zw.Close() }
+
+type tarArchive struct {
+	tw   *tar.Writer
+	gz   *gzip.Writer
+	mode os.FileMode
+}
+
+func newTarArchive(w io.Writer, mode os.FileMode) archiveWriter {
+	return tarArchive{tw: tar.NewWriter(w), mode: mode}
+}
+
+func newTarGzipArchive(w io.Writer, mode os.FileMode) archiveWriter {
+	gz := gzip.NewWriter(w)
+	return tarArchive{tw: tar.NewWriter(gz), gz: gz, mode: mode}
+}
+
+func (a tarArchive) create(name string, size int64) (io.Writer, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(a.mode),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+func (a tarArchive) flush() error {
+	if err := a.tw.Flush(); err != nil || a.gz == nil {
+		return err
+	}
+	return a.gz.Flush()
+}
+
+func (a tarArchive) close() error {
+	err := a.tw.Close()
+	if a.gz != nil {
+		if gzErr := a.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+// writeArchive writes the successful downloads of report to w as an archive
+// of the given format, followed by the optional index and manifest entries.
+// It returns the total size of the image entries written, and any error
+// finalizing the archive, after which the archive is incomplete. Once
+// ARCHIVE_TIMEOUT has passed, writing stops with errArchiveTimeout. Builds
+// wait for a MAX_ARCHIVE_BUILDS slot before starting.
+func writeArchive(w io.Writer, format archiveFormat, request *downloadRequest, report *downloadReport) (int64, error) {
+	archiveLimiter.acquire()
+	defer archiveLimiter.release(0, false)
+	builder := newArchiveBuilder(w, format, request)
+	builder.startTimeout()
+	for _, result := range archiveOrder(report.Entries, request.OrderBy) {
+		if err := builder.add(result); err != nil {
+			return builder.total, err
+		}
+	}
+	return builder.finish(request, report)
+}
+
+// archiveBuilder adds downloads to an archive one at a time, so a pipelined
+// request can archive each download as it completes. When the destination is
+// an http.Flusher the stream is flushed once ARCHIVE_FLUSH_BYTES have been
+// written since the last flush, so slow clients see steady progress without
+// batches of tiny images paying for a flush per entry. Builders are not safe
+// for concurrent use.
+type archiveBuilder struct {
+	archive  archiveWriter
+	flusher  http.Flusher
+	pending  int64
+	total    int64
+	buf      []byte
+	deadline time.Time
+	// added holds the names written, so entries sharing a file after
+	// deduplication are archived once.
+	added map[string]bool
+	// written lists the entries archived, in order, for the index.
+	written []*downloadResult
+}
+
+func newArchiveBuilder(w io.Writer, format archiveFormat, request *downloadRequest) *archiveBuilder {
+	b := &archiveBuilder{buf: make([]byte, 32<<10), added: make(map[string]bool)}
+	b.flusher = responseFlusher(w)
+	b.archive = format.newWriter(&deadlineWriter{w, &b.deadline}, cmp.Or(request.fileMode, defaultEntryMode))
+	if zipped, ok := b.archive.(zipArchive); ok && request.ArchiveComment != "" {
+		zipped.zw.SetComment(sanitizeComment(request.ArchiveComment))
+	}
+	return b
+}
+
+// startTimeout starts the ARCHIVE_TIMEOUT clock; until then the archive may
+// take as long as its downloads.
+func (b *archiveBuilder) startTimeout() {
+	if cfg.ArchiveTimeout > 0 {
+		b.deadline = time.Now().Add(cfg.ArchiveTimeout)
+	}
+}
+
+// add writes result's file as an entry, skipping failed and uploaded
+// downloads. Only errArchiveTimeout is returned; an entry that cannot be
+// read is left out.
+func (b *archiveBuilder) add(result *downloadResult) error {
+	if expired(b.deadline) {
+		return errArchiveTimeout
+	}
+	if result.Error != "" || result.UploadStatus != 0 || result.original != nil || b.added[result.Filename] {
+		return nil
+	}
+
+	file, err := os.Open(result.path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+
+	entry, err := b.archive.create(result.Filename, info.Size())
+	if err != nil {
+		return nil
+	}
+	b.added[result.Filename] = true
+	b.written = append(b.written, result)
+
+	// One copy buffer serves every entry.
+	n, err := io.CopyBuffer(entry, &deadlineReader{file, &b.deadline}, b.buf)
+	b.total += n
+	b.pending += n
+	if errors.Is(err, errArchiveTimeout) {
+		return err
+	}
+	if err == nil && b.flusher != nil && b.pending >= cfg.ArchiveFlushBytes && b.archive.flush() == nil {
+		b.flusher.Flush()
+		b.pending = 0
+	}
+	return nil
+}
+
+// finish writes the optional index and manifest entries and closes the
+// archive, returning the total size of the image entries.
+func (b *archiveBuilder) finish(request *downloadRequest, report *downloadReport) (int64, error) {
+	if request.Index {
+		var index bytes.Buffer
+		if writeIndex(&index, b.written) == nil {
+			writeArchiveEntry(b.archive, "index.html", index.Bytes())
+		}
+	}
+
+	if request.Manifest {
+		// The timings and retry token differ on every run, and would keep a
+		// repeated batch from producing the same archive and ETag; the token
+		// is sent in X-Retry-Token instead.
+		archived := *report
+		archived.Timings, archived.RetryToken = nil, ""
+		manifest, err := json.MarshalIndent(&archived, "", "  ")
+		if err == nil {
+			writeArchiveEntry(b.archive, "manifest.json", append(manifest, '\n'))
+		}
+	}
+	if expired(b.deadline) {
+		return b.total, errArchiveTimeout
+	}
+	return b.total, b.archive.close()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// deadlineWriter fails writes once its deadline has passed, so a slow
+// compressor cannot hold an archive open indefinitely.
+type deadlineWriter struct {
+	w        io.Writer
+	deadline *time.Time
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if expired(*d.deadline) {
+		return 0, errArchiveTimeout
+	}
+	return d.w.Write(p)
+}
+
+// deadlineReader fails reads once its deadline has passed. It also hides
+// the file's WriteTo, keeping io.CopyBuffer on the shared buffer.
+type deadlineReader struct {
+	r        io.Reader
+	deadline *time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if expired(*d.deadline) {
+		return 0, errArchiveTimeout
+	}
+	return d.r.Read(p)
+}
+
+func writeArchiveEntry(archive archiveWriter, name string, data []byte) error {
+	entry, err := archive.create(name, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// archiveOrder returns results in the order their entries are written:
+// "input" (the default) keeps request order, "name" sorts by entry name, and
+// "size"/"sizeDesc" sort by downloaded size, ties keeping request order.
+func archiveOrder(results []*downloadResult, orderBy string) []*downloadResult {
+	ordered := slices.Clone(results)
+	switch orderBy {
+	case "name":
+		slices.SortStableFunc(ordered, func(a, b *downloadResult) int {
+			return strings.Compare(a.Filename, b.Filename)
+		})
+	case "size":
+		slices.SortStableFunc(ordered, func(a, b *downloadResult) int {
+			return compareInt64(a.Bytes, b.Bytes)
+		})
+	case "sizeDesc":
+		slices.SortStableFunc(ordered, func(a, b *downloadResult) int {
+			return compareInt64(b.Bytes, a.Bytes)
+		})
+	}
+	return ordered
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
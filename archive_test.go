@@ -0,0 +1,491 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zipNames returns the entry names of the zip archive in rec, in order.
+func zipNames(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	zipEntries(t, rec)
+	body := rec.Body.Bytes()
+	reader, _ := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	var names []string
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestArchiveOrder(t *testing.T) {
+	small := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	large := serveBytes(t, "image/png", bytes.Repeat([]byte{0}, 2048))
+	medium := serveBytes(t, "image/png", bytes.Repeat([]byte{0}, 512))
+	urls := `"` + medium.URL + `/b.png","` + small.URL + `/c.png","` + large.URL + `/a.png"`
+
+	tests := []struct {
+		orderBy string
+		want    []string
+	}{
+		{"", []string{"b.png", "c.png", "a.png"}},
+		{"input", []string{"b.png", "c.png", "a.png"}},
+		{"name", []string{"a.png", "b.png", "c.png"}},
+		{"size", []string{"c.png", "b.png", "a.png"}},
+		{"sizeDesc", []string{"a.png", "b.png", "c.png"}},
+	}
+	for _, tt := range tests {
+		rec := postDownload(t, `{"orderBy":"`+tt.orderBy+`","imageURLs":[`+urls+`]}`)
+		if got := zipNames(t, rec); !slices.Equal(got, tt.want) {
+			t.Errorf("orderBy %q: entries %v, want %v", tt.orderBy, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveOrderKeepsTies(t *testing.T) {
+	results := []*downloadResult{{Filename: "x", Bytes: 5}, {Filename: "y", Bytes: 1}, {Filename: "z", Bytes: 5}}
+	var names []string
+	for _, result := range archiveOrder(results, "sizeDesc") {
+		names = append(names, result.Filename)
+	}
+	if want := []string{"x", "z", "y"}; !slices.Equal(names, want) {
+		t.Errorf("sizeDesc order %v, want %v", names, want)
+	}
+	if results[0].Filename != "x" || results[1].Filename != "y" {
+		t.Error("archiveOrder reordered its argument")
+	}
+}
+
+// flushCounter is a response writer stand-in that records how much had been
+// written at each flush.
+type flushCounter struct {
+	bytes.Buffer
+	flushedAt []int
+}
+
+func (f *flushCounter) Flush() { f.flushedAt = append(f.flushedAt, f.Len()) }
+
+// archiveReport returns a report of n successful downloads of size bytes
+// each, saved under dir.
+func archiveReport(t testing.TB, dir string, n, size int) *downloadReport {
+	t.Helper()
+	report := &downloadReport{}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.WriteFile(path, bytes.Repeat([]byte{byte(i)}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		report.Entries = append(report.Entries, &downloadResult{Filename: strconv.Itoa(i) + ".bin", path: path})
+	}
+	return report
+}
+
+func TestArchiveFlushesBetweenEntries(t *testing.T) {
+	format, _ := archiveFormatFor("zip")
+	report := archiveReport(t, t.TempDir(), 4, 1000)
+
+	tests := []struct {
+		flushBytes int64
+		flushes    int
+	}{
+		{1, 4},
+		{2000, 2},
+		{1 << 20, 0},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.ArchiveFlushBytes = tt.flushBytes })
+		var w flushCounter
+		if _, err := writeArchive(&w, format, &downloadRequest{}, report); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.flushedAt) != tt.flushes {
+			t.Errorf("ARCHIVE_FLUSH_BYTES %d: %d flushes, want %d", tt.flushBytes, len(w.flushedAt), tt.flushes)
+		}
+		for i := 1; i < len(w.flushedAt); i++ {
+			if w.flushedAt[i] <= w.flushedAt[i-1] {
+				t.Errorf("flush %d wrote nothing new", i)
+			}
+		}
+		if len(w.flushedAt) > 0 && w.flushedAt[len(w.flushedAt)-1] >= w.Len() {
+			t.Error("flushed after the archive was closed")
+		}
+	}
+}
+
+func TestArchiveTrailersReportTally(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	server := httptestServer(t, downloadHandler)
+
+	body := `{"imageURLs":["` + upstream.URL + `/a.png","` + upstream.URL + `/b.png","` + missing.URL + `/c.png"]}`
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"X-Succeeded":   "2",
+		"X-Failed":      "1",
+		"X-Total-Bytes": strconv.Itoa(2 * len(image)),
+	}
+	for name, value := range want {
+		if got := resp.Trailer.Get(name); got != value {
+			t.Errorf("trailer %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+// discardFlusher is a flushable writer that discards everything, so
+// benchmarks measure the archive loop rather than the response.
+type discardFlusher struct{ flushes int }
+
+func (d *discardFlusher) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardFlusher) Flush()                      { d.flushes++ }
+
+// BenchmarkArchiveTinyEntries archives 10k tiny images, flushing after every
+// entry as archives did before ARCHIVE_FLUSH_BYTES, and batching flushes at
+// the default limit.
+func BenchmarkArchiveTinyEntries(b *testing.B) {
+	format, _ := archiveFormatFor("zip")
+	report := archiveReport(b, b.TempDir(), 10000, 64)
+
+	for _, bm := range []struct {
+		name       string
+		flushBytes int64
+	}{
+		{"PerEntry", 0},
+		{"Batched", loadConfig().ArchiveFlushBytes},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			saved := cfg
+			cfg.ArchiveFlushBytes = bm.flushBytes
+			b.Cleanup(func() { cfg = saved })
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := writeArchive(&discardFlusher{}, format, &downloadRequest{}, report); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// brokenWriter fails every write, like a connection to a client that has
+// gone away.
+type brokenWriter struct{}
+
+var errBrokenWriter = errors.New("client went away")
+
+func (brokenWriter) Write(p []byte) (int, error) { return 0, errBrokenWriter }
+
+func TestArchiveCloseFailureReported(t *testing.T) {
+	format, _ := archiveFormatFor("zip")
+	// The entries fit the zip writer's buffer, so the first write to reach
+	// the client is the one finalizing the archive.
+	report := archiveReport(t, t.TempDir(), 2, 10)
+
+	total, err := writeArchive(brokenWriter{}, format, &downloadRequest{}, report)
+	if !errors.Is(err, errBrokenWriter) {
+		t.Fatalf("writeArchive error = %v, want the write failure", err)
+	}
+	if total != 20 {
+		t.Errorf("total = %d, want 20", total)
+	}
+
+	if _, err := writeArchive(&bytes.Buffer{}, format, &downloadRequest{}, report); err != nil {
+		t.Errorf("writeArchive to a working writer failed: %v", err)
+	}
+}
+
+// tarEntries returns the contents of the tar archive in r, by name.
+func tarEntries(t *testing.T, r io.Reader) map[string][]byte {
+	t.Helper()
+	entries := make(map[string][]byte)
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("reading archive: %v", err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = data
+	}
+}
+
+func TestTarFormats(t *testing.T) {
+	a, b := pngImage(t, 2, 2), pngImage(t, 3, 3)
+	upstreamA, upstreamB := serveBytes(t, "image/png", a), serveBytes(t, "image/png", b)
+	urls := `"imageURLs":["` + upstreamA.URL + `/a.png","` + upstreamB.URL + `/b.png"]`
+
+	for _, tt := range []struct {
+		format, contentType string
+		gzipped             bool
+	}{
+		{"tar", "application/x-tar", false},
+		{"tar.gz", "application/gzip", true},
+	} {
+		rec := postDownload(t, `{"format":"`+tt.format+`",`+urls+`}`)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Fatalf("%s: status %d, Content-Type %q", tt.format, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if got := rec.Header().Get("Content-Disposition"); got != "attachment; filename=images."+tt.format {
+			t.Errorf("%s: Content-Disposition %q", tt.format, got)
+		}
+		var body io.Reader = rec.Body
+		if tt.gzipped {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		entries := tarEntries(t, body)
+		if len(entries) != 2 || !bytes.Equal(entries["a.png"], a) || !bytes.Equal(entries["b.png"], b) {
+			t.Errorf("%s: entries %v do not match the downloads", tt.format, slices.Sorted(maps.Keys(entries)))
+		}
+	}
+}
+
+func TestUnknownFormatRejected(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	if rec := postDownload(t, `{"format":"rar","imageURLs":["`+upstream.URL+`/a.png"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
+
+func TestArchiveComment(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	rec := postDownload(t, `{"archiveComment":"batch 42\tnightly\nrun","imageURLs":["`+upstream.URL+`/a.png"]}`)
+	reader, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Comment != "batch 42\tnightly\nrun" {
+		t.Errorf("archive comment = %q", reader.Comment)
+	}
+}
+
+func TestSanitizeComment(t *testing.T) {
+	tests := []struct{ comment, want string }{
+		{"plain", "plain"},
+		{"bell\a and\x00 nul", "bell and nul"},
+		{"bad \xff utf-8", "bad  utf-8"},
+		{strings.Repeat("é", 600), strings.Repeat("é", 512)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeComment(tt.comment); got != tt.want {
+			t.Errorf("sanitizeComment(%.20q) = %.20q (%d bytes), want %.20q", tt.comment, got, len(got), tt.want)
+		}
+	}
+}
+
+// slowWriter stands in for a pathologically slow compressor, taking delay
+// over every write.
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (s *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.Buffer.Write(p)
+}
+
+func TestArchiveTimeoutStopsSlowCompressor(t *testing.T) {
+	setConfig(t, func(c *config) { c.ArchiveTimeout = 50 * time.Millisecond })
+	format, _ := archiveFormatFor("tar")
+	report := archiveReport(t, t.TempDir(), 100, 1000)
+
+	start := time.Now()
+	_, err := writeArchive(&slowWriter{delay: 10 * time.Millisecond}, format, &downloadRequest{}, report)
+	if !errors.Is(err, errArchiveTimeout) {
+		t.Fatalf("err = %v, want %v", err, errArchiveTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("archive took %v to time out", elapsed)
+	}
+}
+
+func TestArchiveTimeoutResponses(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	body := `{"imageURLs":["` + upstream.URL + `/a.png"]}`
+
+	setConfig(t, func(c *config) { c.ArchiveTimeout = time.Nanosecond; c.ArchiveDelivery = "buffered" })
+	if rec := postDownload(t, body); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("buffered: status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+
+	setConfig(t, func(c *config) { c.ArchiveDelivery = "stream" })
+	rec := postDownload(t, body)
+	if got := rec.Header().Get("X-Archive-Error"); got != "archive timeout" {
+		t.Errorf("streamed: X-Archive-Error = %q, want %q", got, "archive timeout")
+	}
+}
+
+func TestPipelineArchivesBeforeBatchCompletes(t *testing.T) {
+	setConfig(t, func(c *config) { c.ArchiveFlushBytes = 0 })
+	image := pngImage(t, 3, 3)
+	release := make(chan struct{})
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.png" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	server := httptestServer(t, downloadHandler)
+
+	for _, pipeline := range []bool{false, true} {
+		released := make(chan struct{})
+		body := `{"pipeline":` + strconv.FormatBool(pipeline) + `,"imageURLs":["` + upstream.URL + `/slow.png","` + upstream.URL + `/fast.png"]}`
+		responded := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Error(err)
+			}
+			responded <- resp
+		}()
+
+		var resp *http.Response
+		select {
+		case resp = <-responded:
+			if !pipeline {
+				t.Error("sequential archive responded before its downloads finished")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if pipeline {
+				t.Error("pipelined archive did not start while a download was still running")
+			}
+		}
+		go func() {
+			release <- struct{}{}
+			close(released)
+		}()
+		<-released
+		if resp == nil {
+			resp = <-responded
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.Trailer.Get("X-Succeeded") != "2" {
+				t.Errorf("pipeline %v: X-Succeeded %q, want 2", pipeline, resp.Trailer.Get("X-Succeeded"))
+			}
+		}
+	}
+}
+
+// BenchmarkPipeline compares archiving after the whole batch with archiving
+// each download as it completes, for a batch of slow upstream responses
+// whose entries take a while to compress.
+func BenchmarkPipeline(b *testing.B) {
+	image := make([]byte, 4<<20)
+	rand.Read(image)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	}))
+	b.Cleanup(upstream.Close)
+	var urls []string
+	for i := 0; i < 8; i++ {
+		urls = append(urls, `"`+upstream.URL+"/"+strconv.Itoa(i)+`.png"`)
+	}
+
+	for _, bm := range []struct {
+		name     string
+		pipeline bool
+	}{
+		{"Sequential", false},
+		{"Pipelined", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			saved := cfg
+			cfg.Concurrency = 1
+			b.Cleanup(func() { cfg = saved })
+			body := `{"pipeline":` + strconv.FormatBool(bm.pipeline) + `,"imageURLs":[` + strings.Join(urls, ",") + `]}`
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				downloadHandler(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	urls := `"imageURLs":["` + upstream.URL + `/a.png","` + upstream.URL + `/b.png"]`
+
+	for _, tt := range []struct {
+		option string
+		want   os.FileMode
+	}{
+		{``, 0644},
+		{`"fileMode":"0444",`, 0444},
+		{`"fileMode":"755",`, 0755},
+	} {
+		rec := postDownload(t, `{`+tt.option+urls+`}`)
+		reader, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.option, err)
+		}
+		for _, file := range reader.File {
+			if mode := file.Mode(); mode != tt.want {
+				t.Errorf("%s: zip entry %s has mode %v, want %v", tt.option, file.Name, mode, tt.want)
+			}
+		}
+
+		rec = postDownload(t, `{"format":"tar",`+tt.option+urls+`}`)
+		tr := tar.NewReader(rec.Body)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.FileMode(header.Mode) != tt.want {
+				t.Errorf("%s: tar entry %s has mode %o, want %o", tt.option, header.Name, header.Mode, tt.want)
+			}
+		}
+	}
+
+	for _, mode := range []string{"0", "1000", "0644x", "rw-r--r--", "-1"} {
+		if rec := postDownload(t, `{"fileMode":"`+mode+`",`+urls+`}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("fileMode %q: status %d, want %d", mode, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
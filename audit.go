@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog records every download decision when AUDIT_LOG is set; it is nil
+// otherwise.
+var auditLog *auditLogger
+
+// auditLogger writes one JSON line per download. Each line carries the
+// SHA-256 of the line before it, so removing or editing an entry breaks the
+// chain from that point on.
+type auditLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	prev string
+}
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time string `json:"time"`
+	// Key is a fingerprint of the caller's API key, never the key itself.
+	Key string `json:"key,omitempty"`
+	IP  string `json:"ip"`
+	URL string `json:"url"`
+	// Source is the URL that served the image, when it was downloaded.
+	Source string `json:"source,omitempty"`
+	// Verdict is "allowed", or "blocked" with the refusing policy Rule.
+	Verdict string `json:"verdict"`
+	Rule    string `json:"rule,omitempty"`
+	// Outcome is "ok" or "failed", with the download's Error.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	// SHA256 is the digest of the downloaded bytes.
+	SHA256 string `json:"sha256,omitempty"`
+	// Prev is the SHA-256 of the previous line, empty for the first.
+	Prev string `json:"prev"`
+}
+
+// auditIdentity is who a download was made on behalf of.
+type auditIdentity struct {
+	key string
+	ip  string
+}
+
+// openAuditLog opens AUDIT_LOG for appending, or writes to stdout when it
+// is "-". An existing file's chain is continued from its last line.
+func openAuditLog() error {
+	switch cfg.AuditLog {
+	case "":
+		return nil
+	case "-":
+		auditLog = &auditLogger{w: os.Stdout}
+		return nil
+	}
+
+	file, err := os.OpenFile(cfg.AuditLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	last, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	auditLog = &auditLogger{w: file}
+	if len(last) > 0 {
+		auditLog.prev = lineDigest(last)
+	}
+	return nil
+}
+
+// lastLine returns the final line of file without its newline.
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	const tail = 64 << 10
+	offset := max(0, info.Size()-tail)
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data, nil
+}
+
+func lineDigest(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// newAuditIdentity identifies the caller of r by a fingerprint of its API
+// key and its remote IP.
+func newAuditIdentity(r *http.Request) auditIdentity {
+	identity := auditIdentity{ip: r.RemoteAddr}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		identity.ip = host
+	}
+	if key := apiKey(r); key != "" {
+		identity.key = lineDigest([]byte(key))[:16]
+	}
+	return identity
+}
+
+// record appends the outcome of one download to the log. It does nothing
+// on a nil logger.
+func (l *auditLogger) record(identity auditIdentity, result *downloadResult) {
+	if l == nil {
+		return
+	}
+	entry := auditEntry{
+		Key:     identity.key,
+		IP:      identity.ip,
+		URL:     result.URL,
+		Source:  result.Source,
+		Verdict: "allowed",
+		Rule:    result.BlockedBy,
+		Outcome: "ok",
+		Error:   result.Error,
+		Bytes:   result.Bytes,
+		SHA256:  result.sha256,
+	}
+	if result.BlockedBy != "" {
+		entry.Verdict = "blocked"
+	}
+	if result.Error != "" {
+		entry.Outcome = "failed"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	entry.Prev = l.prev
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.prev = lineDigest(line)
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write audit log:", err)
+	}
+}
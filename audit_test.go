@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureAudit points the audit log at a buffer for the rest of the test.
+func captureAudit(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := auditLog
+	auditLog = &auditLogger{w: &buf}
+	t.Cleanup(func() { auditLog = previous })
+	return &buf
+}
+
+// auditLines splits the audit log in buf into its raw lines and entries.
+func auditLines(t *testing.T, buf *bytes.Buffer) ([][]byte, []auditEntry) {
+	t.Helper()
+	var lines [][]byte
+	var entries []auditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+		entries = append(entries, entry)
+	}
+	return lines, entries
+}
+
+func TestAuditLogFields(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	u, _ := url.Parse(upstream.URL)
+	setConfig(t, func(c *config) { c.BlockHosts = []string{"localhost"} })
+	buf := captureAudit(t)
+
+	allowed := upstream.URL + "/a.png"
+	blocked := "http://localhost:" + u.Port() + "/b.png"
+	postWithKey(t, "secret-key", `{"imageURLs":["`+allowed+`","`+blocked+`"]}`)
+
+	_, entries := auditLines(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("%d audit entries, want 2", len(entries))
+	}
+	byURL := map[string]auditEntry{entries[0].URL: entries[0], entries[1].URL: entries[1]}
+	for _, entry := range entries {
+		if entry.Time == "" || entry.IP == "" || entry.Key == "" || entry.Key == "secret-key" {
+			t.Errorf("%s: time %q, ip %q, key %q; want a time, IP and key fingerprint", entry.URL, entry.Time, entry.IP, entry.Key)
+		}
+	}
+
+	ok := byURL[allowed]
+	if ok.Verdict != "allowed" || ok.Outcome != "ok" || ok.Bytes != int64(len(image)) || ok.SHA256 != sha256Hex(image) || ok.Source != allowed {
+		t.Errorf("allowed download logged as %+v", ok)
+	}
+	refused := byURL[blocked]
+	if refused.Verdict != "blocked" || refused.Rule != "block-list" || refused.Outcome != "failed" || refused.Error == "" || refused.Bytes != 0 {
+		t.Errorf("blocked download logged as %+v", refused)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	buf := captureAudit(t)
+
+	postDownload(t, `{"imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b.png","`+upstream.URL+`/c.png"]}`)
+
+	lines, entries := auditLines(t, buf)
+	if len(entries) != 3 {
+		t.Fatalf("%d audit entries, want 3", len(entries))
+	}
+	if entries[0].Prev != "" {
+		t.Errorf("first entry prev = %q, want none", entries[0].Prev)
+	}
+	for i := 1; i < len(entries); i++ {
+		if want := lineDigest(lines[i-1]); entries[i].Prev != want {
+			t.Errorf("entry %d prev = %q, want %q", i, entries[i].Prev, want)
+		}
+	}
+}
+
+func TestOpenAuditLogContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	last := []byte(`{"url":"b"}`)
+	if err := os.WriteFile(path, append([]byte("{\"url\":\"a\"}\n"), append(last, '\n')...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, func(c *config) { c.AuditLog = path })
+	previous := auditLog
+	t.Cleanup(func() { auditLog = previous })
+
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.w.(*os.File).Close()
+	if want := lineDigest(last); auditLog.prev != want {
+		t.Errorf("prev = %q, want the digest of the last line %q", auditLog.prev, want)
+	}
+}
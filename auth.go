@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// apiKey returns the API key presented with r, from an "Authorization:
+// Bearer" header or an X-API-Key header.
+func apiKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// isTrusted reports whether r carries one of TRUSTED_API_KEYS. Trusted
+// callers may use options that relax the server's defaults.
+func isTrusted(r *http.Request) bool {
+	key := apiKey(r)
+	if key == "" {
+		return false
+	}
+	trusted := false
+	for _, candidate := range cfg.TrustedAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			trusted = true
+		}
+	}
+	return trusted
+}
+
+// checkTrusted refuses r with 401 when it carries no API key and 403 when
+// its key is not trusted, returning false, whenever TRUSTED_API_KEYS is
+// set. Without TRUSTED_API_KEYS every caller is let through.
+func checkTrusted(w http.ResponseWriter, r *http.Request) bool {
+	if len(cfg.TrustedAPIKeys) == 0 || isTrusted(r) {
+		return true
+	}
+	if apiKey(r) == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "API key required", http.StatusUnauthorized)
+		return false
+	}
+	http.Error(w, "API key not trusted", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+	tests := []struct {
+		header, value, want string
+	}{
+		{"Authorization", "Bearer  abc ", "abc"},
+		{"X-API-Key", "xyz", "xyz"},
+		{"Authorization", "Basic dTpw", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(tt.header, tt.value)
+		if got := apiKey(req); got != tt.want {
+			t.Errorf("%s: %q: apiKey = %q, want %q", tt.header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTrustedWithoutKeysConfigured(t *testing.T) {
+	setConfig(t, func(c *config) { c.TrustedAPIKeys = nil })
+
+	rec := httptest.NewRecorder()
+	if !checkTrusted(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil)) {
+		t.Errorf("checkTrusted refused a caller with no TRUSTED_API_KEYS set: %d", rec.Code)
+	}
+}
+
+func TestCheckTrusted(t *testing.T) {
+	setConfig(t, func(c *config) { c.TrustedAPIKeys = []string{"one", "two"} })
+
+	tests := []struct {
+		key  string
+		ok   bool
+		code int
+	}{
+		{"", false, http.StatusUnauthorized},
+		{"three", false, http.StatusForbidden},
+		{"two", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		if ok := checkTrusted(rec, req); ok != tt.ok || rec.Code != tt.code {
+			t.Errorf("key %q: checkTrusted = %v with status %d, want %v with %d", tt.key, ok, rec.Code, tt.ok, tt.code)
+		}
+	}
+}
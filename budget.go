@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var errBudgetExceeded = errors.New("byte budget exceeded")
+
+// byteBudget counts the bytes downloaded for one request and, when it has a
+// limit, fails the download that crosses it. A nil budget counts nothing.
+type byteBudget struct {
+	limit    int64
+	used     atomic.Int64
+	exceeded atomic.Bool
+}
+
+// newByteBudget returns the budget for request: its maxTotalBytes, capped by
+// MAX_REQUEST_BYTES and the space left in its destDir's quota. A limit of 0
+// only counts.
+func newByteBudget(request *downloadRequest) *byteBudget {
+	limit := max(request.MaxTotalBytes, 0)
+	for _, ceiling := range []int64{cfg.MaxRequestBytes, request.quotaFree} {
+		if ceiling > 0 && (limit == 0 || limit > ceiling) {
+			limit = ceiling
+		}
+	}
+	return &byteBudget{limit: limit}
+}
+
+// exhausted reports whether a download has already crossed the limit, after
+// which no further downloads are started.
+func (b *byteBudget) exhausted() bool {
+	return b != nil && b.exceeded.Load()
+}
+
+// reader counts the bytes read from r against the budget.
+func (b *byteBudget) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *byteBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	used := r.budget.used.Add(int64(n))
+	if r.budget.limit > 0 && used > r.budget.limit {
+		r.budget.exceeded.Store(true)
+		return n, errBudgetExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNewByteBudgetLimit(t *testing.T) {
+	tests := []struct {
+		requested, ceiling, want int64
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 500, 500},
+		{100, 500, 100},
+		{900, 500, 500},
+		{-1, 0, 0},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.MaxRequestBytes = tt.ceiling })
+		if got := newByteBudget(&downloadRequest{MaxTotalBytes: tt.requested}).limit; got != tt.want {
+			t.Errorf("maxTotalBytes %d, MAX_REQUEST_BYTES %d: limit %d, want %d", tt.requested, tt.ceiling, got, tt.want)
+		}
+	}
+}
+
+func TestByteBudgetExceeded(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	size := len(image)
+	upstream := serveBytes(t, "image/png", image)
+	setConfig(t, func(c *config) { c.Concurrency = 1 })
+	var urls []string
+	for i := 0; i < 5; i++ {
+		urls = append(urls, `"`+upstream.URL+"/"+strconv.Itoa(i)+`.png"`)
+	}
+
+	rec := postDownload(t, `{"maxTotalBytes":`+strconv.Itoa(size*5/2)+`,"imageURLs":[`+strings.Join(urls, ",")+`]}`)
+	if rec.Code != http.StatusRequestEntityTooLarge || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q; want a 413 JSON report", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	report := decodeReport(t, rec)
+	if !report.BudgetExceeded || report.Skipped["budget"] != 2 || report.Succeeded != 2 {
+		t.Errorf("budgetExceeded %v, skipped %v, succeeded %d; want true, 2 skipped and 2 succeeded", report.BudgetExceeded, report.Skipped, report.Succeeded)
+	}
+	if report.TotalBytes <= int64(size*5/2) || report.TotalBytes > int64(size*3) {
+		t.Errorf("totalBytes %d, want just past the %d byte budget", report.TotalBytes, size*5/2)
+	}
+	for i, entry := range report.Entries {
+		failed := entry.Error != ""
+		if failed != (i >= 2) {
+			t.Errorf("entry %d error %q", i, entry.Error)
+		}
+		if i >= 3 && !strings.HasPrefix(entry.Error, "skipped: ") {
+			t.Errorf("entry %d error %q, want a skip", i, entry.Error)
+		}
+	}
+}
+
+func TestTotalBytesReported(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream := serveBytes(t, "image/png", image)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b.png"]}`)
+	if report := decodeReport(t, rec); report.TotalBytes != int64(2*len(image)) || report.BudgetExceeded {
+		t.Errorf("totalBytes %d, budgetExceeded %v; want %d and false", report.TotalBytes, report.BudgetExceeded, 2*len(image))
+	}
+}
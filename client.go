@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	defaultTransport = newTransport()
+	http1Transport   = newProtocolTransport("http1")
+	http2Transport   = newProtocolTransport("http2")
+)
+
+// newTransport returns a transport whose dials give up after CONNECT_TIMEOUT,
+// independently of the overall DOWNLOAD_TIMEOUT, and are subject to the
+// private address policy. Responses whose headers exceed
+// MAX_RESPONSE_HEADER_BYTES are refused.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second, Control: dialControl}
+	transport.DialContext = validatedDial(dialer)
+	transport.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	return transport
+}
+
+// newProtocolTransport returns a transport restricted to HTTP/1.1 ("http1")
+// or HTTP/2 ("http2"). HTTP/2 over plain http:// uses prior knowledge.
+func newProtocolTransport(protocol string) *http.Transport {
+	transport := newTransport()
+	protocols := new(http.Protocols)
+	switch protocol {
+	case "http1":
+		protocols.SetHTTP1(true)
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case "http2":
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return transport
+}
+
+// transportFor picks the transport for host according to the per-host
+// HTTP1_HOSTS/HTTP2_HOSTS lists, falling back to HTTP_PROTOCOL.
+func transportFor(host string) http.RoundTripper {
+	switch protocolFor(host) {
+	case "http1":
+		return http1Transport
+	case "http2":
+		return http2Transport
+	default:
+		return defaultTransport
+	}
+}
+
+// protocolFor returns the protocol forced for host, "http1" or "http2", or
+// HTTP_PROTOCOL otherwise.
+func protocolFor(host string) string {
+	host = strings.ToLower(host)
+	protocol := cfg.HTTPProtocol
+	for _, pattern := range cfg.HTTP1Hosts {
+		if hostMatches(host, pattern) {
+			protocol = "http1"
+		}
+	}
+	for _, pattern := range cfg.HTTP2Hosts {
+		if hostMatches(host, pattern) {
+			protocol = "http2"
+		}
+	}
+	return protocol
+}
+
+// hostCookieJar carries cookies between the redirects of a single fetch. It
+// only stores and returns cookies for the host the fetch started on, so they
+// never reach a cross-host hop.
+type hostCookieJar struct {
+	host string
+	jar  *cookiejar.Jar
+}
+
+func newHostCookieJar(host string) *hostCookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &hostCookieJar{host: host, jar: jar}
+}
+
+func (j *hostCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if strings.EqualFold(u.Hostname(), j.host) {
+		j.jar.SetCookies(u, cookies)
+	}
+}
+
+func (j *hostCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	if !strings.EqualFold(u.Hostname(), j.host) {
+		return nil
+	}
+	return j.jar.Cookies(u)
+}
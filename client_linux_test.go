@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stalledAddress returns the address of a listener that never accepts and
+// whose queue is already full, so new connections to it hang in the
+// handshake.
+func stalledAddress(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "127.0.0.1:" + strconv.Itoa(sa.(*syscall.SockaddrInet4).Port)
+
+	// A backlog of 0 still queues a connection; anything beyond it stalls.
+	for i := 0; i < 4; i++ {
+		conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+		if err != nil {
+			return address
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Skip("the kernel accepted every connection to a full listener")
+	return ""
+}
+
+func TestConnectTimeoutFailsFast(t *testing.T) {
+	address := stalledAddress(t)
+	setConfig(t, func(c *config) {
+		c.ConnectTimeout = 200 * time.Millisecond
+		c.DownloadTimeout = time.Minute
+		c.RetryAttempts = 0
+		c.DestRoot = t.TempDir()
+	})
+
+	// maxConnections gives the request transports of its own, built with
+	// the CONNECT_TIMEOUT set above.
+	start := time.Now()
+	rec := postDownload(t, `{"output":"local","destDir":"out","maxConnections":1,"imageURLs":["http://`+address+`/a.png"]}`)
+	elapsed := time.Since(start)
+	entry := decodeReport(t, rec).Entries[0]
+	if !strings.Contains(entry.Error, "timeout") {
+		t.Errorf("error %q does not report a timeout", entry.Error)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("download took %v with a 200ms connect timeout", elapsed)
+	}
+}
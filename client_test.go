@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// protocolServer serves a PNG over HTTP/1.1 and unencrypted HTTP/2,
+// recording the protocol of the last request.
+func protocolServer(t *testing.T) (*httptest.Server, *string) {
+	t.Helper()
+	body := pngImage(t, 2, 2)
+	var proto string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &proto
+}
+
+func TestForcedProtocol(t *testing.T) {
+	server, proto := protocolServer(t)
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   string
+	}{
+		{"default", func(c *config) {}, "HTTP/1.1"},
+		{"http2 host", func(c *config) { c.HTTP2Hosts = []string{"127.0.0.1"} }, "HTTP/2.0"},
+		{"http1 host overrides HTTP_PROTOCOL", func(c *config) { c.HTTPProtocol, c.HTTP1Hosts = "http2", []string{"127.0.0.1"} }, "HTTP/1.1"},
+		{"HTTP_PROTOCOL", func(c *config) { c.HTTPProtocol = "http2" }, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+			setConfig(t, tt.change)
+
+			rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+server.URL+`/a.png"]}`)
+			entry := decodeReport(t, rec).Entries[0]
+			if entry.Error != "" || *proto != tt.want || entry.Protocol != tt.want {
+				t.Errorf("server saw %s, entry %+v; want %s", *proto, entry, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtocolFor(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.HTTPProtocol = ""
+		c.HTTP1Hosts = []string{"*.legacy.example"}
+		c.HTTP2Hosts = []string{"h2.legacy.example"}
+	})
+	for host, want := range map[string]string{"a.legacy.example": "http1", "H2.legacy.example": "http2", "example.com": ""} {
+		if got := protocolFor(host); got != want {
+			t.Errorf("protocolFor(%s) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+// cookieServer redirects /start to /image while setting a session cookie,
+// and serves /image only to requests carrying it.
+func cookieServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	body := pngImage(t, 2, 2)
+	return httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "ok", Path: "/"})
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "ok" {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	})
+}
+
+func TestCookiesCarriedAcrossRedirects(t *testing.T) {
+	upstream := cookieServer(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	for _, tt := range []struct {
+		useCookies bool
+		ok         bool
+	}{{true, true}, {false, false}} {
+		rec := postDownload(t, `{"useCookies":`+strconv.FormatBool(tt.useCookies)+`,"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/start"]}`)
+		if entry := decodeReport(t, rec).Entries[0]; (entry.Error == "") != tt.ok {
+			t.Errorf("useCookies %v: error %q", tt.useCookies, entry.Error)
+		}
+	}
+}
+
+func TestCookiesNotSharedBetweenDownloads(t *testing.T) {
+	upstream := cookieServer(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"useCookies":true,"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/start","`+upstream.URL+`/image.png?direct"]}`)
+	entries := decodeReport(t, rec).Entries
+	if entries[0].Error != "" {
+		t.Errorf("redirected download failed: %s", entries[0].Error)
+	}
+	if entries[1].Error == "" {
+		t.Error("second download was sent the first download's cookie")
+	}
+}
+
+func TestHostCookieJarIgnoresOtherHosts(t *testing.T) {
+	jar := newHostCookieJar("example.com")
+	same, _ := url.Parse("http://example.com/a")
+	other, _ := url.Parse("http://other.example/a")
+	cookie := []*http.Cookie{{Name: "session", Value: "ok"}}
+
+	jar.SetCookies(other, cookie)
+	if len(jar.Cookies(other)) != 0 {
+		t.Error("jar stored a cookie from another host")
+	}
+	jar.SetCookies(same, cookie)
+	if len(jar.Cookies(same)) != 1 {
+		t.Error("jar dropped a cookie from its own host")
+	}
+	if len(jar.Cookies(other)) != 0 {
+		t.Error("jar sent its host's cookie to another host")
+	}
+}
+
+func TestOversizedResponseHeaders(t *testing.T) {
+	image := pngImage(t, 2, 2)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge.png" {
+			w.Header().Set("X-Padding", strings.Repeat("a", 100<<10))
+		} else {
+			w.Header().Set("X-Padding", strings.Repeat("a", 1<<10))
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	report := decodeReport(t, postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/huge.png","`+upstream.URL+`/small.png"]}`))
+	if entry := report.Entries[0]; !strings.Contains(entry.Error, "server response headers exceeded") {
+		t.Errorf("100 KiB of headers: error %q, want the header limit", entry.Error)
+	}
+	if entry := report.Entries[1]; entry.Error != "" {
+		t.Errorf("1 KiB of headers: %s", entry.Error)
+	}
+}
+
+func TestTransportHeaderLimit(t *testing.T) {
+	if got := defaultTransport.MaxResponseHeaderBytes; got != 64<<10 {
+		t.Errorf("default transport header limit = %d, want 64 KiB", got)
+	}
+	setConfig(t, func(c *config) { c.MaxResponseHeaderBytes = 4096 })
+	if got := newTransport().MaxResponseHeaderBytes; got != 4096 {
+		t.Errorf("MAX_RESPONSE_HEADER_BYTES=4096: transport header limit = %d", got)
+	}
+}
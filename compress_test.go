@@ -0,0 +1,60 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipRequest sends a request accepting gzip to handler through
+// gzipMiddleware.
+func gzipRequest(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	gzipMiddleware(handler).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipSkipsArchives(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 4, 4))
+	body := `{"imageURLs":["` + upstream.URL + `/a.png"]}`
+
+	for _, format := range []string{"zip", "tar.gz"} {
+		req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(strings.Replace(body, "{", `{"format":"`+format+`",`, 1)))
+		rec := gzipRequest(downloadHandler, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %q", format, rec.Code, rec.Body.String())
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%s archive served with Content-Encoding %q", format, encoding)
+		}
+	}
+	if entries := zipEntries(t, gzipRequest(downloadHandler, httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body)))); len(entries) != 1 {
+		t.Errorf("archive has %d entries, want 1", len(entries))
+	}
+}
+
+func TestGzipCompressesJSON(t *testing.T) {
+	rec := gzipRequest(statusHandler, httptest.NewRequest(http.MethodGet, "/", nil))
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]string
+	if err := json.NewDecoder(reader).Decode(&status); err != nil || status["status"] != "active" {
+		t.Errorf("decoded %v, %v", status, err)
+	}
+}
+
+func TestCompressResponsesIsOffByDefault(t *testing.T) {
+	t.Setenv("COMPRESS_RESPONSES", "")
+	if loadConfig().CompressResponses {
+		t.Error("COMPRESS_RESPONSES defaults to true")
+	}
+}
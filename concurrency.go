@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// downloadLimiter bounds how many of a request's downloads run at once.
+type downloadLimiter interface {
+	acquire()
+	release(latency time.Duration, failed bool)
+}
+
+func newDownloadLimiter(request *downloadRequest) downloadLimiter {
+	if request.AdaptiveConcurrency {
+		return newAIMDLimiter(cfg.AdaptiveMinConcurrency, cfg.AdaptiveMaxConcurrency)
+	}
+	if cfg.Concurrency > 0 {
+		return make(fixedLimiter, cfg.Concurrency)
+	}
+	return unlimitedLimiter{}
+}
+
+// globalLimiter bounds the downloads running at once across all requests.
+// Workers take a slot from it after their request's own limiter, so the
+// process never runs more than MAX_GLOBAL_DOWNLOADS however many requests
+// are in flight.
+var globalLimiter = newGlobalLimiter()
+
+func newGlobalLimiter() downloadLimiter {
+	if cfg.MaxGlobalDownloads > 0 {
+		return make(fixedLimiter, cfg.MaxGlobalDownloads)
+	}
+	return unlimitedLimiter{}
+}
+
+// archiveLimiter bounds the archives being assembled at once across all
+// requests to MAX_ARCHIVE_BUILDS, independently of the download limits.
+var archiveLimiter = newArchiveLimiter()
+
+func newArchiveLimiter() downloadLimiter {
+	if cfg.MaxArchiveBuilds > 0 {
+		return make(fixedLimiter, cfg.MaxArchiveBuilds)
+	}
+	return unlimitedLimiter{}
+}
+
+type unlimitedLimiter struct{}
+
+func (unlimitedLimiter) acquire()                    {}
+func (unlimitedLimiter) release(time.Duration, bool) {}
+
+// fixedLimiter is a semaphore allowing up to cap(l) concurrent downloads.
+type fixedLimiter chan struct{}
+
+func (l fixedLimiter) acquire()                    { l <- struct{}{} }
+func (l fixedLimiter) release(time.Duration, bool) { <-l }
+
+// aimdLimiter adapts its concurrency with additive increase/multiplicative
+// decrease: each fast, successful download raises the limit by 1/limit, so
+// it grows by about one per round of downloads, while a failure or a download
+// taking more than twice the average latency halves it. The limit stays
+// within [min, max].
+type aimdLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	min, max float64
+	inFlight int
+	latency  time.Duration
+}
+
+func newAIMDLimiter(min, max int) *aimdLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	l := &aimdLimiter{limit: float64(min), min: float64(min), max: float64(max)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *aimdLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+func (l *aimdLimiter) release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+
+	slow := l.latency > 0 && latency > 2*l.latency
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency = (7*l.latency + latency) / 8
+	}
+
+	if failed || slow {
+		l.limit = max(l.min, l.limit/2)
+	} else {
+		l.limit = min(l.max, l.limit+1/l.limit)
+	}
+	l.cond.Broadcast()
+}
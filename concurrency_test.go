@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAIMDLimiterAdapts(t *testing.T) {
+	l := newAIMDLimiter(2, 8)
+	for i := 0; i < 40; i++ {
+		l.acquire()
+		l.release(10*time.Millisecond, false)
+	}
+	if l.limit != 8 {
+		t.Errorf("limit after fast successes = %v, want the maximum 8", l.limit)
+	}
+
+	l.acquire()
+	l.release(10*time.Millisecond, true)
+	if l.limit != 4 {
+		t.Errorf("limit after a failure = %v, want 4", l.limit)
+	}
+	l.acquire()
+	l.release(time.Second, false)
+	if l.limit != 2 {
+		t.Errorf("limit after a slow download = %v, want 2", l.limit)
+	}
+	l.acquire()
+	l.release(10*time.Millisecond, true)
+	if l.limit != 2 {
+		t.Errorf("limit fell below the minimum: %v", l.limit)
+	}
+}
+
+// concurrencyUpstream serves PNGs after delay, failing every request when
+// fail is set, and records the most requests it saw in flight at once.
+func concurrencyUpstream(t *testing.T, delay time.Duration, fail bool) (string, func() int) {
+	t.Helper()
+	image := pngImage(t, 2, 2)
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	server := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(delay)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	return server.URL, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return peak
+	}
+}
+
+func adaptiveBody(base string, n int) string {
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, `"`+base+"/"+strconv.Itoa(i)+`.png"`)
+	}
+	return `{"adaptiveConcurrency":true,"output":"local","destDir":"out","imageURLs":[` + strings.Join(urls, ",") + `]}`
+}
+
+func TestAdaptiveConcurrencyAgainstUpstreams(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.AdaptiveMinConcurrency, c.AdaptiveMaxConcurrency = 1, 6
+		c.RetryAttempts = 0
+	})
+
+	fast, fastPeak := concurrencyUpstream(t, 5*time.Millisecond, false)
+	postDownload(t, adaptiveBody(fast, 60))
+	if peak := fastPeak(); peak < 3 {
+		t.Errorf("healthy upstream saw at most %d downloads at once, want the limit to grow", peak)
+	}
+
+	failing, failingPeak := concurrencyUpstream(t, 5*time.Millisecond, true)
+	postDownload(t, adaptiveBody(failing, 30))
+	if peak := failingPeak(); peak != 1 {
+		t.Errorf("failing upstream saw %d downloads at once, want the minimum 1", peak)
+	}
+}
+
+// setGlobalLimit replaces the global download limiter with one of n slots
+// for the rest of the test.
+func setGlobalLimit(t *testing.T, n int) {
+	saved := globalLimiter
+	globalLimiter = make(fixedLimiter, n)
+	t.Cleanup(func() { globalLimiter = saved })
+}
+
+func TestGlobalLimitAcrossRequests(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	setGlobalLimit(t, 3)
+	upstream, peak := concurrencyUpstream(t, 20*time.Millisecond, false)
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var urls []string
+			for i := 0; i < 5; i++ {
+				urls = append(urls, `"`+upstream+"/"+strconv.Itoa(r)+"-"+strconv.Itoa(i)+`.png"`)
+			}
+			postDownload(t, `{"output":"local","destDir":"out`+strconv.Itoa(r)+`","imageURLs":[`+strings.Join(urls, ",")+`]}`)
+		}()
+	}
+	wg.Wait()
+	if got := peak(); got > 3 || got < 2 {
+		t.Errorf("upstream saw %d downloads at once across requests, want at most the global limit of 3", got)
+	}
+}
+
+// setArchiveLimit replaces archiveLimiter with a MAX_ARCHIVE_BUILDS of n
+// for the rest of the test.
+func setArchiveLimit(t *testing.T, n int) {
+	saved := archiveLimiter
+	archiveLimiter = make(fixedLimiter, n)
+	t.Cleanup(func() { archiveLimiter = saved })
+}
+
+// gatedWriter holds the first write of an archive until released.
+type gatedWriter struct {
+	started  chan struct{}
+	release  chan struct{}
+	once     sync.Once
+	released bool
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	g.once.Do(func() {
+		close(g.started)
+		<-g.release
+	})
+	return len(p), nil
+}
+
+func TestArchiveBuildsLimited(t *testing.T) {
+	format, _ := archiveFormatFor("tar")
+	report := archiveReport(t, t.TempDir(), 2, 100)
+
+	for _, limit := range []int{1, 2} {
+		setArchiveLimit(t, limit)
+
+		writers := make([]*gatedWriter, 5)
+		var wg sync.WaitGroup
+		for i := range writers {
+			writers[i] = &gatedWriter{started: make(chan struct{}), release: make(chan struct{})}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				writeArchive(writers[i], format, &downloadRequest{}, report)
+			}()
+		}
+
+		for done := 0; done < len(writers); {
+			time.Sleep(50 * time.Millisecond)
+			var building []*gatedWriter
+			for _, w := range writers {
+				select {
+				case <-w.started:
+					if !w.released {
+						building = append(building, w)
+					}
+				default:
+				}
+			}
+			if len(building) == 0 || len(building) > limit {
+				t.Fatalf("MAX_ARCHIVE_BUILDS=%d: %d archives building at once", limit, len(building))
+			}
+			for _, w := range building {
+				w.released = true
+				close(w.release)
+			}
+			done += len(building)
+		}
+		wg.Wait()
+	}
+}
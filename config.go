@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the server-wide settings read from the environment at startup.
+type config struct {
+	// CompressResponses gzips JSON and text responses for clients that
+	// accept it. Archives are never recompressed.
+	CompressResponses bool
+
+	// EnableUI serves a browser form at / and moves the JSON status to
+	// /status.
+	EnableUI bool
+
+	// AllowHosts, when non-empty, restricts downloads to matching hosts.
+	AllowHosts []string
+	// BlockHosts lists hosts that are never fetched.
+	BlockHosts []string
+	// BlockPrivateIPs refuses to connect to loopback, private and link-local
+	// addresses, whether given literally or resolved from a host name.
+	BlockPrivateIPs bool
+	// MixedAddresses decides what happens when a host name resolves to both
+	// allowed and private addresses: "reject" (default) refuses the host,
+	// "skip" dials only the allowed addresses.
+	MixedAddresses string
+	// ErrorBodies decides what happens to 200 responses carrying a JSON or
+	// text document instead of an image: "reject" (default) fails them
+	// with the document's message, "accept" saves them like any download.
+	ErrorBodies string
+	// UnknownContent decides what happens to downloads with no Content-Type,
+	// no recognized signature and no image extension to go by: "keep"
+	// (default) saves them as named, "bin" gives ".bin" instead of
+	// DefaultExtension to names that had no extension, and "reject" fails
+	// them.
+	UnknownContent string
+	// BlockCrossHostRedirects refuses redirects to a host other than the
+	// one a download started on.
+	BlockCrossHostRedirects bool
+	// MaxRedirectHostChanges limits how many times a redirect chain may
+	// move to a different host; 0 is unlimited.
+	MaxRedirectHostChanges int
+	// DataRedirects decides what happens to a redirect to a data: URI:
+	// "refuse" (default) fails the download, "follow" decodes the URI as
+	// the image.
+	DataRedirects string
+
+	// HostHeaders maps host patterns to headers sent with every download
+	// from a matching host.
+	HostHeaders map[string]map[string]string
+	// AcceptLanguage is the Accept-Language sent with every download unless
+	// HOST_HEADERS or the request gives one; empty sends none.
+	AcceptLanguage string
+
+	// TempProfiles maps the names trusted requests may give as tempProfile
+	// to the directories their scratch files are kept in.
+	TempProfiles map[string]string
+
+	// DestRoot is the directory request destDir values are resolved in.
+	// Without it destDir is ignored and every request uses a temporary
+	// directory.
+	DestRoot string
+	// DefaultDestDir is the destDir of requests that give none and are not
+	// ephemeral, such as "{yyyy}-{mm}-{dd}" for a folder per day. Empty
+	// keeps them in temporary directories.
+	DefaultDestDir string
+
+	// MaxURLListBytes limits the decompressed size of an uploaded URL list.
+	MaxURLListBytes int64
+
+	// MaxRequestBytes caps the bytes downloaded for one request; 0 is
+	// unlimited.
+	MaxRequestBytes int64
+	// MaxRequestMemory caps the memory one request's in-memory image
+	// transforms hold at once; 0 is unlimited.
+	MaxRequestMemory int64
+	// DestQuotaBytes caps the total size of the files in each destDir; 0 is
+	// unlimited.
+	DestQuotaBytes int64
+
+	// MaxMetaBytes limits the size of each entry's meta object.
+	MaxMetaBytes int
+
+	// UnicodeFilenames keeps non-ASCII letters and digits in generated
+	// filenames instead of folding or replacing them.
+	UnicodeFilenames bool
+	// DefaultExtension is given to names without an extension whose type
+	// cannot be determined from the download.
+	DefaultExtension string
+	// FormatQueryParams are query parameters that may name an image format,
+	// giving URLs without a path extension one.
+	FormatQueryParams []string
+
+	// MaxFilenameBytes caps the length of each component of a saved file's
+	// name, and so of each zip entry name. Zero disables the cap.
+	MaxFilenameBytes int
+
+	// MetricsMaxHosts caps the number of distinct host labels in the
+	// metrics; further hosts are counted under "other".
+	MetricsMaxHosts int
+
+	// AuditLog is a file to which every download decision is appended as a
+	// JSON line, or "-" for stdout. Empty disables the audit log.
+	AuditLog string
+	// SelfTestURL is a known-good image downloaded and archived at startup
+	// to check the pipeline works; empty skips the self-test.
+	SelfTestURL string
+	// SelfTestRequired makes a failed self-test stop the server.
+	SelfTestRequired bool
+
+	// ArchiveDelivery is "stream" (the default) to send archives as they are
+	// written, or "buffered" to build them completely first so they can be
+	// sent with a length and cached by ETag.
+	ArchiveDelivery string
+	// ArchiveCacheControl is the Cache-Control header of buffered archives.
+	ArchiveCacheControl string
+
+	// ArchiveFlushBytes is how much archive data is written between flushes
+	// of a streamed zip. Zero flushes after every entry.
+	ArchiveFlushBytes int64
+	// ArchiveTimeout bounds assembling an archive once its downloads have
+	// finished. Zero leaves it unbounded.
+	ArchiveTimeout time.Duration
+
+	// MinFreeFDs marks the service not ready, and rejects downloads, when
+	// fewer file descriptors than this remain available.
+	MinFreeFDs int
+	// HealthMode set to "load" makes /health report "degraded" while every
+	// MaxGlobalDownloads slot is taken, and marks the service not ready
+	// while more than HealthMaxQueued requests wait for one. "basic"
+	// (default) ignores load.
+	HealthMode      string
+	HealthMaxQueued int
+
+	// ConnectTimeout bounds establishing a connection to an upstream, while
+	// DownloadTimeout bounds each whole download.
+	ConnectTimeout  time.Duration
+	DownloadTimeout time.Duration
+	// MaxResponseHeaderBytes caps the header block read from an upstream
+	// response, so a hostile server cannot exhaust memory with it.
+	MaxResponseHeaderBytes int64
+
+	// HTTPProtocol forces "http1" or "http2" for all downloads; anything
+	// else negotiates automatically. HTTP1Hosts and HTTP2Hosts force a
+	// protocol for matching hosts only.
+	HTTPProtocol string
+	HTTP1Hosts   []string
+	HTTP2Hosts   []string
+
+	// ContentScan rejects downloads whose leading bytes identify them as a
+	// denied kind such as an executable or archive, regardless of extension.
+	ContentScan      bool
+	ContentScanDeny  []string
+	ContentScanAllow []string
+
+	// AllowedTypes restricts downloads to these media types. Strict requests
+	// fall back to a default image list when it is empty, and also enforce
+	// StrictMaxBytes and StrictMaxDimension when they are positive.
+	AllowedTypes       []string
+	StrictMaxBytes     int64
+	StrictMaxDimension int
+
+	// AllowedTypesCeiling bounds the allowedTypes a trusted request may ask
+	// for. When empty, requests may only narrow the default allowlist.
+	AllowedTypesCeiling []string
+
+	// TrustedAPIKeys authenticate callers allowed to relax server defaults.
+	TrustedAPIKeys []string
+
+	// Concurrency caps simultaneous downloads per request; 0 is unlimited.
+	// Requests asking for adaptive concurrency start at
+	// AdaptiveMinConcurrency and adjust up to AdaptiveMaxConcurrency.
+	Concurrency            int
+	AdaptiveMinConcurrency int
+	AdaptiveMaxConcurrency int
+	// KeepAliveMaxHosts disables connection reuse for requests whose
+	// downloads span more hosts than this, since each connection would
+	// only sit idle; 0 never disables it.
+	KeepAliveMaxHosts int
+	// MaxGlobalDownloads caps simultaneous downloads across all requests;
+	// 0 is unlimited.
+	MaxGlobalDownloads int
+	// MaxArchiveBuilds caps the archives assembled at once across all
+	// requests; further builds wait their turn. 0 is unlimited.
+	MaxArchiveBuilds int
+
+	// RetryAttempts is how many times a failed download is retried. Delays
+	// start at RetryBaseDelay and double up to RetryMaxDelay; with RetryJitter
+	// each delay is drawn uniformly between zero and that value.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	RetryJitter    bool
+
+	// RetryTokenTTL is how long the failed entries of a batch can be re-run
+	// with its retryToken. Zero disables retry tokens.
+	RetryTokenTTL time.Duration
+
+	// PostDownloadHook is a command run after each successful download. It is
+	// ignored unless EnablePostDownloadHook is also set.
+	PostDownloadHook       []string
+	EnablePostDownloadHook bool
+
+	// WebDAVURL is the collection that requests with output "webdav"
+	// upload their files to, authenticating with WebDAVUsername and
+	// WebDAVPassword when a username is set.
+	WebDAVURL      string
+	WebDAVUsername string
+	WebDAVPassword string
+}
+
+var cfg = loadConfig()
+
+func loadConfig() config {
+	return config{
+		CompressResponses: envBool("COMPRESS_RESPONSES", false),
+
+		EnableUI: envBool("ENABLE_UI", false),
+
+		AllowHosts: envList("ALLOW_HOSTS"),
+		BlockHosts: envList("BLOCK_HOSTS"),
+
+		BlockPrivateIPs:         envBool("BLOCK_PRIVATE_IPS", false),
+		MixedAddresses:          envString("MIXED_ADDRESSES", "reject"),
+		ErrorBodies:             envString("ERROR_BODIES", "reject"),
+		UnknownContent:          envString("UNKNOWN_CONTENT", "keep"),
+		BlockCrossHostRedirects: envBool("BLOCK_CROSS_HOST_REDIRECTS", false),
+		MaxRedirectHostChanges:  envInt("MAX_REDIRECT_HOST_CHANGES", 0),
+		DataRedirects:           envString("DATA_REDIRECTS", "refuse"),
+
+		HostHeaders:    envHostHeaders("HOST_HEADERS"),
+		AcceptLanguage: os.Getenv("ACCEPT_LANGUAGE"),
+
+		TempProfiles: envStringMap("TEMP_PROFILES"),
+
+		DestRoot:       os.Getenv("DEST_ROOT"),
+		DefaultDestDir: os.Getenv("DEFAULT_DEST_DIR"),
+
+		MaxURLListBytes: int64(envInt("MAX_URL_LIST_BYTES", 10<<20)),
+
+		MaxRequestBytes:  int64(envInt("MAX_REQUEST_BYTES", 0)),
+		MaxRequestMemory: int64(envInt("MAX_REQUEST_MEMORY", 0)),
+		DestQuotaBytes:   int64(envInt("DEST_QUOTA_BYTES", 0)),
+
+		MaxMetaBytes: envInt("MAX_META_BYTES", 4096),
+
+		UnicodeFilenames: envBool("UNICODE_FILENAMES", false),
+		DefaultExtension: envString("DEFAULT_EXTENSION", ".jpg"),
+		FormatQueryParams: strings.FieldsFunc(envString("FORMAT_QUERY_PARAMS", "format,fmt,type"), func(r rune) bool {
+			return r == ',' || r == ' '
+		}),
+
+		MaxFilenameBytes: envInt("MAX_FILENAME_BYTES", 255),
+
+		MetricsMaxHosts: envInt("METRICS_MAX_HOSTS", 100),
+
+		AuditLog: os.Getenv("AUDIT_LOG"),
+
+		SelfTestURL:      os.Getenv("SELF_TEST_URL"),
+		SelfTestRequired: envBool("SELF_TEST_REQUIRED", false),
+
+		ArchiveDelivery:     envString("ARCHIVE_DELIVERY", "stream"),
+		ArchiveCacheControl: envString("ARCHIVE_CACHE_CONTROL", "private, no-cache"),
+
+		ArchiveFlushBytes: int64(envInt("ARCHIVE_FLUSH_BYTES", 64<<10)),
+		ArchiveTimeout:    envDuration("ARCHIVE_TIMEOUT", 0),
+
+		MinFreeFDs:      envInt("MIN_FREE_FDS", 0),
+		HealthMode:      envString("HEALTH_MODE", "basic"),
+		HealthMaxQueued: envInt("HEALTH_MAX_QUEUED", 0),
+
+		ConnectTimeout:         envDuration("CONNECT_TIMEOUT", 10*time.Second),
+		DownloadTimeout:        envDuration("DOWNLOAD_TIMEOUT", 30*time.Second),
+		MaxResponseHeaderBytes: int64(envInt("MAX_RESPONSE_HEADER_BYTES", 64<<10)),
+
+		HTTPProtocol: strings.ToLower(os.Getenv("HTTP_PROTOCOL")),
+		HTTP1Hosts:   envList("HTTP1_HOSTS"),
+		HTTP2Hosts:   envList("HTTP2_HOSTS"),
+
+		ContentScan:      envBool("CONTENT_SCAN", false),
+		ContentScanDeny:  envList("CONTENT_SCAN_DENY"),
+		ContentScanAllow: envList("CONTENT_SCAN_ALLOW"),
+
+		AllowedTypes:       envMediaTypes("ALLOWED_TYPES"),
+		StrictMaxBytes:     int64(envInt("STRICT_MAX_BYTES", 0)),
+		StrictMaxDimension: envInt("STRICT_MAX_DIMENSION", 0),
+
+		AllowedTypesCeiling: envMediaTypes("ALLOWED_TYPES_CEILING"),
+
+		TrustedAPIKeys: envSecrets("TRUSTED_API_KEYS"),
+
+		Concurrency:            envInt("CONCURRENCY", 0),
+		AdaptiveMinConcurrency: envInt("ADAPTIVE_MIN_CONCURRENCY", 2),
+		AdaptiveMaxConcurrency: envInt("ADAPTIVE_MAX_CONCURRENCY", 32),
+		MaxGlobalDownloads:     envInt("MAX_GLOBAL_DOWNLOADS", 0),
+		MaxArchiveBuilds:       envInt("MAX_ARCHIVE_BUILDS", 0),
+		KeepAliveMaxHosts:      envInt("KEEPALIVE_MAX_HOSTS", 0),
+
+		RetryAttempts:  envInt("RETRY_ATTEMPTS", 0),
+		RetryBaseDelay: envDuration("RETRY_BASE_DELAY", 500*time.Millisecond),
+		RetryMaxDelay:  envDuration("RETRY_MAX_DELAY", 10*time.Second),
+		RetryJitter:    envBool("RETRY_JITTER", true),
+
+		RetryTokenTTL: envDuration("RETRY_TOKEN_TTL", 10*time.Minute),
+
+		PostDownloadHook:       strings.Fields(os.Getenv("POST_DOWNLOAD_HOOK")),
+		EnablePostDownloadHook: envBool("ENABLE_POST_DOWNLOAD_HOOK", false),
+
+		WebDAVURL:      os.Getenv("WEBDAV_URL"),
+		WebDAVUsername: os.Getenv("WEBDAV_USERNAME"),
+		WebDAVPassword: os.Getenv("WEBDAV_PASSWORD"),
+	}
+}
+
+// envSecrets reads a comma-separated environment variable of secrets,
+// keeping their case.
+func envSecrets(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envHostHeaders reads a JSON object mapping host patterns to header names
+// and values, ignoring the variable when it is invalid.
+func envHostHeaders(key string) map[string]map[string]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	var raw map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		log.Printf("Ignoring invalid %s: %v", key, err)
+		return nil
+	}
+	headers := make(map[string]map[string]string, len(raw))
+	for pattern, values := range raw {
+		headers[strings.ToLower(strings.TrimSpace(pattern))] = values
+	}
+	return headers
+}
+
+// envStringMap reads a JSON object of strings, ignoring the variable when it
+// is invalid.
+func envStringMap(key string) map[string]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		log.Printf("Ignoring invalid %s: %v", key, err)
+		return nil
+	}
+	return values
+}
+
+// envList reads a comma-separated environment variable, dropping blank items.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, strings.ToLower(item))
+		}
+	}
+	return list
+}
+
+// envMediaTypes reads a comma-separated list of media types, dropping their
+// parameters and invalid items.
+func envMediaTypes(key string) []string {
+	var list []string
+	for _, item := range envList(key) {
+		if mediaType := baseMediaType(item); mediaType != "" {
+			list = append(list, mediaType)
+		}
+	}
+	return list
+}
+
+// envString reads an environment variable, returning fallback when it is
+// unset.
+func envString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// envBool reads a boolean environment variable, returning fallback when it is
+// unset or invalid.
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envInt reads an integer environment variable, returning fallback when it is
+// unset or invalid.
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envDuration reads a duration such as "500ms" from the environment,
+// returning fallback when it is unset or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var errConnectionBudget = errors.New("connection budget exhausted")
+
+// connectionBudget caps the TCP connections a request may open. Its
+// downloads get transports of their own, so connections are reused across
+// the batch, and no more than limit are opened to any one host: downloads
+// beyond that wait for one to be reused. Once limit connections have been
+// opened in total, further dials fail; failed dials do not count. A nil
+// budget uses the shared transports.
+type connectionBudget struct {
+	limit  int64
+	opened atomic.Int64
+
+	mu sync.Mutex
+	// transports holds the transport of each host, keyed by lower-cased
+	// host name.
+	transports map[string]*http.Transport
+}
+
+func newConnectionBudget(limit int) *connectionBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &connectionBudget{limit: int64(limit), transports: make(map[string]*http.Transport)}
+}
+
+// transportFor returns the budget's transport for host, created on first
+// use with the protocol transportFor would pick. Every host gets a transport
+// of its own, while the total opened is shared across them.
+func (b *connectionBudget) transportFor(host string) http.RoundTripper {
+	if b == nil {
+		return transportFor(host)
+	}
+	host = strings.ToLower(host)
+	protocol := protocolFor(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if transport, ok := b.transports[host]; ok {
+		return transport
+	}
+	transport := newTransport()
+	if protocol != "" {
+		transport = newProtocolTransport(protocol)
+	}
+	transport.MaxConnsPerHost = int(b.limit)
+	transport.MaxIdleConnsPerHost = int(b.limit)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		// A connection is counted while it is dialed, so concurrent dials
+		// cannot overshoot the limit, and given back if the dial fails.
+		if b.opened.Add(1) > b.limit {
+			b.opened.Add(-1)
+			return nil, errConnectionBudget
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			b.opened.Add(-1)
+		}
+		return conn, err
+	}
+	b.transports[host] = transport
+	return transport
+}
+
+// close closes the idle connections of the budget's transports once the
+// request is done with them.
+func (b *connectionBudget) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, transport := range b.transports {
+		transport.CloseIdleConnections()
+	}
+}
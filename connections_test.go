@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingServer serves a PNG and counts the connections opened to it.
+func countingServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	body := pngImage(t, 2, 2)
+	var opened atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &opened
+}
+
+func TestConnectionBudgetCapsBatch(t *testing.T) {
+	server, opened := countingServer(t)
+	var urls []string
+	for i := 0; i < 8; i++ {
+		urls = append(urls, `"`+server.URL+"/"+strconv.Itoa(i)+`.png"`)
+	}
+
+	rec := postDownload(t, `{"maxConnections":2,"imageURLs":[`+strings.Join(urls, ",")+`]}`)
+	if entries := zipEntries(t, rec); len(entries) != 8 {
+		t.Errorf("archive has %d entries, want 8", len(entries))
+	}
+	if n := opened.Load(); n > 2 {
+		t.Errorf("batch opened %d connections, budget is 2", n)
+	}
+}
+
+func TestConnectionBudgetIgnoresFailedDials(t *testing.T) {
+	server, _ := countingServer(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + closed.Addr().String() + "/a.png"
+	closed.Close()
+
+	budget := newConnectionBudget(1)
+	defer budget.close()
+	client := &http.Client{Transport: budget.transportFor("127.0.0.1")}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(closedURL); err == nil || errors.Is(err, errConnectionBudget) {
+			t.Fatalf("dial to a closed port: %v", err)
+		}
+	}
+	// The connection is not kept, so the next request must dial again.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/a.png", nil)
+	req.Close = true
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed dials used up the budget: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if _, err := client.Get(server.URL + "/b.png"); !errors.Is(err, errConnectionBudget) {
+		t.Errorf("second connection: err = %v, want %v", err, errConnectionBudget)
+	}
+}
+
+func TestConnectionBudgetSharedAcrossHosts(t *testing.T) {
+	server, _ := countingServer(t)
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	budget := newConnectionBudget(1)
+	defer budget.close()
+	first := budget.transportFor("127.0.0.1")
+	if again := budget.transportFor("127.0.0.1"); again != first {
+		t.Error("the same host got a second transport")
+	}
+	if budget.transportFor("LOCALHOST") != budget.transportFor("localhost") {
+		t.Error("host case gave different transports")
+	}
+	if budget.transportFor("localhost") == first {
+		t.Error("two hosts share a transport")
+	}
+
+	resp, err := (&http.Client{Transport: first}).Get(server.URL + "/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// The idle connection to 127.0.0.1 still counts against the budget.
+	if _, err := (&http.Client{Transport: budget.transportFor("localhost")}).Get(other + "/b.png"); !errors.Is(err, errConnectionBudget) {
+		t.Errorf("connection to a second host: err = %v, want %v", err, errConnectionBudget)
+	}
+}
+
+func TestConnectionBudgetKeepsProtocolNegotiation(t *testing.T) {
+	setConfig(t, func(c *config) { c.HTTPProtocol, c.HTTP1Hosts = "", []string{"old.example"} })
+
+	budget := newConnectionBudget(4)
+	auto := budget.transportFor("example.com").(*http.Transport)
+	if auto.Protocols != nil && !auto.Protocols.HTTP2() {
+		t.Errorf("auto transport protocols = %v, want HTTP/2 allowed", auto.Protocols)
+	}
+	if forced := budget.transportFor("old.example").(*http.Transport); forced.Protocols == nil || forced.Protocols.HTTP2() {
+		t.Errorf("http1 transport protocols = %v, want HTTP/1 only", forced.Protocols)
+	}
+}
+
+func TestCountHosts(t *testing.T) {
+	entries := []imageEntry{
+		{URL: "https://a.example/1.png", Mirrors: []string{"https://B.example/1.png"}},
+		{URL: "https://A.example/2.png"},
+		{URL: "https://a.example:8443/3.png"},
+	}
+	if got := countHosts(entries); got != 3 {
+		t.Errorf("countHosts = %d, want 3", got)
+	}
+}
+
+func TestManyHostBatchesCloseConnections(t *testing.T) {
+	// maxConnections gives the request its own transport, which keeps
+	// connections alive unless a download asks to close them.
+	for _, tt := range []struct {
+		maxHosts int
+		close    bool
+	}{{1, true}, {2, false}, {0, false}} {
+		var closed, requests atomic.Int64
+		server := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.Close {
+				closed.Add(1)
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngImage(t, 1, 1))
+		})
+		// The server closes every connection itself, so none is pooled
+		// whatever the request asks for.
+		server.Config.SetKeepAlivesEnabled(false)
+		other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+		setConfig(t, func(c *config) { c.KeepAliveMaxHosts = tt.maxHosts; c.Concurrency = 1 })
+
+		rec := postDownload(t, `{"maxConnections":10,"imageURLs":["`+server.URL+`/a.png","`+other+`/b.png","`+server.URL+`/c.png"]}`)
+		zipEntries(t, rec)
+		want := int64(0)
+		if tt.close {
+			want = 3
+		}
+		if closed.Load() != want || requests.Load() != 3 {
+			t.Errorf("KEEPALIVE_MAX_HOSTS %d: %d of %d requests asked to close, want %d", tt.maxHosts, closed.Load(), requests.Load(), want)
+		}
+	}
+}
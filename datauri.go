@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dataRedirect stops a redirect chain at a data: URI, which the transport
+// cannot fetch, so the download can decode it instead. It is returned
+// from CheckRedirect when DATA_REDIRECTS is "follow".
+type dataRedirect struct {
+	uri   *url.URL
+	proto string
+}
+
+func (d *dataRedirect) Error() string { return "redirect to a data: URI" }
+
+// response decodes the data: URI into a 200 response carrying its bytes
+// and media type. The response's URL names only the media type, as the
+// URI itself may be large.
+func (d *dataRedirect) response() (*http.Response, error) {
+	mediaType, data, err := decodeDataURI(d.uri)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	if mediaType != "" {
+		header.Set("Content-Type", mediaType)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         d.proto,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       &http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "data", Opaque: mediaType}},
+	}, nil
+}
+
+// decodeDataURI splits an RFC 2397 data: URI into its media type and
+// decoded bytes.
+func decodeDataURI(u *url.URL) (string, []byte, error) {
+	raw := strings.TrimPrefix(u.String(), "data:")
+	meta, payload, ok := strings.Cut(raw, ",")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid data: URI: missing ','")
+	}
+	encoded := strings.HasSuffix(meta, ";base64")
+	meta = strings.TrimSuffix(meta, ";base64")
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data: URI: %v", err)
+	}
+	if !encoded {
+		return meta, []byte(data), nil
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid data: URI: %v", err)
+	}
+	return meta, decoded, nil
+}
+
+// abbreviateURL shortens u for error messages, keeping data: URIs from
+// filling them with their payload.
+func abbreviateURL(u *url.URL) string {
+	s := u.String()
+	if u.Scheme != "data" || len(s) <= 64 {
+		return s
+	}
+	return s[:48] + "... (" + strconv.Itoa(len(s)) + " bytes)"
+}
+
+// abbreviateURLError shortens the URL quoted by a client *url.Error, which
+// for a refused redirect is the redirect's target.
+func abbreviateURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			urlErr.URL = abbreviateURL(u)
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDataURI(t *testing.T) {
+	tests := []struct {
+		uri       string
+		mediaType string
+		data      string
+		wantErr   bool
+	}{
+		{"data:image/png;base64,aGVsbG8=", "image/png", "hello", false},
+		{"data:image/png;base64,aGVsbG8", "image/png", "hello", false},
+		{"data:image/svg+xml,%3Csvg%2F%3E", "image/svg+xml", "<svg/>", false},
+		{"data:,plain", "", "plain", false},
+		{"data:image/png;base64", "", "", true},
+		{"data:image/png;base64,not*base64", "", "", true},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, data, err := decodeDataURI(u)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %t", tt.uri, err, tt.wantErr)
+			continue
+		}
+		if mediaType != tt.mediaType || string(data) != tt.data {
+			t.Errorf("%s: decoded %q, %q; want %q, %q", tt.uri, mediaType, data, tt.mediaType, tt.data)
+		}
+	}
+}
+
+func TestAbbreviateURL(t *testing.T) {
+	long, _ := url.Parse("data:image/png;base64," + strings.Repeat("A", 200))
+	if got := abbreviateURL(long); len(got) > 80 || !strings.HasSuffix(got, "... (222 bytes)") {
+		t.Errorf("abbreviateURL(long data: URI) = %q", got)
+	}
+	short, _ := url.Parse("data:,x")
+	if got := abbreviateURL(short); got != "data:,x" {
+		t.Errorf("abbreviateURL(short data: URI) = %q", got)
+	}
+	other, _ := url.Parse("https://example.com/" + strings.Repeat("a", 200))
+	if got := abbreviateURL(other); got != other.String() {
+		t.Errorf("abbreviateURL shortened an https URL to %q", got)
+	}
+}
+
+func TestDataRedirects(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	dataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, dataURI, http.StatusFound)
+	})
+	imageURL := upstream.URL + "/inline.png"
+
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	report := decodeReport(t, postDownload(t, `{"output":"local","destDir":"refuse","imageURLs":["`+imageURL+`"]}`))
+	entry := report.Entries[0]
+	if entry.BlockedBy != "scheme" || !strings.Contains(entry.Error, "refusing redirect to data:image/png") {
+		t.Errorf("DATA_REDIRECTS=refuse: blockedBy %q, error %q; want a scheme refusal", entry.BlockedBy, entry.Error)
+	}
+	if strings.Contains(entry.Error, dataURI) {
+		t.Errorf("refusal quotes the whole data: URI: %q", entry.Error)
+	}
+
+	setConfig(t, func(c *config) { c.DataRedirects = "follow" })
+	rec := postDownload(t, `{"imageURLs":["`+imageURL+`"]}`)
+	if got := zipEntries(t, rec)["inline.png"]; !bytes.Equal(got, image) {
+		t.Errorf("DATA_REDIRECTS=follow: archived %d bytes, want the %d decoded from the URI", len(got), len(image))
+	}
+	report = decodeReport(t, postDownload(t, `{"output":"local","destDir":"follow","imageURLs":["`+imageURL+`"]}`))
+	if entry := report.Entries[0]; entry.Error != "" || entry.FinalURL != "data:image/png" {
+		t.Errorf("DATA_REDIRECTS=follow: error %q, finalURL %q; want no error and data:image/png", entry.Error, entry.FinalURL)
+	}
+}
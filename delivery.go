@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveBufferedArchive builds the whole archive in a temporary file in dir
+// before sending any of it. The response then carries a Content-Length, an
+// ETag of the archive's SHA-256 and ARCHIVE_CACHE_CONTROL; a matching
+// If-None-Match is answered with 304. A failure finalizing the archive
+// becomes a 500, or a 504 past ARCHIVE_TIMEOUT, instead of a truncated
+// download.
+func serveBufferedArchive(w http.ResponseWriter, r *http.Request, dir string, format archiveFormat, request *downloadRequest, report *downloadReport, timer *phaseTimer) {
+	file, err := os.CreateTemp(dir, "archive-")
+	if err != nil {
+		log.Println("Failed to create archive file:", err)
+		http.Error(w, "Failed to build archive", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	archiveStart := time.Now()
+	total, err := writeArchive(io.MultiWriter(file, digest), format, request, report)
+	timer.archived(archiveStart)
+	if errors.Is(err, errArchiveTimeout) {
+		log.Println("Failed to finalize archive:", err)
+		http.Error(w, "Archive timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to finalize archive:", err)
+		http.Error(w, "Failed to build archive", http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + hex.EncodeToString(digest.Sum(nil)) + `"`
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Server-Timing", timer.serverTiming())
+	if cfg.ArchiveCacheControl != "" {
+		header.Set("Cache-Control", cfg.ArchiveCacheControl)
+	}
+	// Downloads are POSTs, for which http.ServeContent answers a matching
+	// If-None-Match with 412, so the 304 is sent here.
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		header.Del("Content-Type")
+		header.Del("Content-Disposition")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("X-Succeeded", strconv.Itoa(report.Succeeded))
+	header.Set("X-Failed", strconv.Itoa(report.Failed))
+	header.Set("X-Total-Bytes", strconv.FormatInt(total, 10))
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag,
+// comparing weakly as RFC 9110 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// postConditional sends body to downloadHandler with an If-None-Match
+// header, when ifNoneMatch is set.
+func postConditional(t *testing.T, body, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, req)
+	return rec
+}
+
+func TestBufferedArchiveCaching(t *testing.T) {
+	setConfig(t, func(c *config) { c.ArchiveDelivery = "buffered"; c.ArchiveCacheControl = "public, max-age=60" })
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	body := `{"imageURLs":["` + upstream.URL + `/a.png","` + upstream.URL + `/b.png"]}`
+
+	rec := postConditional(t, body, "")
+	entries := zipEntries(t, rec)
+	etag := rec.Header().Get("ETag")
+	if len(entries) != 2 || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("%d entries, ETag %q", len(entries), etag)
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %q for a %d byte body", rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+	if rec.Header().Get("Cache-Control") != "public, max-age=60" || rec.Header().Get("X-Succeeded") != "2" {
+		t.Errorf("Cache-Control %q, X-Succeeded %q", rec.Header().Get("Cache-Control"), rec.Header().Get("X-Succeeded"))
+	}
+
+	for ifNoneMatch, status := range map[string]int{
+		etag:                 http.StatusNotModified,
+		"W/" + etag:          http.StatusNotModified,
+		`"other", ` + etag:   http.StatusNotModified,
+		"*":                  http.StatusNotModified,
+		`"0123456789abcdef"`: http.StatusOK,
+	} {
+		rec := postConditional(t, body, ifNoneMatch)
+		if rec.Code != status {
+			t.Errorf("If-None-Match %s: status %d, want %d", ifNoneMatch, rec.Code, status)
+		}
+		if status == http.StatusNotModified && (rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag) {
+			t.Errorf("If-None-Match %s: 304 with %d byte body and ETag %q", ifNoneMatch, rec.Body.Len(), rec.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestBufferedManifestArchiveCaching(t *testing.T) {
+	setConfig(t, func(c *config) { c.ArchiveDelivery = "buffered" })
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	body := `{"manifest":true,"imageURLs":["` + upstream.URL + `/a.png"]}`
+
+	rec := postConditional(t, body, "")
+	if manifest := zipEntries(t, rec)["manifest.json"]; manifest == nil || strings.Contains(string(manifest), "timings") {
+		t.Errorf("manifest.json %s, want one without timings", manifest)
+	}
+	if rec := postConditional(t, body, rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Errorf("repeated batch with its ETag: status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestStreamedArchiveHasNoETag(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	server := httptestServer(t, downloadHandler)
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"imageURLs":["`+upstream.URL+`/a.png"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("ETag") != "" || resp.ContentLength != -1 {
+		t.Errorf("streamed archive has ETag %q and length %d", resp.Header.Get("ETag"), resp.ContentLength)
+	}
+}
+
+func TestDeliveryOption(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	server := httptestServer(t, downloadHandler)
+
+	tests := []struct {
+		serverDefault, delivery string
+		buffered                bool
+	}{
+		{"stream", "", false},
+		{"stream", "buffered", true},
+		{"buffered", "", true},
+		{"buffered", "stream", false},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.ArchiveDelivery = tt.serverDefault })
+		body := `{"delivery":"` + tt.delivery + `","imageURLs":["` + upstream.URL + `/a.png"]}`
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("ARCHIVE_DELIVERY=%s, delivery %q: status %d, %v", tt.serverDefault, tt.delivery, resp.StatusCode, err)
+		}
+
+		name := "ARCHIVE_DELIVERY=" + tt.serverDefault + ", delivery " + strconv.Quote(tt.delivery)
+		if tt.buffered {
+			if resp.ContentLength != int64(len(archive)) || resp.Header.Get("ETag") == "" || resp.Header.Get("X-Succeeded") != "1" {
+				t.Errorf("%s: length %d for %d bytes, ETag %q, X-Succeeded header %q; want a buffered archive",
+					name, resp.ContentLength, len(archive), resp.Header.Get("ETag"), resp.Header.Get("X-Succeeded"))
+			}
+		} else {
+			if resp.ContentLength != -1 || resp.Header.Get("ETag") != "" || resp.Trailer.Get("X-Succeeded") != "1" {
+				t.Errorf("%s: length %d, ETag %q, X-Succeeded trailer %q; want a streamed archive",
+					name, resp.ContentLength, resp.Header.Get("ETag"), resp.Trailer.Get("X-Succeeded"))
+			}
+		}
+	}
+
+	if rec := postDownload(t, `{"delivery":"chunked","imageURLs":["`+upstream.URL+`/a.png"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid delivery: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
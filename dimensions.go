@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// describeImage reads the width, height and format of the image at path.
+// Raster formats come from image.DecodeConfig, which reads only the header;
+// SVGs from the root element's attributes. Formats neither can read report
+// only their format.
+func describeImage(path string) (width, height int, format string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, "", err
+	}
+
+	switch mediaType := sniffImageType(head); mediaType {
+	case "image/svg+xml":
+		width, height, err = svgDimensions(file)
+		return width, height, "svg", err
+	case "image/jpeg", "image/png", "image/gif":
+		config, format, err := image.DecodeConfig(file)
+		return config.Width, config.Height, format, err
+	case "":
+		return 0, 0, "", fmt.Errorf("unrecognized image format")
+	default:
+		return 0, 0, formatName(mediaType), nil
+	}
+}
+
+// formatName turns a media type such as "image/webp" into a format name.
+func formatName(mediaType string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(mediaType, "image/"), "+")
+	if name == "x-icon" {
+		return "ico"
+	}
+	return name
+}
+
+// svgDimensions returns the size of an SVG from its root element: the width
+// and height attributes when given in pixels or without a unit, or else the
+// viewBox. Sizes it cannot tell are zero.
+func svgDimensions(r io.Reader) (int, int, error) {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid SVG: %v", err)
+		}
+		root, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var width, height int
+		var viewBox []string
+		for _, attr := range root.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				viewBox = strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ' ' || r == ',' })
+			}
+		}
+		if len(viewBox) == 4 {
+			if width == 0 {
+				width = svgLength(viewBox[2])
+			}
+			if height == 0 {
+				height = svgLength(viewBox[3])
+			}
+		}
+		return width, height, nil
+	}
+}
+
+// svgLength parses a length such as "120" or "120.5px", returning zero for
+// other units and percentages.
+func svgLength(value string) int {
+	number, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "px"), 64)
+	if err != nil || number <= 0 || number > math.MaxInt32 {
+		return 0
+	}
+	return int(math.Round(number))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSVGDimensions(t *testing.T) {
+	tests := []struct {
+		svg           string
+		width, height int
+	}{
+		{`<svg width="120" height="80"/>`, 120, 80},
+		{`<svg width="120.4px" height="79.6px"/>`, 120, 80},
+		{`<svg viewBox="0 0 300 150"/>`, 300, 150},
+		{`<svg viewBox="0,0,300,150" width="64"/>`, 64, 150},
+		{`<svg width="50%" height="2cm"/>`, 0, 0},
+		{`<?xml version="1.0"?><!-- comment --><svg width="10" height="20"/>`, 10, 20},
+	}
+	for _, tt := range tests {
+		width, height, err := svgDimensions(strings.NewReader(tt.svg))
+		if err != nil || width != tt.width || height != tt.height {
+			t.Errorf("svgDimensions(%s) = %d, %d, %v; want %d, %d", tt.svg, width, height, err, tt.width, tt.height)
+		}
+	}
+	if _, _, err := svgDimensions(strings.NewReader("")); err == nil {
+		t.Error("empty SVG: no error")
+	}
+}
+
+func TestIncludeDimensionsInManifest(t *testing.T) {
+	png := pngImage(t, 7, 5)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/b.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(baselineJPEG(t))
+		default:
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 48 32"/>`))
+		}
+	})
+
+	urls := `["` + upstream.URL + `/a.png","` + upstream.URL + `/b.jpg","` + upstream.URL + `/c.svg"]`
+	rec := postDownload(t, `{"manifest":true,"includeDimensions":true,"imageURLs":`+urls+`}`)
+	var manifest downloadReport
+	if err := json.Unmarshal(zipEntries(t, rec)["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	want := []struct {
+		width, height int
+		format        string
+	}{
+		{7, 5, "png"},
+		{8, 8, "jpeg"},
+		{48, 32, "svg"},
+	}
+	for i, entry := range manifest.Entries {
+		if entry.Width != want[i].width || entry.Height != want[i].height || entry.Format != want[i].format {
+			t.Errorf("%s: %dx%d %q, want %dx%d %q", entry.URL, entry.Width, entry.Height, entry.Format, want[i].width, want[i].height, want[i].format)
+		}
+	}
+
+	rec = postDownload(t, `{"manifest":true,"imageURLs":`+urls+`}`)
+	if manifest := zipEntries(t, rec)["manifest.json"]; strings.Contains(string(manifest), `"width"`) {
+		t.Errorf("manifest without includeDimensions has sizes: %s", manifest)
+	}
+}
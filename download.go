@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sniffLen is the number of leading bytes inspected to identify content.
+const sniffLen = 512
+
+// maxRedirects matches the limit of http.Client's default redirect policy.
+const maxRedirects = 10
+
+var errTruncated = errors.New("truncated download")
+
+type downloadRequest struct {
+	ImageURLs []imageEntry `json:"imageURLs"`
+	// DestDir keeps the files in a directory under DEST_ROOT.
+	DestDir string `json:"destDir"`
+	// Ephemeral keeps the files in a temporary directory removed after the
+	// request, even when DEFAULT_DEST_DIR is set.
+	Ephemeral bool `json:"ephemeral"`
+	// OnConflict decides what happens when a file already exists in DestDir:
+	// "rename" (default), "overwrite", "skip", or "content".
+	OnConflict string `json:"onConflict"`
+	// Duplicates decides what happens to entries whose URLs are the same once
+	// normalized: "keep" (default) downloads each and suffixes the later
+	// names, "collapse" downloads the URL once and reports the others as
+	// duplicates of it.
+	Duplicates string `json:"duplicates"`
+	// Seed makes collision suffixes a hash of the seed and URL instead of a
+	// counter.
+	Seed string `json:"seed"`
+	// Output is "zip" (default) to return an archive, "local" to leave the
+	// files in DestDir and return only the JSON report, "stream" to leave
+	// them there and stream each result as it completes, or "webdav" to
+	// upload them to WEBDAV_URL and return the JSON report.
+	Output string `json:"output"`
+	// Format is the archive format: "zip" (default), "tar" or "tar.gz".
+	Format string `json:"format"`
+	// VerifyFirst probes every entry before downloading any, and downloads
+	// nothing unless all of them can be reached.
+	VerifyFirst bool `json:"verifyFirst"`
+	// Pipeline archives each download as soon as it completes instead of
+	// after the whole batch, so entries follow completion order.
+	Pipeline bool `json:"pipeline"`
+	// Delivery is "stream" or "buffered", overriding ARCHIVE_DELIVERY for
+	// the request's archive.
+	Delivery string `json:"delivery"`
+	// ArchiveComment is stored as the zip archive's comment.
+	ArchiveComment string `json:"archiveComment"`
+	// FileMode is the octal permission given to archive entries, such as
+	// "0444" for read-only files; "0644" by default.
+	FileMode string `json:"fileMode"`
+	// Strict accepts only 200 responses with an allowed image content type
+	// and a non-empty body that decodes within the configured bounds.
+	Strict bool `json:"strict"`
+	// JPEGScan set to "baseline" re-encodes progressive JPEGs as baseline.
+	JPEGScan string `json:"jpegScan"`
+	// Optimize losslessly recompresses PNG images. JPEGs cannot be
+	// optimized losslessly and are kept unchanged.
+	Optimize bool `json:"optimize"`
+	// EmbedProvenance writes the source URL and fetch time into the XMP
+	// metadata of JPEG, PNG and WebP images.
+	EmbedProvenance bool `json:"embedProvenance"`
+	// Headers are sent with every download, overriding HOST_HEADERS.
+	Headers map[string]string `json:"headers"`
+	// AcceptLanguage is sent as the Accept-Language of every download,
+	// overriding ACCEPT_LANGUAGE and HOST_HEADERS but not Headers.
+	AcceptLanguage string `json:"acceptLanguage"`
+	// NormalizeText rewrites text-based images such as SVG as UTF-8
+	// without a byte order mark.
+	NormalizeText bool `json:"normalizeText"`
+	// UseContentDisposition names files after the upstream
+	// Content-Disposition filename when one is given.
+	UseContentDisposition bool `json:"useContentDisposition"`
+	// DispositionExtension resolves a Content-Disposition extension that
+	// disagrees with the downloaded format: "content" (default) keeps the
+	// base name and swaps in the format's extension, "keep" leaves the name
+	// as the upstream gave it.
+	DispositionExtension string `json:"dispositionExtension"`
+	// FilenameEncoding overrides UNICODE_FILENAMES for the request's names:
+	// "ascii" folds or replaces non-ASCII characters, "utf8" keeps anything
+	// but path separators and control characters.
+	FilenameEncoding string `json:"filenameEncoding"`
+	// WindowsSafe, on unless set to false, rewrites names Windows cannot
+	// extract, such as "CON.jpg" or names ending in a dot.
+	WindowsSafe *bool `json:"windowsSafe"`
+	// PathTemplate places entries in folders, e.g. "{host}/{yyyy}/{mm}".
+	PathTemplate string `json:"pathTemplate"`
+	// OrderBy sets the order of archive entries: "input" (default), "name",
+	// "size", or "sizeDesc".
+	OrderBy string `json:"orderBy"`
+	// TraceRedirects records each download's redirect chain in the report.
+	TraceRedirects bool `json:"traceRedirects"`
+	// UseCookies keeps cookies set during a download's redirects for its
+	// later same-host hops. Each download gets its own empty jar.
+	UseCookies bool `json:"useCookies"`
+	// AdaptiveConcurrency tunes how many downloads run at once from observed
+	// latency and errors, within the configured bounds.
+	AdaptiveConcurrency bool `json:"adaptiveConcurrency"`
+	// RequireHTTPS refuses plain http:// image URLs and redirects to them.
+	RequireHTTPS bool `json:"requireHTTPS"`
+	// AllowedTypes replaces the content-type allowlist for this request.
+	// It requires a trusted API key and must lie within
+	// ALLOWED_TYPES_CEILING.
+	AllowedTypes []string `json:"allowedTypes"`
+	// RequireTypeAgreement rejects downloads whose sniffed bytes,
+	// Content-Type and URL extension disagree about the format.
+	RequireTypeAgreement bool `json:"requireTypeAgreement"`
+	// Manifest adds a manifest.json entry describing every download.
+	Manifest bool `json:"manifest"`
+	// Normalize converts every image to one format and resolution.
+	Normalize *normalizeOptions `json:"normalize"`
+	// IncludeDimensions records each image's width, height and format in
+	// the report.
+	IncludeDimensions bool `json:"includeDimensions"`
+	// Index adds an index.html gallery of the downloaded images.
+	Index bool `json:"index"`
+	// MaxImages caps the number of URLs processed. Overflow selects whether a
+	// longer list is rejected ("error", the default) or cut short ("truncate").
+	MaxImages int    `json:"maxImages"`
+	Overflow  string `json:"overflow"`
+	// MaxTotalBytes is the byte budget of the whole request, capped by
+	// MAX_REQUEST_BYTES. Once a download crosses it, that download fails and
+	// the remaining ones are skipped.
+	MaxTotalBytes int64 `json:"maxTotalBytes"`
+	// TempProfile names one of TEMP_PROFILES to keep the request's scratch
+	// files in; it needs a trusted API key.
+	TempProfile string `json:"tempProfile"`
+	// MaxConnections caps the TCP connections the request opens in total.
+	MaxConnections int `json:"maxConnections"`
+	// RetryStatusCodes adds 4xx status codes, such as 408 or 429, to the
+	// ones RETRY_ATTEMPTS retries.
+	RetryStatusCodes []int `json:"retryStatusCodes"`
+	// RetryToken re-runs the failed entries of an earlier batch, with that
+	// batch's options, in place of the rest of the request.
+	RetryToken string `json:"retryToken"`
+
+	// trusted is set when the caller presented one of TRUSTED_API_KEYS.
+	trusted bool
+	// budget counts the request's downloaded bytes against MaxTotalBytes.
+	budget *byteBudget
+	// memory bounds the request's in-memory transforms to
+	// MAX_REQUEST_MEMORY.
+	memory *memoryBudget
+	// fileMode is the parsed FileMode, or 0 for the default.
+	fileMode os.FileMode
+	// quotaFree is the space left in DestDir under DEST_QUOTA_BYTES, or 0
+	// when it has no quota.
+	quotaFree int64
+	// connections holds the request's own transports when it set
+	// MaxConnections.
+	connections *connectionBudget
+	// closeConnections disables keep-alive for the request's downloads; it
+	// is set when they span more than KEEPALIVE_MAX_HOSTS hosts.
+	closeConnections bool
+}
+
+// imageEntry is one item of the imageURLs list. It is either a plain URL
+// string or an object carrying per-image options.
+type imageEntry struct {
+	URL string `json:"url"`
+	// Mirrors are tried in order when URL cannot be downloaded.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// UploadURL is a presigned PUT URL the image is streamed to instead of
+	// being added to the archive.
+	UploadURL string `json:"uploadURL,omitempty"`
+	// Meta is copied verbatim into the entry's manifest record.
+	Meta json.RawMessage `json:"meta,omitempty"`
+	// ExpectedSHA256 is the hex digest the downloaded bytes must match. An
+	// entry with an UploadURL is verified before it is uploaded.
+	ExpectedSHA256 string `json:"expectedSha256,omitempty"`
+	// Required entries fail the whole batch when they fail.
+	Required bool `json:"required,omitempty"`
+	// Filename names the entry's file whichever attempt serves it, in place
+	// of the name taken from its URL, Content-Disposition and type.
+	Filename string `json:"filename,omitempty"`
+}
+
+func (e *imageEntry) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.URL); err == nil {
+		return nil
+	}
+	type plainEntry imageEntry
+	return json.Unmarshal(data, (*plainEntry)(e))
+}
+
+// downloadResult records the outcome of downloading one imageEntry.
+type downloadResult struct {
+	URL      string          `json:"url"`
+	Source   string          `json:"source,omitempty"`
+	Filename string          `json:"filename"`
+	Bytes    int64           `json:"bytes,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Meta     json.RawMessage `json:"meta,omitempty"`
+	// FinalURL is the URL the image was served from once redirects were
+	// followed, when it differs from Source.
+	FinalURL string `json:"finalURL,omitempty"`
+	// ContentType is the media type resolved from the downloaded bytes,
+	// Content-Type header and URL extension, in that order of precedence.
+	ContentType string `json:"contentType,omitempty"`
+	// ContentTypeUnknown is set when nothing told the downloaded type, so
+	// the file was saved under UNKNOWN_CONTENT.
+	ContentTypeUnknown bool `json:"contentTypeUnknown,omitempty"`
+	// Protocol is the HTTP version the image was served over, such as
+	// "HTTP/1.0". Bodies of HTTP/1.0 and Connection: close responses
+	// without a length are read until the server closes the connection,
+	// which is then not reused.
+	Protocol string `json:"protocol,omitempty"`
+	// BlockedBy names the policy rule that refused the download, if any.
+	BlockedBy string `json:"blockedBy,omitempty"`
+	// UploadStatus is the status returned by the entry's UploadURL.
+	UploadStatus int `json:"uploadStatus,omitempty"`
+	// WebDAVPath is where the file was uploaded under WEBDAV_URL.
+	WebDAVPath string `json:"webdavPath,omitempty"`
+	// Existing is set when a file of the same name was already in DestDir and
+	// was left in place.
+	Existing bool `json:"existing,omitempty"`
+	// NotOptimized gives the reason an optimize request kept the image as
+	// downloaded, such as for JPEGs.
+	NotOptimized string `json:"notOptimized,omitempty"`
+	// Width, Height and Format describe the saved image when the request
+	// set IncludeDimensions.
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	// Redirects lists the hops followed when the request set TraceRedirects.
+	Redirects []redirectHop `json:"redirects,omitempty"`
+	// Attempts lists every fetch made, in order, when retries or mirrors
+	// took more than one.
+	Attempts []downloadAttempt `json:"attempts,omitempty"`
+	// Required is copied from the entry.
+	Required bool `json:"required,omitempty"`
+	// DuplicateOf is the index of the entry whose download this one shares
+	// when the request collapsed duplicates.
+	DuplicateOf *int `json:"duplicateOf,omitempty"`
+
+	path         string
+	lastModified time.Time
+	// original is the result a collapsed duplicate takes its outcome from.
+	original *downloadResult
+	// sha256 is the hex digest of the downloaded bytes.
+	sha256 string
+}
+
+// downloadAttempt is the outcome of one fetch of an entry.
+type downloadAttempt struct {
+	URL   string `json:"url"`
+	Error string `json:"error,omitempty"`
+}
+
+// redirectHop is one redirect response followed while downloading.
+type redirectHop struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+type downloadReport struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Truncated int               `json:"truncated,omitempty"`
+	Skipped   map[string]int    `json:"skipped,omitempty"`
+	Entries   []*downloadResult `json:"entries"`
+
+	// TotalBytes counts every byte downloaded, including those of failed
+	// downloads.
+	TotalBytes int64 `json:"totalBytes"`
+	// BudgetExceeded is set when the request's byte budget ran out.
+	BudgetExceeded bool `json:"budgetExceeded,omitempty"`
+	// Deduplicated lists the entries that share a file because their URLs
+	// were collapsed or their bytes matched.
+	Deduplicated []dedupGroup `json:"deduplicated,omitempty"`
+	// Timings gives the wall-clock time of the download phase and of the
+	// batch up to the report.
+	Timings *batchTimings `json:"timings,omitempty"`
+	// RequiredFailed counts the failed entries marked required; any fail
+	// the batch.
+	RequiredFailed int `json:"requiredFailed,omitempty"`
+	// RetryToken re-runs the failed entries when sent as a request's
+	// retryToken within RETRY_TOKEN_TTL.
+	RetryToken string `json:"retryToken,omitempty"`
+	// DestDir is the directory DEFAULT_DEST_DIR gave a request without
+	// one.
+	DestDir string `json:"destDir,omitempty"`
+}
+
+func newDownloadReport(results []*downloadResult) *downloadReport {
+	report := &downloadReport{Entries: results}
+	for _, result := range results {
+		if result.Error != "" {
+			report.Failed++
+			if result.Required {
+				report.RequiredFailed++
+			}
+		} else {
+			report.Succeeded++
+		}
+	}
+	return report
+}
+
+// downloadImage fetches entry into result.path, or streams it to the entry's
+// UploadURL, falling back to each mirror in turn and recording which URL
+// served the image. Each result belongs to the one goroutine downloading it,
+// so every attempt is recorded in it without locking.
+func downloadImage(request *downloadRequest, entry imageEntry, result *downloadResult) {
+	var failures []string
+	var blockedBy string
+	result.Attempts = nil
+	// Each attempt names the file afresh from the entry, so the name comes
+	// from the attempt that succeeds and not from earlier failed ones.
+	name := result.Filename
+	defer func() {
+		if len(result.Attempts) == 1 {
+			result.Attempts = nil
+		}
+	}()
+	fetch := func(imageURL string) error {
+		start := time.Now()
+		result.Filename = name
+		err := fetchImage(request, imageURL, entry, result)
+		metrics.observe(imageURL, time.Since(start), err != nil)
+		attempt := downloadAttempt{URL: imageURL}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		result.Attempts = append(result.Attempts, attempt)
+		return err
+	}
+	for _, imageURL := range append([]string{entry.URL}, entry.Mirrors...) {
+		if request.budget.exhausted() {
+			failures = append(failures, errBudgetExceeded.Error())
+			break
+		}
+		err := fetch(imageURL)
+		for attempt := 0; attempt < cfg.RetryAttempts && isRetryable(err, request.RetryStatusCodes); attempt++ {
+			log.Println("Download error, retrying:", err)
+			time.Sleep(retryDelay(attempt))
+			err = fetch(imageURL)
+		}
+		if err == nil {
+			result.Source = imageURL
+			return
+		}
+		log.Println("Download error:", err)
+		failures = append(failures, err.Error())
+		var policy *policyError
+		if errors.As(err, &policy) {
+			blockedBy = policy.rule
+		}
+	}
+
+	os.Remove(result.path)
+	result.Error = strings.Join(failures, "; ")
+	result.BlockedBy = blockedBy
+}
+
+func fetchImage(request *downloadRequest, imageURL string, entry imageEntry, result *downloadResult) error {
+	parsedURL, err := url.Parse(imageURL)
+	if err == nil {
+		err = checkURLPolicy(parsedURL)
+	}
+	if err == nil && request.RequireHTTPS {
+		err = checkHTTPS(parsedURL)
+	}
+	if err != nil {
+		return fmt.Errorf("refusing to fetch %s: %w", imageURL, err)
+	}
+
+	result.Redirects = nil
+	client := &http.Client{
+		Transport: request.connections.transportFor(parsedURL.Hostname()),
+		Timeout:   cfg.DownloadTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme == "data" && cfg.DataRedirects == "follow" {
+				if request.TraceRedirects {
+					result.Redirects = append(result.Redirects, redirectHop{
+						URL:    via[len(via)-1].URL.String(),
+						Status: req.Response.StatusCode,
+					})
+				}
+				return &dataRedirect{uri: req.URL, proto: req.Response.Proto}
+			}
+			if err := checkRedirect(req.URL, via); err != nil {
+				return fmt.Errorf("refusing redirect to %s: %w", abbreviateURL(req.URL), err)
+			}
+			if request.RequireHTTPS {
+				if err := checkHTTPS(req.URL); err != nil {
+					return fmt.Errorf("refusing redirect to %s: %w", abbreviateURL(req.URL), err)
+				}
+			}
+			if request.TraceRedirects {
+				result.Redirects = append(result.Redirects, redirectHop{
+					URL:    via[len(via)-1].URL.String(),
+					Status: req.Response.StatusCode,
+				})
+			}
+			return nil
+		},
+	}
+	if request.UseCookies {
+		client.Jar = newHostCookieJar(parsedURL.Hostname())
+	}
+	req, err := http.NewRequest("GET", imageURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch URL %s: %w", imageURL, err)
+	}
+	req.Header = downloadHeaders(parsedURL, request)
+	req.Close = request.closeConnections
+	resp, err := client.Do(req)
+	var inline *dataRedirect
+	if errors.As(err, &inline) {
+		resp, err = inline.response()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch URL %s: %w", imageURL, abbreviateURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{url: imageURL, code: resp.StatusCode}
+	}
+
+	result.Protocol = resp.Proto
+	result.FinalURL = ""
+	if finalURL := resp.Request.URL.String(); finalURL != imageURL {
+		result.FinalURL = finalURL
+	}
+	result.lastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	fromDisposition := false
+	if request.UseContentDisposition && entry.Filename == "" {
+		if name := dispositionFilename(resp.Header.Get("Content-Disposition"), request.FilenameEncoding); name != "" {
+			result.Filename = name
+			fromDisposition = true
+		}
+	}
+
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := body.Peek(sniffLen)
+	if err := scanContent(head); err != nil {
+		return fmt.Errorf("rejected %s: %v", imageURL, err)
+	}
+
+	// DEFAULT_EXTENSION says nothing about the content, so only an extension
+	// taken from the URL or Content-Disposition counts as evidence.
+	typeName := result.Filename
+	if !fromDisposition && entry.Filename == "" && filepath.Ext(urlFilename(result.URL, request.FilenameEncoding)) == "" {
+		typeName = ""
+	}
+	evidence := newMediaTypeEvidence(head, resp.Header.Get("Content-Type"), typeName)
+	result.ContentType = evidence.resolve()
+	if cfg.ErrorBodies == "reject" {
+		if err := checkErrorBody(evidence, head, body); err != nil {
+			return fmt.Errorf("rejected %s: %v", imageURL, err)
+		}
+	}
+	if request.RequireTypeAgreement {
+		if err := evidence.checkAgreement(); err != nil {
+			return fmt.Errorf("rejected %s: %v", imageURL, err)
+		}
+	}
+	result.ContentTypeUnknown = result.ContentType == ""
+	if result.ContentTypeUnknown {
+		switch cfg.UnknownContent {
+		case "reject":
+			return fmt.Errorf("rejected %s: %v", imageURL, &checkError{"content-type", "content type could not be determined"})
+		case "bin":
+			if typeName == "" {
+				result.Filename = strings.TrimSuffix(result.Filename, filepath.Ext(result.Filename)) + ".bin"
+			}
+		}
+	}
+	if err := checkMediaType(result.ContentType, request); err != nil {
+		return fmt.Errorf("rejected %s: %v", imageURL, err)
+	}
+	if entry.Filename == "" && (!fromDisposition || request.DispositionExtension != "keep") {
+		result.Filename = withImageExtension(result.Filename, result.ContentType)
+	}
+
+	digest := sha256.New()
+	content := io.TeeReader(request.budget.reader(body), digest)
+	checkDigest := func() error {
+		result.sha256 = hex.EncodeToString(digest.Sum(nil))
+		if entry.ExpectedSHA256 != "" && !strings.EqualFold(result.sha256, entry.ExpectedSHA256) {
+			return fmt.Errorf("rejected %s: %v", imageURL, &checkError{"sha256", "hash mismatch, got " + result.sha256})
+		}
+		return nil
+	}
+
+	// An upload with an expected digest is downloaded to the scratch file
+	// first, so only verified bytes are ever uploaded.
+	if entry.UploadURL != "" && entry.ExpectedSHA256 == "" {
+		status, err := uploadImage(request, entry.UploadURL, content, resp.ContentLength, resp.Header.Get("Content-Type"))
+		result.UploadStatus = status
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %v", imageURL, err)
+		}
+		return checkDigest()
+	}
+
+	file, err := os.Create(result.path)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %v", result.path, err)
+	}
+	defer file.Close()
+
+	size, err := io.Copy(file, content)
+	result.Bytes = size
+	if errors.Is(err, io.ErrUnexpectedEOF) || err == nil && resp.ContentLength > size {
+		return fmt.Errorf("failed to download %s: %w: got %d of %d bytes", imageURL, errTruncated, size, resp.ContentLength)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write image to file %s: %v", result.path, err)
+	}
+	if err := checkDigest(); err != nil {
+		return err
+	}
+
+	if entry.UploadURL != "" {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read image file %s: %v", result.path, err)
+		}
+		status, err := uploadImage(request, entry.UploadURL, file, size, resp.Header.Get("Content-Type"))
+		result.UploadStatus = status
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %v", imageURL, err)
+		}
+		os.Remove(result.path)
+		return nil
+	}
+
+	if request.memory != nil {
+		need, err := transformMemory(result.path, request)
+		if err != nil {
+			return fmt.Errorf("failed to read image file %s: %v", result.path, err)
+		}
+		release, err := request.memory.reserve(need)
+		if err != nil {
+			return fmt.Errorf("rejected %s: %v", imageURL, err)
+		}
+		defer release()
+	}
+
+	if request.NormalizeText {
+		if size, err = normalizeText(result.path, result.ContentType, size); err != nil {
+			log.Printf("Failed to normalize %s: %v", imageURL, err)
+		}
+		result.Bytes = size
+	}
+
+	if request.Strict {
+		if err := checkStrictFile(result.path, size); err != nil {
+			return fmt.Errorf("rejected %s: %v", imageURL, err)
+		}
+	}
+
+	if request.Normalize != nil {
+		if result.Bytes, result.ContentType, err = normalizeImage(result.path, request.Normalize); err != nil {
+			return fmt.Errorf("failed to normalize %s: %v", imageURL, err)
+		}
+		result.Filename = withImageExtension(result.Filename, result.ContentType)
+	}
+
+	if request.JPEGScan == "baseline" {
+		if result.Bytes, err = toBaselineJPEG(result.path, result.Bytes); err != nil {
+			log.Printf("Failed to convert %s to baseline: %v", imageURL, err)
+		}
+	}
+
+	if request.Optimize {
+		if result.Bytes, err = optimizeImage(result.path, result.Bytes); err == errOptimizeJPEG {
+			log.Printf("Not optimizing %s: %v", imageURL, err)
+			result.NotOptimized = err.Error()
+		} else if err != nil {
+			log.Printf("Failed to optimize %s: %v", imageURL, err)
+		}
+	}
+
+	if request.EmbedProvenance {
+		if result.Bytes, err = embedProvenance(result.path, result.Bytes, imageURL, time.Now()); err != nil {
+			log.Printf("Failed to embed provenance in %s: %v", imageURL, err)
+		}
+	}
+
+	if request.IncludeDimensions {
+		if result.Width, result.Height, result.Format, err = describeImage(result.path); err != nil {
+			log.Printf("Failed to read dimensions of %s: %v", imageURL, err)
+		}
+	}
+	return nil
+}
+
+// uploadImage streams body, size bytes of contentType, to a presigned PUT
+// URL and returns the status code it answered with. A size of -1 is unknown.
+func uploadImage(request *downloadRequest, uploadURL string, body io.Reader, size int64, contentType string) (int, error) {
+	parsedURL, err := url.Parse(uploadURL)
+	if err == nil {
+		err = checkURLPolicy(parsedURL)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("refusing upload URL: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, uploadURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := &http.Client{
+		Transport: request.connections.transportFor(parsedURL.Hostname()),
+		Timeout:   cfg.DownloadTimeout,
+	}
+	uploadResp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer uploadResp.Body.Close()
+	io.Copy(io.Discard, uploadResp.Body)
+
+	if uploadResp.StatusCode < 200 || uploadResp.StatusCode > 299 {
+		return uploadResp.StatusCode, fmt.Errorf("upload returned status %d", uploadResp.StatusCode)
+	}
+	return uploadResp.StatusCode, nil
+}
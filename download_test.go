@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// uploadTarget records the bodies PUT to it.
+type uploadTarget struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newUploadTarget(t *testing.T) *uploadTarget {
+	t.Helper()
+	target := &uploadTarget{}
+	target.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		target.mu.Lock()
+		target.bodies = append(target.bodies, body)
+		target.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func TestExpectedSHA256(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	imageURL := upstream.URL + "/a.png"
+
+	rec := postDownload(t, `{"imageURLs":[{"url":"`+imageURL+`","expectedSha256":"`+strings.ToUpper(sha256Hex(image))+`"}]}`)
+	if entries := zipEntries(t, rec); len(entries) != 1 {
+		t.Errorf("matching hash: archive has %d entries, want 1", len(entries))
+	}
+
+	rec = postDownload(t, `{"imageURLs":[{"url":"`+imageURL+`","expectedSha256":"`+sha256Hex([]byte("other"))+`"}]}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("mismatching hash: status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestExpectedSHA256Mismatch(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+upstream.URL+`/a.png","expectedSha256":"`+sha256Hex([]byte("other"))+`"}]}`)
+	report := decodeReport(t, rec)
+	if report.Failed != 1 || !strings.Contains(report.Entries[0].Error, "hash mismatch") {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestExpectedSHA256RejectsMalformedDigest(t *testing.T) {
+	rec := postDownload(t, `{"imageURLs":[{"url":"https://example.com/a.png","expectedSha256":"abc"}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExpectedSHA256VerifiedBeforeUpload(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	tests := []struct {
+		digest   string
+		uploaded bool
+	}{
+		{sha256Hex(image), true},
+		{sha256Hex([]byte("other")), false},
+	}
+	for _, tt := range tests {
+		target := newUploadTarget(t)
+		rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+upstream.URL+`/a.png","uploadURL":"`+target.URL+`/put","expectedSha256":"`+tt.digest+`"}]}`)
+		report := decodeReport(t, rec)
+		if failed := report.Failed == 1; failed == tt.uploaded {
+			t.Errorf("digest %s: report = %+v", tt.digest, report)
+		}
+		if tt.uploaded && (len(target.bodies) != 1 || !bytes.Equal(target.bodies[0], image)) {
+			t.Errorf("digest %s: uploaded %d bodies, want the image once", tt.digest, len(target.bodies))
+		}
+		if !tt.uploaded && len(target.bodies) != 0 {
+			t.Errorf("digest %s: mismatching image was uploaded", tt.digest)
+		}
+	}
+}
+
+func TestUploadStreamsWithoutExpectedSHA256(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	target := newUploadTarget(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+upstream.URL+`/a.png","uploadURL":"`+target.URL+`/put"}]}`)
+	report := decodeReport(t, rec)
+	if report.Succeeded != 1 || report.Entries[0].UploadStatus != http.StatusCreated {
+		t.Errorf("report = %+v", report)
+	}
+	if len(target.bodies) != 1 || !bytes.Equal(target.bodies[0], image) {
+		t.Errorf("uploaded %d bodies, want the image once", len(target.bodies))
+	}
+}
+
+func TestMirrorServesWhenPrimaryFails(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	t.Cleanup(primary.Close)
+	image := pngImage(t, 5, 5)
+	mirror := serveBytes(t, "image/png", image)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+primary.URL+`/a.png","mirrors":["`+mirror.URL+`/a.png"]}]}`)
+	report := decodeReport(t, rec)
+	entry := report.Entries[0]
+	if entry.Error != "" || entry.Source != mirror.URL+"/a.png" {
+		t.Fatalf("entry = %+v", entry)
+	}
+	if len(entry.Attempts) != 2 || entry.Attempts[0].Error == "" || entry.Attempts[1].Error != "" {
+		t.Errorf("attempts = %+v", entry.Attempts)
+	}
+	saved, err := os.ReadFile(filepath.Join(cfg.DestRoot, "out", entry.Filename))
+	if err != nil || !bytes.Equal(saved, image) {
+		t.Errorf("saved file does not hold the mirror's bytes: %v", err)
+	}
+}
+
+func TestMirrorsAllFailing(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	t.Cleanup(failing.Close)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+failing.URL+`/a.png","mirrors":["`+failing.URL+`/b.png"]}]}`)
+	entry := decodeReport(t, rec).Entries[0]
+	if strings.Count(entry.Error, ": 404") != 2 {
+		t.Errorf("error %q does not report both failures", entry.Error)
+	}
+}
+
+func TestUploadForwardsImage(t *testing.T) {
+	image := pngImage(t, 3, 3)
+	upstream := serveBytes(t, "image/png", image)
+	var method, contentType string
+	var length int64
+	var body []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, contentType, length = r.Method, r.Header.Get("Content-Type"), r.ContentLength
+		body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(target.Close)
+
+	rec := postDownload(t, `{"imageURLs":[{"url":"`+upstream.URL+`/a.png","uploadURL":"`+target.URL+`/bucket/a.png?sig=x"}],"manifest":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	if method != http.MethodPut || contentType != "image/png" || length != int64(len(image)) || !bytes.Equal(body, image) {
+		t.Errorf("upload was %s %s, %d bytes declared, %d received", method, contentType, length, len(body))
+	}
+}
+
+func TestUploadFailureIsReported(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(target.Close)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":[{"url":"`+upstream.URL+`/a.png","uploadURL":"`+target.URL+`/put"}]}`)
+	entry := decodeReport(t, rec).Entries[0]
+	if entry.UploadStatus != http.StatusForbidden || !strings.Contains(entry.Error, "upload returned status 403") {
+		t.Errorf("entry = %+v", entry)
+	}
+}
+
+// redirectingUpstream serves /hop/N by redirecting to /hop/N-1, alternating
+// 301 and 302, and a PNG at /hop/0.
+func redirectingUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	image := pngImage(t, 2, 2)
+	return httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n == 0 {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+			return
+		}
+		status := http.StatusFound
+		if n%2 == 1 {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), status)
+	})
+}
+
+func TestTraceRedirects(t *testing.T) {
+	upstream := redirectingUpstream(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","traceRedirects":true,"imageURLs":["`+upstream.URL+`/hop/3"]}`)
+	entry := decodeReport(t, rec).Entries[0]
+	want := []redirectHop{
+		{upstream.URL + "/hop/3", http.StatusMovedPermanently},
+		{upstream.URL + "/hop/2", http.StatusFound},
+		{upstream.URL + "/hop/1", http.StatusMovedPermanently},
+	}
+	if entry.Error != "" || !slices.Equal(entry.Redirects, want) {
+		t.Errorf("redirects %+v, want %+v (error %q)", entry.Redirects, want, entry.Error)
+	}
+
+	rec = postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/hop/3"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Redirects != nil {
+		t.Errorf("redirects traced without traceRedirects: %+v", entry.Redirects)
+	}
+}
+
+func TestFinalURLAfterRedirects(t *testing.T) {
+	upstream := redirectingUpstream(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/hop/2","`+upstream.URL+`/hop/1","`+upstream.URL+`/hop/0"]}`)
+	want := []string{upstream.URL + "/hop/0", upstream.URL + "/hop/0", ""}
+	for i, entry := range decodeReport(t, rec).Entries {
+		if entry.Error != "" || entry.FinalURL != want[i] {
+			t.Errorf("%s: finalURL %q, want %q (error %q)", entry.URL, entry.FinalURL, want[i], entry.Error)
+		}
+	}
+}
+
+// legacyUpstream is an HTTP/1.0 server that sends image without a
+// Content-Length and closes each connection after one response.
+func legacyUpstream(t *testing.T, image []byte) (addr string, connections *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	connections = new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.0 200 OK\r\nContent-Type: image/png\r\nConnection: close\r\n\r\n")
+				conn.Write(image)
+			}()
+		}
+	}()
+	return listener.Addr().String(), connections
+}
+
+func TestHTTP10ConnectionCloseUpstream(t *testing.T) {
+	image := pngImage(t, 16, 16)
+	addr, connections := legacyUpstream(t, image)
+	setConfig(t, func(c *config) { c.Concurrency = 1; c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","maxConnections":2,"imageURLs":["http://`+addr+`/a.png","http://`+addr+`/b.png"]}`)
+	report := decodeReport(t, rec)
+	if report.Succeeded != 2 {
+		t.Fatalf("succeeded %d, entries %+v; want 2", report.Succeeded, report.Entries)
+	}
+	for _, entry := range report.Entries {
+		if entry.Protocol != "HTTP/1.0" {
+			t.Errorf("%s: protocol %q, want HTTP/1.0", entry.URL, entry.Protocol)
+		}
+		data, err := os.ReadFile(filepath.Join(cfg.DestRoot, "out", entry.Filename))
+		if err != nil || !bytes.Equal(data, image) {
+			t.Errorf("%s: saved %d bytes (%v), want the full %d byte image", entry.URL, len(data), err, len(image))
+		}
+	}
+	if got := connections.Load(); got != 2 {
+		t.Errorf("%d connections, want one per download", got)
+	}
+}
+
+func TestRequiredEntryFailsBatch(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 4, 4))
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	ok := `{"url":"` + upstream.URL + `/a.png","required":true}`
+	optional := `"` + missing.URL + `/optional.png"`
+	required := `{"url":"` + missing.URL + `/required.png","required":true}`
+
+	rec := postDownload(t, `{"imageURLs":[`+ok+`,`+optional+`]}`)
+	if entries := zipEntries(t, rec); len(entries) != 1 {
+		t.Errorf("optional failure: archive has %v, want the one success", keys(entries))
+	}
+
+	rec = postDownload(t, `{"imageURLs":[`+ok+`,`+optional+`,`+required+`]}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("required failure: status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	report := decodeReport(t, rec)
+	if report.Succeeded != 1 || report.Failed != 2 || report.RequiredFailed != 1 {
+		t.Errorf("required failure: succeeded %d, failed %d, requiredFailed %d; want 1, 2 and 1",
+			report.Succeeded, report.Failed, report.RequiredFailed)
+	}
+	for _, entry := range report.Entries {
+		if want := !strings.HasSuffix(entry.URL, "/optional.png"); entry.Required != want {
+			t.Errorf("%s: required = %t, want %t", entry.URL, entry.Required, want)
+		}
+	}
+
+	rec = postDownload(t, `{"output":"stream","destDir":"out","imageURLs":[`+ok+`,`+optional+`,`+required+`]}`)
+	if got := rec.Result().Trailer.Get("X-Required-Failed"); got != "1" {
+		t.Errorf("streamed X-Required-Failed trailer = %q, want 1", got)
+	}
+}
+
+func TestTruncatedDownload(t *testing.T) {
+	image := pngImage(t, 16, 16)
+	var served atomic.Int32
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		if served.Add(1) == 1 || r.URL.Path == "/short.png" {
+			w.Write(image[:len(image)/2])
+			return
+		}
+		w.Write(image)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	report := decodeReport(t, postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/short.png"]}`))
+	want := "truncated download: got " + strconv.Itoa(len(image)/2) + " of " + strconv.Itoa(len(image)) + " bytes"
+	if entry := report.Entries[0]; !strings.Contains(entry.Error, want) {
+		t.Errorf("short body: error %q, want %q", entry.Error, want)
+	}
+	if files, _ := filepath.Glob(filepath.Join(cfg.DestRoot, "out", "*")); len(files) != 0 {
+		t.Errorf("partial download kept as %v", files)
+	}
+
+	served.Store(0)
+	setConfig(t, func(c *config) {
+		c.RetryAttempts = 1
+		c.RetryBaseDelay = time.Millisecond
+		c.RetryMaxDelay = time.Millisecond
+	})
+	if got := zipEntries(t, postDownload(t, `{"imageURLs":["`+upstream.URL+`/a.png"]}`))["a.png"]; !bytes.Equal(got, image) {
+		t.Errorf("retried truncated download archived %d bytes, want %d", len(got), len(image))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import "slices"
+
+// collapseDuplicates finds the entries whose URLs are the same once
+// normalized and ties every later one to the result of the first, so it is
+// downloaded only once. Entries uploading elsewhere or expecting different
+// digests are never collapsed. It returns the indexes of each entry's
+// duplicates.
+func collapseDuplicates(entries []imageEntry, results []*downloadResult) [][]int {
+	type entryKey struct{ url, uploadURL, digest string }
+	duplicates := make([][]int, len(entries))
+	first := make(map[entryKey]int)
+	for i, entry := range entries {
+		normalized, err := normalizeURL(entry.URL)
+		if err != nil {
+			continue
+		}
+		key := entryKey{normalized, entry.UploadURL, entry.ExpectedSHA256}
+		original, ok := first[key]
+		if !ok {
+			first[key] = i
+			continue
+		}
+		duplicates[original] = append(duplicates[original], i)
+		results[i].DuplicateOf = &original
+		results[i].original = results[original]
+	}
+	return duplicates
+}
+
+// shareOriginal copies the outcome of the download a collapsed duplicate
+// shares, keeping its own URL and Meta. The original must already be
+// placed.
+func (r *downloadResult) shareOriginal() {
+	original := r.original
+	url, meta, duplicateOf := r.URL, r.Meta, r.DuplicateOf
+	*r = *original
+	r.URL, r.Meta, r.DuplicateOf = url, meta, duplicateOf
+	r.original = original
+}
+
+// dedupGroup lists the entries of a batch that ended up sharing one file.
+type dedupGroup struct {
+	Filename string       `json:"filename"`
+	Entries  []dedupEntry `json:"entries"`
+}
+
+// dedupEntry is one entry of a dedupGroup. By is "url" for an entry
+// collapsed as a duplicate URL and "content" for one whose bytes matched
+// the file, and empty for the group's first entry.
+type dedupEntry struct {
+	Index int    `json:"index"`
+	URL   string `json:"url"`
+	By    string `json:"by,omitempty"`
+}
+
+// deduplicatedGroups finds the successful downloads of results that share
+// a file, in request order. Names are unique within a batch otherwise, so a
+// shared name means a shared file.
+func deduplicatedGroups(results []*downloadResult) []dedupGroup {
+	var groups []dedupGroup
+	byName := make(map[string]int)
+	for i, result := range results {
+		if result.Error != "" || result.UploadStatus != 0 {
+			continue
+		}
+		entry := dedupEntry{Index: i, URL: result.URL}
+		g, ok := byName[result.Filename]
+		if !ok {
+			byName[result.Filename] = len(groups)
+			groups = append(groups, dedupGroup{Filename: result.Filename, Entries: []dedupEntry{entry}})
+			continue
+		}
+		entry.By = "content"
+		if result.DuplicateOf != nil {
+			entry.By = "url"
+		}
+		groups[g].Entries = append(groups[g].Entries, entry)
+	}
+	return slices.DeleteFunc(groups, func(group dedupGroup) bool { return len(group.Entries) < 2 })
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeduplicatedReport(t *testing.T) {
+	same, other := pngImage(t, 2, 2), pngImage(t, 3, 3)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if strings.HasPrefix(r.URL.Path, "/z/") {
+			w.Write(other)
+			return
+		}
+		w.Write(same)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	urls := `"` + upstream.URL + `/x/a.png","` + upstream.URL + `/y/a.png","` + upstream.URL + `/x/a.png#again","` +
+		upstream.URL + `/z/a.png","` + upstream.URL + `/b.png"`
+
+	report := decodeReport(t, postDownload(t, `{"output":"local","destDir":"out","onConflict":"content","duplicates":"collapse","imageURLs":[`+urls+`]}`))
+	if len(report.Deduplicated) != 1 {
+		t.Fatalf("deduplicated %+v, want one group", report.Deduplicated)
+	}
+	group := report.Deduplicated[0]
+	want := []dedupEntry{
+		{Index: 0, URL: upstream.URL + "/x/a.png"},
+		{Index: 1, URL: upstream.URL + "/y/a.png", By: "content"},
+		{Index: 2, URL: upstream.URL + "/x/a.png#again", By: "url"},
+	}
+	if group.Filename != report.Entries[0].Filename || !reflect.DeepEqual(group.Entries, want) {
+		t.Errorf("deduplicated group %+v, want %s shared by %+v", group, report.Entries[0].Filename, want)
+	}
+
+	rec := postDownload(t, `{"onConflict":"content","duplicates":"collapse","imageURLs":[`+urls+`]}`)
+	if entries := zipEntries(t, rec); len(entries) != 3 {
+		t.Errorf("archive has %v, want each of the three distinct images once", keys(entries))
+	}
+
+	report = decodeReport(t, postDownload(t, `{"output":"local","destDir":"kept","imageURLs":[`+urls+`]}`))
+	if report.Deduplicated != nil {
+		t.Errorf("without deduplication: deduplicated %+v", report.Deduplicated)
+	}
+}
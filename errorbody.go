@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// maxErrorBodyBytes bounds how much of a suspected error body is read for
+// its message.
+const maxErrorBodyBytes = 64 << 10
+
+// maxErrorMessageBytes bounds the upstream message quoted in a result.
+const maxErrorMessageBytes = 200
+
+// errorMessageKeys are the fields APIs commonly carry their error message
+// in, in order of preference.
+var errorMessageKeys = []string{"error", "message", "error_description", "detail", "title", "msg"}
+
+// checkErrorBody recognizes a 200 response that carries an error document
+// instead of an image: a body that does not sniff as an image and is
+// declared as JSON or text, or looks like a JSON object when undeclared. The
+// message it reports is taken from the document's usual error fields, or
+// its first line. Other responses pass.
+func checkErrorBody(evidence mediaTypeEvidence, head []byte, body io.Reader) error {
+	if evidence.sniffed != "" {
+		return nil
+	}
+	trimmed := bytes.TrimSpace(head)
+	isJSON := evidence.header == "application/json" || strings.HasSuffix(evidence.header, "+json") ||
+		evidence.header == "" && bytes.HasPrefix(trimmed, []byte("{"))
+	if !isJSON && !strings.HasPrefix(evidence.header, "text/") {
+		return nil
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(body, maxErrorBodyBytes))
+	message := ""
+	if isJSON {
+		var document map[string]any
+		if json.Unmarshal(data, &document) == nil {
+			message = errorMessage(document)
+		}
+	}
+	if message == "" {
+		message, _, _ = strings.Cut(strings.TrimSpace(string(data)), "\n")
+	}
+	message = truncateUTF8(strings.ToValidUTF8(strings.TrimSpace(message), ""), maxErrorMessageBytes)
+
+	kind := "text"
+	if isJSON {
+		kind = "JSON"
+	}
+	detail := "upstream returned " + kind + " instead of an image"
+	if message != "" {
+		detail += ": " + message
+	}
+	return &checkError{"error-body", detail}
+}
+
+// errorMessage finds the message of a JSON error document, looking into
+// nested error objects such as {"error": {"message": "..."}}.
+func errorMessage(document map[string]any) string {
+	for _, key := range errorMessageKeys {
+		switch value := document[key].(type) {
+		case string:
+			return value
+		case map[string]any:
+			if message := errorMessage(value); message != "" {
+				return message
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// errorBodyUpstream answers 200 with the body and Content-Type given in
+// the query, sending no Content-Type when type is absent.
+func errorBodyUpstream(t *testing.T) string {
+	t.Helper()
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if contentType, ok := r.URL.Query()["type"]; ok {
+			w.Header().Set("Content-Type", contentType[0])
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write([]byte(r.URL.Query().Get("body")))
+	})
+	return upstream.URL
+}
+
+func errorBodyURL(upstream, contentType, body string) string {
+	query := url.Values{"body": {body}}
+	if contentType != "" {
+		query.Set("type", contentType)
+	}
+	return upstream + "/image.jpg?" + query.Encode()
+}
+
+func TestErrorBodiesRejected(t *testing.T) {
+	upstream := errorBodyUpstream(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	tests := []struct {
+		contentType, body, want string
+	}{
+		{"application/json", `{"error":"not found"}`, "upstream returned JSON instead of an image: not found"},
+		{"application/problem+json", `{"title":"Gone","status":410}`, "upstream returned JSON instead of an image: Gone"},
+		{"application/json", `{"error":{"code":7,"message":"quota exceeded"}}`, "upstream returned JSON instead of an image: quota exceeded"},
+		{"text/plain", "Image missing\nrequest id 42", "upstream returned text instead of an image: Image missing"},
+		{"", `  {"message":"no such image"}`, "upstream returned JSON instead of an image: no such image"},
+		{"application/json", `{"status":"failed"}`, `upstream returned JSON instead of an image: {"status":"failed"}`},
+	}
+	for _, tt := range tests {
+		rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+errorBodyURL(upstream, tt.contentType, tt.body)+`"]}`)
+		entry := decodeReport(t, rec).Entries[0]
+		if !strings.HasPrefix(entry.Error, "rejected ") || !strings.HasSuffix(entry.Error, "error-body check failed: "+tt.want) {
+			t.Errorf("%s %s: error %q, want %q", tt.contentType, tt.body, entry.Error, tt.want)
+		}
+	}
+}
+
+func TestErrorBodiesPassImages(t *testing.T) {
+	upstream := errorBodyUpstream(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	for _, imageURL := range []string{
+		errorBodyURL(upstream, "text/xml", svgDocument),
+		errorBodyURL(upstream, "application/json", string(pngImage(t, 2, 2))),
+	} {
+		rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+imageURL+`"]}`)
+		if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" {
+			t.Errorf("image body rejected: %q", entry.Error)
+		}
+	}
+
+	setConfig(t, func(c *config) { c.ErrorBodies = "accept" })
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+errorBodyURL(upstream, "application/json", `{"error":"not found"}`)+`"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" {
+		t.Errorf("ERROR_BODIES=accept: error %q", entry.Error)
+	}
+}
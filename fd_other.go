@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func currentFDUsage() (int, int, error) {
+	return 0, 0, errors.New("file descriptor usage is not available on this platform")
+}
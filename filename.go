@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// generateFilename names the file downloaded from originalURL, sanitized
+// for encoding, giving names without an extension DEFAULT_EXTENSION until
+// the download's type is known.
+func generateFilename(originalURL, encoding string) string {
+	fileName := urlFilename(originalURL, encoding)
+	if filepath.Ext(fileName) == "" {
+		fileName = sanitizeFilename(fileName+cfg.DefaultExtension, encoding)
+	}
+	return fileName
+}
+
+// entryFilename names the file of entry: the caller's filename, sanitized
+// for encoding, when it gave a usable one, or else the name generated from
+// its URL.
+func entryFilename(entry imageEntry, encoding string) string {
+	name := filepath.Base(strings.ReplaceAll(entry.Filename, "\\", "/"))
+	if entry.Filename == "" || name == "." || name == "/" || name == ".." {
+		return generateFilename(entry.URL, encoding)
+	}
+	return sanitizeFilename(name, encoding)
+}
+
+// urlFilename names the file from originalURL alone, falling back to a hash
+// of the URL when its path has no last segment or ends in a dot segment.
+func urlFilename(originalURL, encoding string) string {
+	urlPath := ""
+	parsedURL, err := url.Parse(originalURL)
+	if err == nil {
+		urlPath = parsedURL.Path
+	} else {
+		urlPath = rawURLPath(originalURL)
+	}
+
+	fileName := ""
+	if err == nil {
+		if imageURL, ok := unwrapCDNURL(parsedURL); ok {
+			fileName = filepath.Base(imageURL)
+		}
+	}
+
+	if fileName == "" {
+		fileName = decodeSegment(filepath.Base(urlPath))
+	}
+	// Dot segments, including escaped ones such as %2e%2e, name no file.
+	if fileName == "" || fileName == "." || fileName == "/" || fileName == ".." {
+		hash := sha256.Sum256([]byte(originalURL))
+		fileName = fmt.Sprintf("image_%x", hash[:8])
+	}
+
+	if filepath.Ext(fileName) == "" {
+		if ext := filepath.Ext(urlPath); ext != "." {
+			fileName += ext
+		}
+	}
+	if filepath.Ext(fileName) == "" && err == nil {
+		fileName += queryExtension(parsedURL.Query())
+	}
+
+	return sanitizeFilename(fileName, encoding)
+}
+
+// queryExtension returns the extension of the image format named by the
+// first FORMAT_QUERY_PARAMS parameter of query that names one, as in
+// "?format=png" or "?fmt=image/webp", or "" when none does.
+func queryExtension(query url.Values) string {
+	for _, param := range cfg.FormatQueryParams {
+		for _, value := range query[param] {
+			value = strings.ToLower(strings.TrimSpace(value))
+			mediaType := extensionTypes["."+value]
+			if strings.Contains(value, "/") {
+				mediaType = baseMediaType(value)
+			}
+			if extension, ok := imageExtensions[mediaType]; ok {
+				return extension
+			}
+		}
+	}
+	return ""
+}
+
+// rawURLPath extracts the path of a URL that url.Parse rejects, typically
+// because of an invalid percent-escape, so it can still name the file.
+func rawURLPath(rawURL string) string {
+	if _, rest, ok := strings.Cut(rawURL, "://"); ok {
+		rawURL = rest
+	}
+	_, urlPath, ok := strings.Cut(rawURL, "/")
+	if !ok {
+		return ""
+	}
+	urlPath, _, _ = strings.Cut(urlPath, "?")
+	urlPath, _, _ = strings.Cut(urlPath, "#")
+	return "/" + urlPath
+}
+
+// decodeSegment decodes percent-escapes still present in an already decoded
+// path segment, as left by double encoding. A segment whose escapes are
+// invalid is returned as is.
+func decodeSegment(segment string) string {
+	if decoded, err := url.PathUnescape(segment); err == nil && !strings.Contains(decoded, "/") {
+		return decoded
+	}
+	return segment
+}
+
+var (
+	unsafeFilenameChars        = regexp.MustCompile(`[^a-zA-Z0-9\.\-_]`)
+	unsafeUnicodeFilenameChars = regexp.MustCompile(`[^\p{L}\p{M}\p{N}\.\-_]`)
+)
+
+// sanitizeFilename replaces characters unsafe in file names with "_". With
+// encoding "ascii", accented Latin letters are first folded to ASCII so
+// "café.jpg" becomes "cafe.jpg", and any other non-ASCII is replaced. With
+// "utf8", only path separators, control characters and invalid UTF-8 are
+// replaced. Otherwise UNICODE_FILENAMES chooses between ASCII and keeping
+// Unicode letters and digits.
+func sanitizeFilename(name, encoding string) string {
+	switch {
+	case encoding == "utf8":
+		return strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' || r == utf8.RuneError || unicode.IsControl(r) {
+				return '_'
+			}
+			return r
+		}, name)
+	case encoding == "" && cfg.UnicodeFilenames:
+		return unsafeUnicodeFilenameChars.ReplaceAllString(name, "_")
+	}
+	return unsafeFilenameChars.ReplaceAllString(asciiFolder.Replace(name), "_")
+}
+
+// asciiFolder folds accented Latin letters to their ASCII base letters.
+var asciiFolder = func() *strings.Replacer {
+	groups := []struct{ from, to string }{
+		{"ÀÁÂÃÄÅĀĂĄ", "A"}, {"àáâãäåāăą", "a"}, {"ÇĆĈĊČ", "C"}, {"çćĉċč", "c"},
+		{"ĎĐ", "D"}, {"ďđ", "d"}, {"ÈÉÊËĒĔĖĘĚ", "E"}, {"èéêëēĕėęě", "e"},
+		{"ĜĞĠĢ", "G"}, {"ĝğġģ", "g"}, {"ĤĦ", "H"}, {"ĥħ", "h"},
+		{"ÌÍÎÏĨĪĬĮİ", "I"}, {"ìíîïĩīĭįı", "i"}, {"Ĵ", "J"}, {"ĵ", "j"},
+		{"Ķ", "K"}, {"ķ", "k"}, {"ĹĻĽĿŁ", "L"}, {"ĺļľŀł", "l"},
+		{"ÑŃŅŇ", "N"}, {"ñńņň", "n"}, {"ÒÓÔÕÖØŌŎŐ", "O"}, {"òóôõöøōŏő", "o"},
+		{"ŔŖŘ", "R"}, {"ŕŗř", "r"}, {"ŚŜŞŠ", "S"}, {"śŝşš", "s"},
+		{"ŢŤŦ", "T"}, {"ţťŧ", "t"}, {"ÙÚÛÜŨŪŬŮŰŲ", "U"}, {"ùúûüũūŭůűų", "u"},
+		{"Ŵ", "W"}, {"ŵ", "w"}, {"ÝŶŸ", "Y"}, {"ýÿŷ", "y"}, {"ŹŻŽ", "Z"}, {"źżž", "z"},
+		{"Æ", "AE"}, {"æ", "ae"}, {"Œ", "OE"}, {"œ", "oe"}, {"ß", "ss"}, {"Þ", "Th"}, {"þ", "th"},
+	}
+	var pairs []string
+	for _, group := range groups {
+		for _, r := range group.from {
+			pairs = append(pairs, string(r), group.to)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+// unwrapCDNURL returns the original image URL wrapped by an image
+// optimization endpoint such as Next.js's /_next/image, if parsedURL is one.
+func unwrapCDNURL(parsedURL *url.URL) (string, bool) {
+	if (parsedURL.Host == "nextjs.org" && strings.HasPrefix(parsedURL.Path, "/_next/image")) ||
+		(parsedURL.Host == "vercel-storage.com" && strings.Contains(parsedURL.Path, "/_next/image")) {
+		if rawImageURL := parsedURL.Query().Get("url"); rawImageURL != "" {
+			if decodedImageURL, err := url.QueryUnescape(rawImageURL); err == nil {
+				return decodedImageURL, true
+			}
+		}
+	}
+	return "", false
+}
+
+// applyPathTemplate renders a directory template such as "{host}/{yyyy}/{mm}"
+// for a download and returns fileName inside it. {yyyy}, {mm} and {dd} come
+// from the response's Last-Modified date, or the current date when it is
+// absent; {ext} is the file extension without its dot. Each rendered segment
+// is sanitized and empty, "." and ".." segments are dropped, so the result
+// always stays inside the archive root.
+func applyPathTemplate(template, imageURL, fileName string, modified time.Time) string {
+	if template == "" {
+		return fileName
+	}
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	modified = modified.UTC()
+
+	host := ""
+	if parsedURL, err := url.Parse(imageURL); err == nil {
+		host = parsedURL.Hostname()
+	}
+	replacer := strings.NewReplacer(
+		"{host}", host,
+		"{yyyy}", modified.Format("2006"),
+		"{mm}", modified.Format("01"),
+		"{dd}", modified.Format("02"),
+		"{ext}", strings.TrimPrefix(filepath.Ext(fileName), "."),
+	)
+
+	return path.Join(templatePath(replacer.Replace(template)), fileName)
+}
+
+// templatePath sanitizes each segment of a rendered directory template,
+// dropping empty, "." and ".." segments so the path stays relative.
+func templatePath(rendered string) string {
+	var segments []string
+	for _, segment := range strings.Split(rendered, "/") {
+		segment = sanitizeFilename(segment, "")
+		if segment != "" && segment != "." && segment != ".." {
+			segments = append(segments, segment)
+		}
+	}
+	return path.Join(segments...)
+}
+
+// dispositionFilename returns the filename declared by a Content-Disposition
+// header, decoding RFC 5987 filename* values and sanitized for encoding, or
+// "" when the header is absent or unparseable.
+func dispositionFilename(header, encoding string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return sanitizeFilename(name, encoding)
+}
+
+// windowsReservedNames are device names Windows refuses as a file's base
+// name, whatever its extension.
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// windowsSafeName rewrites each component of the slash-separated name so it
+// can be extracted on Windows: trailing dots and spaces are removed, and a
+// reserved device name such as "CON.jpg" gets a "_" after its base, becoming
+// "CON_.jpg".
+func windowsSafeName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segment = strings.TrimRight(segment, ". ")
+		if segment == "" {
+			segment = "_"
+		}
+		base, rest, _ := strings.Cut(segment, ".")
+		if windowsReservedNames[strings.ToLower(strings.TrimRight(base, " "))] {
+			segment = base + "_"
+			if rest != "" {
+				segment += "." + rest
+			}
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestApplyPathTemplate(t *testing.T) {
+	modified := time.Date(2023, time.March, 7, 23, 30, 0, 0, time.FixedZone("", -2*3600))
+	tests := []struct {
+		template, url, name, want string
+	}{
+		{"", "https://example.com/a.png", "a.png", "a.png"},
+		{"{host}/{yyyy}/{mm}", "https://cdn.example.com:8443/a.png", "a.png", "cdn.example.com/2023/03/a.png"},
+		{"{yyyy}-{mm}-{dd}/{ext}", "https://example.com/a.jpeg", "a.jpeg", "2023-03-08/jpeg/a.jpeg"},
+		{"../{host}/./..//x", "https://example.com/a.png", "a.png", "example.com/x/a.png"},
+		{"/abs/{host}", "https://example.com/a.png", "a.png", "abs/example.com/a.png"},
+		{"{host}", "not a url\x7f", "a.png", "a.png"},
+	}
+	for _, tt := range tests {
+		if got := applyPathTemplate(tt.template, tt.url, tt.name, modified); got != tt.want {
+			t.Errorf("applyPathTemplate(%q, %q) = %q, want %q", tt.template, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestPathTemplateNestsArchiveEntries(t *testing.T) {
+	body := pngImage(t, 2, 2)
+	upstream := serveBytes(t, "image/png", body)
+	dated := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Last-Modified", "Tue, 05 Sep 2023 10:00:00 GMT")
+		w.Write(body)
+	})
+
+	rec := postDownload(t, `{"pathTemplate":"{host}/{yyyy}/{ext}","imageURLs":["`+dated.URL+`/a.png","`+upstream.URL+`/b.png"]}`)
+	entries := zipEntries(t, rec)
+	if _, ok := entries["127.0.0.1/2023/png/a.png"]; !ok {
+		t.Errorf("archive entries %v lack 127.0.0.1/2023/png/a.png", keys(entries))
+	}
+	if _, ok := entries["127.0.0.1/"+time.Now().UTC().Format("2006")+"/png/b.png"]; !ok {
+		t.Errorf("archive entries %v lack this year's b.png", keys(entries))
+	}
+}
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", ""},
+		{`attachment; filename="report.png"`, "report.png"},
+		{`inline; filename=plain.jpg`, "plain.jpg"},
+		{`attachment; filename*=UTF-8''na%C3%AFve%20photo.png`, "na\u00efve photo.png"},
+		{`attachment; filename="fallback.png"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.png`, "\u65e5\u672c.png"},
+		{`attachment; filename="../../etc/passwd.png"`, "passwd.png"},
+		{`attachment; filename="C:\\dir\\win.png"`, "win.png"},
+		{`attachment; filename=".."`, ""},
+		{`attachment; filename="unterminated`, ""},
+	}
+	for _, tt := range tests {
+		if got := dispositionFilename(tt.header, "utf8"); got != tt.want {
+			t.Errorf("dispositionFilename(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestUseContentDisposition(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	image := pngImage(t, 2, 2)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", r.URL.Query().Get("cd"))
+		w.Write(image)
+	})
+	download := func(disposition string, use bool) string {
+		body := `{"output":"local","destDir":"out","filenameEncoding":"utf8","useContentDisposition":` + strconv.FormatBool(use) +
+			`,"imageURLs":["` + upstream.URL + `/download?cd=` + url.QueryEscape(disposition) + `"]}`
+		return decodeReport(t, postDownload(t, body)).Entries[0].Filename
+	}
+
+	if got := download(`attachment; filename="plain.png"`, true); got != "plain.png" {
+		t.Errorf("plain header: %q", got)
+	}
+	if got := download(`attachment; filename*=UTF-8''caf%C3%A9.png`, true); got != "caf\u00e9.png" {
+		t.Errorf("RFC 5987 header: %q", got)
+	}
+	if got := download(`attachment; filename="plain.png"`, false); got != "download.png" {
+		t.Errorf("header used without useContentDisposition: %q", got)
+	}
+}
+
+func TestDispositionExtensionConflict(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	image := baselineJPEG(t)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", `attachment; filename="photo.png"`)
+		w.Write(image)
+	})
+
+	tests := []struct {
+		option string
+		want   string
+	}{
+		{"", "photo.jpg"},
+		{"content", "photo.jpg"},
+		{"keep", "photo.png"},
+	}
+	for _, tt := range tests {
+		body := `{"output":"local","destDir":"out-` + tt.option + `","useContentDisposition":true,"dispositionExtension":"` + tt.option +
+			`","imageURLs":["` + upstream.URL + `/download"]}`
+		entry := decodeReport(t, postDownload(t, body)).Entries[0]
+		if entry.Filename != tt.want || entry.ContentType != "image/jpeg" {
+			t.Errorf("dispositionExtension %q: saved as %q (%s), want %q", tt.option, entry.Filename, entry.ContentType, tt.want)
+		}
+	}
+
+	rec := postDownload(t, `{"useContentDisposition":true,"dispositionExtension":"other","imageURLs":["`+upstream.URL+`/download"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid dispositionExtension: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHashedNameTakesDownloadedExtension(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "application/octet-stream", pngImage(t, 2, 2))
+	hashed := regexp.MustCompile(`^image_[0-9a-f]{16}\.png$`)
+
+	for i, agreement := range []bool{false, true} {
+		body := `{"output":"local","destDir":"out` + strconv.Itoa(i) + `","requireTypeAgreement":` + strconv.FormatBool(agreement) +
+			`,"imageURLs":["` + upstream.URL + `/"]}`
+		entry := decodeReport(t, postDownload(t, body)).Entries[0]
+		if entry.Error != "" || !hashed.MatchString(entry.Filename) {
+			t.Errorf("requireTypeAgreement %v: saved as %q (error %q), want a hashed .png name", agreement, entry.Filename, entry.Error)
+		}
+	}
+}
+
+func TestDefaultExtension(t *testing.T) {
+	setConfig(t, func(c *config) { c.DefaultExtension = ".bin" })
+	if got := generateFilename("https://example.com/photo", ""); got != "photo.bin" {
+		t.Errorf("extension-less URL: %q, want photo.bin", got)
+	}
+	if got := generateFilename("https://example.com/photo.gif", ""); got != "photo.gif" {
+		t.Errorf("URL with an extension: %q, want photo.gif", got)
+	}
+}
+
+func TestGenerateFilenameDecodesEscapes(t *testing.T) {
+	tests := []struct {
+		url     string
+		unicode bool
+		want    string
+	}{
+		{"https://example.com/images/caf%C3%A9.jpg", false, "cafe.jpg"},
+		{"https://example.com/images/caf%C3%A9.jpg", true, "café.jpg"},
+		{"https://example.com/images/caf%25C3%25A9.jpg", false, "cafe.jpg"},
+		{"https://example.com/images/a%2520b.png", false, "a_b.png"},
+		{"https://example.com/images/100%25.png", false, "100_.png"},
+		{"https://example.com/images/a%252Fb.png", false, "a_2Fb.png"},
+		{"https://example.com/images/bad%zz.png?x=1", false, "bad_zz.png"},
+		{"https://example.com/%E6%97%A5%E6%9C%AC.png", true, "日本.png"},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.UnicodeFilenames = tt.unicode })
+		if got := generateFilename(tt.url, ""); got != tt.want {
+			t.Errorf("generateFilename(%q) with UNICODE_FILENAMES=%v = %q, want %q", tt.url, tt.unicode, got, tt.want)
+		}
+	}
+
+	// Segments decoding to a dot segment fall back to the hashed name.
+	hashed := regexp.MustCompile(`^image_[0-9a-f]{16}\.(jpg|png)$`)
+	for _, rawURL := range []string{
+		"https://example.com/images/%2e%2e",
+		"https://example.com/images/%2E%2E?format=png",
+		"https://example.com/images/%252e%252e",
+		"https://example.com/images/%2e",
+		"https://example.com/images/%252e",
+		"https://example.com/images/..%2f",
+	} {
+		if got := generateFilename(rawURL, ""); !hashed.MatchString(got) {
+			t.Errorf("generateFilename(%q) = %q, want a hashed name", rawURL, got)
+		}
+	}
+}
+
+func TestWindowsSafeName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"CON", "CON_"},
+		{"con.jpg", "con_.jpg"},
+		{"PRN.JPG", "PRN_.JPG"},
+		{"COM1.tar.gz", "COM1_.tar.gz"},
+		{"nul ", "nul_"},
+		{"file.", "file"},
+		{"file ", "file"},
+		{"file. . ", "file"},
+		{"...", "_"},
+		{"aux/lpt9.png", "aux_/lpt9_.png"},
+		{"console.jpg", "console.jpg"},
+		{"com10.png", "com10.png"},
+	}
+	for _, tt := range tests {
+		if got := windowsSafeName(tt.name); got != tt.want {
+			t.Errorf("windowsSafeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWindowsSafeOption(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	body := `"imageURLs":["` + upstream.URL + `/CON.png"]}`
+
+	if entries := zipEntries(t, postDownload(t, `{`+body)); entries["CON_.png"] == nil {
+		t.Errorf("default entries %v, want CON_.png", keys(entries))
+	}
+	if entries := zipEntries(t, postDownload(t, `{"windowsSafe":false,`+body)); entries["CON.png"] == nil {
+		t.Errorf("windowsSafe false entries %v, want CON.png", keys(entries))
+	}
+}
+
+func TestSanitizeFilenameEncoding(t *testing.T) {
+	tests := []struct {
+		name, encoding, want string
+	}{
+		{"café-写真.png", "utf8", "café-写真.png"},
+		{"café-写真.png", "ascii", "cafe-__.png"},
+		{"a/b\\c\x01d.png", "utf8", "a_b_c_d.png"},
+		{"bad\xffbyte.png", "utf8", "bad_byte.png"},
+		{"résumé photo.jpg", "utf8", "résumé photo.jpg"},
+		{"résumé photo.jpg", "ascii", "resume_photo.jpg"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.name, tt.encoding); got != tt.want {
+			t.Errorf("sanitizeFilename(%q, %q) = %q, want %q", tt.name, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestFilenameEncodingInArchive(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	imageURL := upstream.URL + "/caf%C3%A9-%E5%86%99%E7%9C%9F.png"
+
+	tests := []struct {
+		encoding string
+		want     string
+		utf8Flag bool
+	}{
+		{"utf8", "café-写真.png", true},
+		{"ascii", "cafe-__.png", false},
+	}
+	for _, tt := range tests {
+		rec := postDownload(t, `{"filenameEncoding":"`+tt.encoding+`","imageURLs":["`+imageURL+`"]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.encoding, rec.Code)
+		}
+		reader, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil || len(reader.File) != 1 {
+			t.Fatalf("%s: reading archive: %v", tt.encoding, err)
+		}
+		file := reader.File[0]
+		if file.Name != tt.want || (file.Flags&0x800 != 0) != tt.utf8Flag {
+			t.Errorf("%s: entry %q with flags %#x, want %q with UTF-8 flag %v", tt.encoding, file.Name, file.Flags, tt.want, tt.utf8Flag)
+		}
+	}
+
+	if rec := postDownload(t, `{"filenameEncoding":"latin1","imageURLs":["`+imageURL+`"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid filenameEncoding: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestQueryExtension(t *testing.T) {
+	tests := []struct {
+		url    string
+		params []string
+		want   string
+	}{
+		{"https://example.com/image?format=png", []string{"format", "fmt", "type"}, "image.png"},
+		{"https://example.com/image?fmt=webp", []string{"format", "fmt", "type"}, "image.webp"},
+		{"https://example.com/image?type=image/svg%2Bxml", []string{"format", "fmt", "type"}, "image.svg"},
+		{"https://example.com/image?format=JPEG", []string{"format", "fmt", "type"}, "image.jpg"},
+		{"https://example.com/image?format=thumbnail&fmt=gif", []string{"format", "fmt", "type"}, "image.gif"},
+		{"https://example.com/photo.png?format=webp", []string{"format", "fmt", "type"}, "photo.png"},
+		{"https://example.com/image?format=png", nil, "image"},
+		{"https://example.com/image?size=png", []string{"format", "fmt", "type"}, "image"},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.FormatQueryParams = tt.params })
+		if got := urlFilename(tt.url, ""); got != tt.want {
+			t.Errorf("urlFilename(%q) with FORMAT_QUERY_PARAMS=%v = %q, want %q", tt.url, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestEntryFilename(t *testing.T) {
+	tests := []struct {
+		entry imageEntry
+		want  string
+	}{
+		{imageEntry{URL: "https://example.com/a.png"}, "a.png"},
+		{imageEntry{URL: "https://example.com/a.png", Filename: "chosen.jpg"}, "chosen.jpg"},
+		{imageEntry{URL: "https://example.com/a.png", Filename: "../up/evil.png"}, "evil.png"},
+		{imageEntry{URL: "https://example.com/a.png", Filename: `dir\name.gif`}, "name.gif"},
+		{imageEntry{URL: "https://example.com/a.png", Filename: ".."}, "a.png"},
+		{imageEntry{URL: "https://example.com/a.png", Filename: "/"}, "a.png"},
+	}
+	for _, tt := range tests {
+		if got := entryFilename(tt.entry, ""); got != tt.want {
+			t.Errorf("entryFilename(%+v) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorKeepsEntryName(t *testing.T) {
+	image := pngImage(t, 2, 2)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photo":
+			// An error document under a name of its own, rejected as an
+			// error body, so a mirror serves the entry.
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="error.json"`)
+			w.Write([]byte(`{"error":"rate limited"}`))
+		case "/named/photo":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Disposition", `attachment; filename="mirror-copy.png"`)
+			w.Write(image)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(image)
+		}
+	})
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.ErrorBodies = "reject"
+	})
+	primary, mirror, named := upstream.URL+"/photo", upstream.URL+"/cdn/photo", upstream.URL+"/named/photo"
+
+	tests := []struct {
+		entry  string
+		source string
+		want   string
+	}{
+		{`{"url":"` + primary + `","mirrors":["` + mirror + `"]}`, mirror, "photo.png"},
+		{`{"url":"` + primary + `","mirrors":["` + named + `"]}`, named, "mirror-copy.png"},
+		{`{"url":"` + primary + `","filename":"chosen.jpg","mirrors":["` + named + `"]}`, named, "chosen.jpg"},
+	}
+	for i, tt := range tests {
+		rec := postDownload(t, `{"output":"local","destDir":"out`+strconv.Itoa(i)+`","useContentDisposition":true,"imageURLs":[`+tt.entry+`]}`)
+		entry := decodeReport(t, rec).Entries[0]
+		if entry.Error != "" || entry.Filename != tt.want || entry.Source != tt.source {
+			t.Errorf("%s: saved %q from %s (error %q), want %q from %s", tt.entry, entry.Filename, entry.Source, entry.Error, tt.want, tt.source)
+		}
+	}
+}
@@ -2,4 +2,4 @@ module image-downloader
 
 go 1.24.2
 
-require github.com/rs/cors v1.11.1 // indirect
+require github.com/rs/cors v1.11.1
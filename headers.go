@@ -0,0 +1,43 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// downloadHeaders returns the headers sent when fetching u: ACCEPT_LANGUAGE,
+// then the HOST_HEADERS defaults of every pattern matching its host, with
+// longer, more specific patterns taking precedence, overridden in turn by the
+// request's acceptLanguage and headers.
+func downloadHeaders(u *url.URL, request *downloadRequest) http.Header {
+	host := strings.ToLower(u.Hostname())
+	var patterns []string
+	for pattern := range cfg.HostHeaders {
+		if hostMatches(host, pattern) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slices.SortFunc(patterns, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+
+	header := make(http.Header)
+	if cfg.AcceptLanguage != "" {
+		header.Set("Accept-Language", cfg.AcceptLanguage)
+	}
+	for _, pattern := range patterns {
+		for name, value := range cfg.HostHeaders[pattern] {
+			header.Set(name, value)
+		}
+	}
+	if request.AcceptLanguage != "" {
+		header.Set("Accept-Language", request.AcceptLanguage)
+	}
+	for name, value := range request.Headers {
+		header.Set(name, value)
+	}
+	return header
+}
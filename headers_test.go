@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestDownloadHeadersPrecedence(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.HostHeaders = map[string]map[string]string{
+			"*.example.com":   {"Referer": "https://example.com/", "User-Agent": "generic"},
+			"cdn.example.com": {"User-Agent": "cdn"},
+			"other.test":      {"Referer": "https://other.test/"},
+		}
+	})
+
+	tests := []struct {
+		url     string
+		headers map[string]string
+		referer string
+		agent   string
+	}{
+		{"https://img.example.com/a.png", nil, "https://example.com/", "generic"},
+		{"https://CDN.example.com/a.png", nil, "https://example.com/", "cdn"},
+		{"https://cdn.example.com/a.png", map[string]string{"user-agent": "caller"}, "https://example.com/", "caller"},
+		{"https://unrelated.test/a.png", nil, "", ""},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		header := downloadHeaders(u, &downloadRequest{Headers: tt.headers})
+		if header.Get("Referer") != tt.referer || header.Get("User-Agent") != tt.agent {
+			t.Errorf("%s: Referer %q, User-Agent %q; want %q, %q", tt.url, header.Get("Referer"), header.Get("User-Agent"), tt.referer, tt.agent)
+		}
+	}
+}
+
+func TestHostHeadersSentUpstream(t *testing.T) {
+	image := pngImage(t, 2, 2)
+	var referer, agent string
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		referer, agent = r.Referer(), r.UserAgent()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.HostHeaders = map[string]map[string]string{"127.0.0.1": {"Referer": "https://gallery.test/", "User-Agent": "quirk"}}
+	})
+
+	rec := postDownload(t, `{"headers":{"User-Agent":"caller"},"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/a.png"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" {
+		t.Fatal(entry.Error)
+	}
+	if referer != "https://gallery.test/" || agent != "caller" {
+		t.Errorf("upstream saw Referer %q, User-Agent %q", referer, agent)
+	}
+}
+
+func TestEnvHostHeaders(t *testing.T) {
+	t.Setenv("HOST_HEADERS", `{" *.Example.com ": {"Referer": "https://example.com/"}}`)
+	if got := envHostHeaders("HOST_HEADERS"); got["*.example.com"]["Referer"] != "https://example.com/" {
+		t.Errorf("envHostHeaders = %v", got)
+	}
+	t.Setenv("HOST_HEADERS", `not json`)
+	if got := envHostHeaders("HOST_HEADERS"); got != nil {
+		t.Errorf("invalid HOST_HEADERS parsed as %v", got)
+	}
+}
+
+func TestAcceptLanguage(t *testing.T) {
+	localized := map[string][]byte{"": pngImage(t, 1, 1), "de": pngImage(t, 2, 2), "fr": pngImage(t, 3, 3)}
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(localized[r.Header.Get("Accept-Language")])
+	})
+
+	tests := []struct {
+		name        string
+		env         string
+		hostHeaders map[string]map[string]string
+		options     string
+		want        string
+	}{
+		{"default", "", nil, ``, ""},
+		{"ACCEPT_LANGUAGE", "de", nil, ``, "de"},
+		{"HOST_HEADERS over ACCEPT_LANGUAGE", "de", map[string]map[string]string{"127.0.0.1": {"Accept-Language": "fr"}}, ``, "fr"},
+		{"acceptLanguage over HOST_HEADERS", "", map[string]map[string]string{"127.0.0.1": {"Accept-Language": "fr"}}, `"acceptLanguage":"de",`, "de"},
+		{"headers over acceptLanguage", "", nil, `"acceptLanguage":"de","headers":{"accept-language":"fr"},`, "fr"},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) {
+			c.AcceptLanguage = tt.env
+			c.HostHeaders = tt.hostHeaders
+		})
+		rec := postDownload(t, `{`+tt.options+`"imageURLs":["`+upstream.URL+`/logo.png"]}`)
+		if got := zipEntries(t, rec)["logo.png"]; !bytes.Equal(got, localized[tt.want]) {
+			t.Errorf("%s: downloaded the wrong localized image, want the one for %q", tt.name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const hookTimeout = 30 * time.Second
+
+// runPlacedHook runs the post-download hook for result once its file has
+// been placed under its final name. Uploaded entries, files that were
+// already in the destination and collapsed duplicates have no new file and
+// are skipped. A failing hook removes the file and fails the entry.
+func runPlacedHook(result *downloadResult) {
+	if result.Error != "" || result.UploadStatus != 0 || result.Existing || result.original != nil {
+		return
+	}
+	if err := runPostDownloadHook(result.path, result.Source); err != nil {
+		log.Println("Download error:", err)
+		os.Remove(result.path)
+		result.Error = err.Error()
+	}
+}
+
+// runPostDownloadHook runs the configured hook command for a downloaded file.
+// The {path} and {url} placeholders in the command are replaced with the
+// file's final path and its source URL, which are also exported as
+// IMAGE_PATH and IMAGE_URL. The command is executed directly, never through a
+// shell.
+func runPostDownloadHook(filePath, imageURL string) error {
+	if !cfg.EnablePostDownloadHook || len(cfg.PostDownloadHook) == 0 {
+		return nil
+	}
+
+	replacer := strings.NewReplacer("{path}", filePath, "{url}", imageURL)
+	args := make([]string, len(cfg.PostDownloadHook))
+	for i, arg := range cfg.PostDownloadHook {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "IMAGE_PATH="+filePath, "IMAGE_URL="+imageURL)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("post-download hook failed for %s: %v: %s", imageURL, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
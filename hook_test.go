@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingHook configures a hook that appends its arguments and
+// environment to a file, which it returns.
+func recordingHook(t *testing.T, enabled bool) string {
+	t.Helper()
+	record := filepath.Join(t.TempDir(), "hook.log")
+	setConfig(t, func(c *config) {
+		c.EnablePostDownloadHook = enabled
+		c.PostDownloadHook = []string{"/bin/sh", "-c", `printf '%s|%s|%s|%s\n' "$1" "$2" "$IMAGE_PATH" "$IMAGE_URL" >> "$0"`, record, "{path}", "{url}"}
+	})
+	return record
+}
+
+func TestHookRunsOnPlacedFile(t *testing.T) {
+	record := recordingHook(t, true)
+	destRoot := t.TempDir()
+	setConfig(t, func(c *config) { c.DestRoot = destRoot })
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	imageURL := upstream.URL + "/cat.png"
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+imageURL+`"]}`)
+	report := decodeReport(t, rec)
+	if report.Succeeded != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	logged, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("hook did not run: %v", err)
+	}
+	path := filepath.Join(destRoot, "out", "cat.png")
+	if want := path + "|" + imageURL + "|" + path + "|" + imageURL + "\n"; string(logged) != want {
+		t.Errorf("hook ran with %q, want %q", logged, want)
+	}
+}
+
+func TestHookNeverRunsWhenDisabled(t *testing.T) {
+	record := recordingHook(t, false)
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+
+	zipEntries(t, postDownload(t, `{"imageURLs":["`+upstream.URL+`/cat.png"]}`))
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Errorf("disabled hook ran: %v", err)
+	}
+}
+
+func TestHookFailureFailsDownload(t *testing.T) {
+	destRoot := t.TempDir()
+	setConfig(t, func(c *config) {
+		c.DestRoot = destRoot
+		c.EnablePostDownloadHook = true
+		c.PostDownloadHook = []string{"/bin/sh", "-c", "echo infected; exit 3"}
+	})
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/cat.png"]}`)
+	report := decodeReport(t, rec)
+	if report.Failed != 1 || !strings.Contains(report.Entries[0].Error, "infected") {
+		t.Errorf("report = %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(destRoot, "out", "cat.png")); !os.IsNotExist(err) {
+		t.Errorf("file kept after the hook failed: %v", err)
+	}
+}
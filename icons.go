@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maxPageBytes limits how much of an HTML page or web manifest is read when
+// discovering icons.
+const maxPageBytes = 2 << 20
+
+var (
+	linkTagPattern   = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	attributePattern = regexp.MustCompile(`(?s)([a-zA-Z][a-zA-Z0-9_:-]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// iconRels are the <link rel> values that declare site icons.
+var iconRels = map[string]bool{
+	"icon":                         true,
+	"apple-touch-icon":             true,
+	"apple-touch-icon-precomposed": true,
+	"mask-icon":                    true,
+	"fluid-icon":                   true,
+}
+
+// iconsHandler downloads every icon a site declares and returns them as an
+// archive. The site is given by the url query parameter on GET, or by a JSON
+// body with a "url" field and any /download options on POST.
+func iconsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL string `json:"url"`
+		downloadRequest
+	}
+
+	switch r.Method {
+	case "GET":
+		request.URL = r.URL.Query().Get("url")
+	case "POST":
+		if err := decodeJSON(r.Body, &request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if request.URL == "" {
+		http.Error(w, "Missing url", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkReady(); err != nil {
+		log.Println("Rejecting download:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	icons, err := discoverIcons(request.URL)
+	if err != nil {
+		log.Println("Icon discovery error:", err)
+		http.Error(w, fmt.Sprintf("Failed to load site: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	request.ImageURLs = nil
+	for _, icon := range icons {
+		request.ImageURLs = append(request.ImageURLs, imageEntry{URL: icon})
+	}
+	request.trusted = isTrusted(r)
+	serveDownload(w, r, &request.downloadRequest)
+}
+
+// discoverIcons returns the icon URLs declared by the page at siteURL through
+// <link rel="icon"> and similar tags, the icons of its web app manifest, and
+// the conventional /favicon.ico.
+func discoverIcons(siteURL string) ([]string, error) {
+	page, base, err := fetchPage(siteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var icons []string
+	add := func(ref string, base *url.URL) {
+		resolved, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil || ref == "" {
+			return
+		}
+		if icon := resolved.String(); !seen[icon] {
+			seen[icon] = true
+			icons = append(icons, icon)
+		}
+	}
+
+	for _, tag := range linkTagPattern.FindAllString(string(page), -1) {
+		attributes := parseAttributes(tag)
+		href := attributes["href"]
+		for _, rel := range strings.Fields(strings.ToLower(attributes["rel"])) {
+			if iconRels[rel] {
+				add(href, base)
+				break
+			}
+			if rel == "manifest" {
+				for _, icon := range manifestIcons(href, base) {
+					add(icon, base)
+				}
+			}
+		}
+	}
+
+	add("/favicon.ico", base)
+	return icons, nil
+}
+
+// manifestIcons returns the absolute URLs of the icons listed in the web app
+// manifest at href, ignoring a manifest that cannot be loaded.
+func manifestIcons(href string, base *url.URL) []string {
+	manifestURL, err := base.Parse(href)
+	if err != nil {
+		return nil
+	}
+	data, manifestBase, err := fetchPage(manifestURL.String())
+	if err != nil {
+		log.Println("Icon discovery error:", err)
+		return nil
+	}
+
+	var manifest struct {
+		Icons []struct {
+			Src string `json:"src"`
+		} `json:"icons"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil
+	}
+
+	var icons []string
+	for _, icon := range manifest.Icons {
+		if resolved, err := manifestBase.Parse(icon.Src); err == nil && icon.Src != "" {
+			icons = append(icons, resolved.String())
+		}
+	}
+	return icons
+}
+
+func parseAttributes(tag string) map[string]string {
+	attributes := make(map[string]string)
+	for _, match := range attributePattern.FindAllStringSubmatch(tag, -1) {
+		attributes[strings.ToLower(match[1])] = match[2] + match[3] + match[4]
+	}
+	return attributes
+}
+
+// fetchPage fetches a page subject to the URL policy, which its redirects
+// must pass as image downloads' do, and returns its body and final URL after
+// redirects.
+func fetchPage(pageURL string) ([]byte, *url.URL, error) {
+	parsedURL, err := url.Parse(pageURL)
+	if err == nil {
+		err = checkURLPolicy(parsedURL)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("refusing to fetch %s: %v", pageURL, err)
+	}
+
+	client := &http.Client{
+		Transport: transportFor(parsedURL.Hostname()),
+		Timeout:   cfg.DownloadTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if err := checkRedirect(req.URL, via); err != nil {
+				return fmt.Errorf("refusing redirect to %s: %w", abbreviateURL(req.URL), err)
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(pageURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch URL %s: %w", pageURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &statusError{url: pageURL, code: resp.StatusCode}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPageBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", pageURL, err)
+	}
+	return data, resp.Request.URL, nil
+}
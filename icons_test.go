@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// iconSite serves a page declaring several icons, a manifest listing two
+// more, and the icons themselves, counting the requests for each path. The
+// counts may be read once the requests are done.
+func iconSite(t *testing.T) (*httptest.Server, map[string]int) {
+	t.Helper()
+	icon := pngImage(t, 2, 2)
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><head>
+				<link rel="icon" href="/favicon-32.png">
+				<LINK REL="shortcut icon" href='/shortcut.png'>
+				<link href="/touch.png" rel="apple-touch-icon">
+				<link rel="stylesheet" href="/style.css">
+				<link rel="manifest" href="/app/manifest.json">
+			</head></html>`)
+		case "/app/manifest.json":
+			fmt.Fprint(w, `{"icons":[{"src":"icon-192.png"},{"src":"/icon-512.png"}]}`)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(icon)
+		}
+	}))
+	t.Cleanup(site.Close)
+	return site, fetched
+}
+
+func TestIconsFetchesEveryDeclaredIcon(t *testing.T) {
+	site, fetched := iconSite(t)
+
+	rec := httptest.NewRecorder()
+	iconsHandler(rec, httptest.NewRequest(http.MethodGet, "/icons?url="+url.QueryEscape(site.URL+"/"), nil))
+	entries := zipEntries(t, rec)
+	for _, path := range []string{"/favicon-32.png", "/shortcut.png", "/touch.png", "/app/icon-192.png", "/icon-512.png", "/favicon.ico"} {
+		if fetched[path] != 1 {
+			t.Errorf("%s fetched %d times, want 1", path, fetched[path])
+		}
+	}
+	if fetched["/style.css"] != 0 {
+		t.Error("stylesheet was fetched")
+	}
+	if len(entries) != 6 {
+		t.Errorf("archive has %d entries, want 6", len(entries))
+	}
+}
+
+func TestIconsPostTakesDownloadOptions(t *testing.T) {
+	site, _ := iconSite(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/icons", strings.NewReader(`{"url":"`+site.URL+`/","maxImages":2,"overflow":"truncate"}`))
+	rec := httptest.NewRecorder()
+	iconsHandler(rec, req)
+	if entries := zipEntries(t, rec); len(entries) != 2 {
+		t.Errorf("archive has %d entries, want 2", len(entries))
+	}
+}
+
+func TestIconsPageRedirectsFollowPolicy(t *testing.T) {
+	site, _ := iconSite(t)
+	siteURL, _ := url.Parse(site.URL)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	}))
+	t.Cleanup(redirector.Close)
+	redirectTo := func(target string) string {
+		return redirector.URL + "/?to=" + url.QueryEscape(target)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		page   string
+	}{
+		{"block-list", func(c *config) { c.BlockHosts = []string{"blocked.example"} }, redirectTo("http://blocked.example/")},
+		{"allow-list", func(c *config) { c.AllowHosts = []string{"127.0.0.1"} }, redirectTo("http://localhost:" + siteURL.Port() + "/")},
+		{"cross-host", func(c *config) { c.BlockCrossHostRedirects = true }, redirectTo("http://localhost:" + siteURL.Port() + "/")},
+		{"host changes", func(c *config) { c.MaxRedirectHostChanges = 1 }, redirectTo(strings.Replace(redirectTo(site.URL+"/"), "127.0.0.1", "localhost", 1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, tt.change)
+			rec := httptest.NewRecorder()
+			iconsHandler(rec, httptest.NewRequest(http.MethodGet, "/icons?url="+url.QueryEscape(tt.page), nil))
+			if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "refusing redirect") {
+				t.Errorf("status = %d, body %q", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
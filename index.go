@@ -0,0 +1,39 @@
+package main
+
+import (
+	"html/template"
+	"io"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Downloaded images</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.gallery { display: flex; flex-wrap: wrap; gap: 1em; }
+figure { margin: 0; width: 200px; }
+img { max-width: 200px; max-height: 200px; }
+figcaption { font-size: 0.8em; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Downloaded images</h1>
+<div class="gallery">
+{{- range .}}
+<figure>
+<a href="{{.Filename}}"><img src="{{.Filename}}" alt="{{.Filename}}"></a>
+<figcaption>{{.Filename}}<br><a href="{{.Source}}">{{.Source}}</a></figcaption>
+</figure>
+{{- end}}
+</div>
+</body>
+</html>
+`))
+
+// writeIndex renders an HTML gallery linking to each of results, the entries
+// written to the archive, by its relative archive path.
+func writeIndex(w io.Writer, results []*downloadResult) error {
+	return indexTemplate.Execute(w, results)
+}
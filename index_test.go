@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIndexReferencesEachImage(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+
+	rec := postDownload(t, `{"index":true,"imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b%20c.png","`+upstream.URL+`/sub/c.png"]}`)
+	entries := zipEntries(t, rec)
+	index, ok := entries["index.html"]
+	if !ok {
+		t.Fatalf("archive has no index.html, entries %v", len(entries))
+	}
+	for name := range entries {
+		if name == "index.html" {
+			continue
+		}
+		if !strings.Contains(string(index), `<img src="`+name+`"`) {
+			t.Errorf("index.html does not reference %s", name)
+		}
+	}
+	if len(entries) != 4 {
+		t.Errorf("archive has %d entries, want 3 images and the index", len(entries))
+	}
+}
+
+func TestIndexEscapesNames(t *testing.T) {
+	var out strings.Builder
+	err := writeIndex(&out, []*downloadResult{
+		{Filename: `a"><script>.png`, Source: "https://example.com/a.png"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "<script>") {
+		t.Error("filename was not escaped")
+	}
+}
+
+func TestIndexListsOnlyArchivedEntries(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	target := newUploadTarget(t)
+
+	rec := postDownload(t, `{"index":true,"duplicates":"collapse","imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/a.png",`+
+		`"`+missing.URL+`/failed.png",{"url":"`+upstream.URL+`/uploaded.png","uploadURL":"`+target.URL+`/put"}]}`)
+	entries := zipEntries(t, rec)
+	index := string(entries["index.html"])
+	if len(entries) != 2 || entries["a.png"] == nil {
+		t.Fatalf("archive entries %v, want a.png and the index", keys(entries))
+	}
+	if n := strings.Count(index, "<figure>"); n != 1 || !strings.Contains(index, `<img src="a.png"`) {
+		t.Errorf("index.html lists %d images, want only a.png:\n%s", n, index)
+	}
+	for _, name := range []string{"failed.png", "uploaded.png"} {
+		if strings.Contains(index, name) {
+			t.Errorf("index.html lists %s, which is not in the archive", name)
+		}
+	}
+}
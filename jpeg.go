@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+)
+
+// baselineJPEGQuality is the quality used when re-encoding progressive JPEGs
+// as baseline.
+const baselineJPEGQuality = 92
+
+// isProgressiveJPEG reports whether data is a JPEG whose frame header, found
+// by walking the marker segments up to the first scan, is progressive.
+func isProgressiveJPEG(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte("\xff\xd8")) {
+		return false
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		switch marker {
+		case 0xc2, 0xc6, 0xca, 0xce:
+			return true
+		case 0xc0, 0xc1, 0xc3, 0xc5, 0xc7, 0xc9, 0xcb, 0xcd, 0xcf, 0xda:
+			return false
+		}
+		i += 2 + (int(data[i+2])<<8 | int(data[i+3]))
+	}
+	return false
+}
+
+// toBaselineJPEG re-encodes the progressive JPEG at path as baseline for
+// clients that cannot decode progressive scans, returning its resulting
+// size. Other files are left untouched.
+func toBaselineJPEG(path string, size int64) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return size, err
+	}
+	if !isProgressiveJPEG(data) {
+		return size, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return size, err
+	}
+	var baseline bytes.Buffer
+	if err := jpeg.Encode(&baseline, img, &jpeg.Options{Quality: baselineJPEGQuality}); err != nil {
+		return size, err
+	}
+	if err := os.WriteFile(path, baseline.Bytes(), 0644); err != nil {
+		return size, err
+	}
+	return int64(baseline.Len()), nil
+}
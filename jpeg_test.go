@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"testing"
+)
+
+// progressiveJPEG returns an 8x8 grayscale progressive JPEG holding a single
+// DC-only scan, the smallest the standard decoder accepts. The standard
+// encoder only writes baseline JPEGs, so it is assembled by hand.
+func progressiveJPEG(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	b.WriteString("\xff\xd8")
+	b.WriteString("\xff\xdb\x00\x43\x00")
+	b.Write(bytes.Repeat([]byte{1}, 64))
+	// SOF2: 8-bit precision, 8x8, one component with 1x1 sampling.
+	b.WriteString("\xff\xc2\x00\x0b\x08\x00\x08\x00\x08\x01\x01\x11\x00")
+	// A DC table with a single one-bit code for category 0.
+	b.WriteString("\xff\xc4\x00\x14\x00\x01")
+	b.Write(make([]byte, 15))
+	b.WriteString("\x00")
+	// A DC scan of the component, coding a difference of zero.
+	b.WriteString("\xff\xda\x00\x08\x01\x01\x00\x00\x00\x00\x7f")
+	b.WriteString("\xff\xd9")
+
+	if _, err := jpeg.Decode(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatalf("progressive fixture does not decode: %v", err)
+	}
+	return b.Bytes()
+}
+
+func baselineJPEG(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestIsProgressiveJPEG(t *testing.T) {
+	if !isProgressiveJPEG(progressiveJPEG(t)) {
+		t.Error("progressive JPEG not detected")
+	}
+	if isProgressiveJPEG(baselineJPEG(t)) {
+		t.Error("baseline JPEG reported progressive")
+	}
+	if isProgressiveJPEG(pngImage(t, 2, 2)) {
+		t.Error("PNG reported progressive")
+	}
+}
+
+func TestJPEGScanBaseline(t *testing.T) {
+	progressive := serveBytes(t, "image/jpeg", progressiveJPEG(t))
+	baseline := baselineJPEG(t)
+	unchanged := serveBytes(t, "image/jpeg", baseline)
+
+	entries := zipEntries(t, postDownload(t, `{"jpegScan":"baseline","imageURLs":["`+progressive.URL+`/p.jpg","`+unchanged.URL+`/b.jpg"]}`))
+	converted := entries["p.jpg"]
+	if isProgressiveJPEG(converted) {
+		t.Error("p.jpg is still progressive")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(converted)); err != nil {
+		t.Errorf("p.jpg does not decode: %v", err)
+	}
+	if !bytes.Equal(entries["b.jpg"], baseline) {
+		t.Error("baseline b.jpg was re-encoded")
+	}
+
+	entries = zipEntries(t, postDownload(t, `{"imageURLs":["`+progressive.URL+`/p.jpg"]}`))
+	if !isProgressiveJPEG(entries["p.jpg"]) {
+		t.Error("progressive JPEG converted without jpegScan")
+	}
+}
+
+func TestJPEGScanOptions(t *testing.T) {
+	upstream := serveBytes(t, "image/jpeg", baselineJPEG(t))
+	for _, scan := range []string{"progressive", "interlaced"} {
+		if rec := postDownload(t, `{"jpegScan":"`+scan+`","imageURLs":["`+upstream.URL+`/a.jpg"]}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("jpegScan %q: status %d, want 400", scan, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// globalWaiting counts the requests whose next download is waiting for a
+// MAX_GLOBAL_DOWNLOADS slot. Each request launches its downloads one at a
+// time, so at most one of its downloads waits at once.
+var globalWaiting atomic.Int64
+
+// acquireGlobal takes a global download slot, counting the wait for it.
+func acquireGlobal() {
+	globalWaiting.Add(1)
+	defer globalWaiting.Add(-1)
+	globalLimiter.acquire()
+}
+
+// globalSaturated reports whether every MAX_GLOBAL_DOWNLOADS slot is taken.
+func globalSaturated() bool {
+	slots, ok := globalLimiter.(fixedLimiter)
+	return ok && len(slots) == cap(slots)
+}
+
+// checkLoad returns an error when HEALTH_MODE is "load" and more requests
+// than HEALTH_MAX_QUEUED wait for a global download slot.
+func checkLoad() error {
+	if cfg.HealthMode != "load" {
+		return nil
+	}
+	if waiting := globalWaiting.Load(); waiting > int64(cfg.HealthMaxQueued) {
+		return fmt.Errorf("download slot queue at %d, HEALTH_MAX_QUEUED is %d", waiting, cfg.HealthMaxQueued)
+	}
+	return nil
+}
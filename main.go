@@ -1,17 +1,17 @@
 package main
 
 import (
-	"archive/zip"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,18 +20,38 @@ import (
 )
 
 func main() {
+	if err := openAuditLog(); err != nil {
+		log.Fatal("Failed to open audit log: ", err)
+	}
+	if cfg.SelfTestURL != "" {
+		if err := runSelfTest(); err != nil && cfg.SelfTestRequired {
+			log.Fatal("Self-test failed: ", err)
+		} else if err != nil {
+			log.Println("Self-test failed:", err)
+		} else {
+			log.Println("Self-test passed:", cfg.SelfTestURL)
+		}
+	}
+
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type"},
 		AllowCredentials: true,
-		MaxAge:          300,
+		MaxAge:           300,
 	})
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", rootHandler)
+	if cfg.EnableUI {
+		mux.HandleFunc("/status", statusHandler)
+	}
 	mux.HandleFunc("/download", downloadHandler)
 	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/icons", iconsHandler)
+	mux.HandleFunc("/debug/url", debugURLHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -39,14 +59,29 @@ func main() {
 	}
 
 	log.Printf("Server started on :%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, c.Handler(mux)))
+	var handler http.Handler = mux
+	if cfg.CompressResponses {
+		handler = gzipMiddleware(handler)
+	}
+
+	log.Fatal(http.ListenAndServe(":"+port, c.Handler(handler)))
 }
 
+// rootHandler serves the browser UI when ENABLE_UI is set, and the JSON
+// status otherwise.
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
+	if cfg.EnableUI {
+		uiHandler(w, r)
+		return
+	}
+	statusHandler(w, r)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":  "active",
@@ -56,151 +91,541 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if cfg.HealthMode == "load" && globalSaturated() {
+		json.NewEncoder(w).Encode(map[string]string{"status": "degraded", "reason": "all global download slots in use"})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
 }
 
-func downloadImage(url string, filePath string, wg *sync.WaitGroup, errChan chan<- error) {
-	defer wg.Done()
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		errChan <- fmt.Errorf("failed to fetch URL %s: %v", url, err)
+// debugURLHandler reports how a URL would be processed by /download without
+// fetching it. With TRUSTED_API_KEYS set, only trusted callers may use it.
+func debugURLHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTrusted(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		errChan <- fmt.Errorf("bad status code for %s: %d", url, resp.StatusCode)
+	rawURL := r.URL.Query().Get("url")
+	if rawURL == "" {
+		http.Error(w, "Missing url parameter", http.StatusBadRequest)
 		return
 	}
 
-	file, err := os.Create(filePath)
+	result := map[string]interface{}{
+		"url":      rawURL,
+		"filename": generateFilename(rawURL, ""),
+		"allowed":  true,
+	}
+
+	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		errChan <- fmt.Errorf("failed to create file %s: %v", filePath, err)
+		result["allowed"] = false
+		result["reason"] = fmt.Sprintf("invalid URL: %v", err)
+	} else {
+		if normalized, err := normalizeURL(rawURL); err == nil {
+			result["normalizedURL"] = normalized
+		}
+		if imageURL, ok := unwrapCDNURL(parsedURL); ok {
+			result["cdnUnwrapped"] = imageURL
+		}
+		if err := checkURLPolicy(parsedURL); err != nil {
+			result["allowed"] = false
+			result["reason"] = err.Error()
+			var policy *policyError
+			if errors.As(err, &policy) {
+				result["rule"] = policy.rule
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	defer file.Close()
 
-	if _, err := io.Copy(file, resp.Body); err != nil {
-		errChan <- fmt.Errorf("failed to write image to file %s: %v", filePath, err)
+	if err := checkReady(); err != nil {
+		log.Println("Rejecting download:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
 	}
-}
 
-func generateFilename(originalURL string) string {
-	parsedURL, err := url.Parse(originalURL)
+	request, err := decodeDownloadRequest(r)
+	if err == errManifestTooLarge {
+		http.Error(w, "URL list too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		hash := sha256.Sum256([]byte(originalURL))
-		return fmt.Sprintf("image_%x.jpg", hash[:8])
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	fileName := ""
-	if (parsedURL.Host == "nextjs.org" && strings.HasPrefix(parsedURL.Path, "/_next/image")) ||
-		(parsedURL.Host == "vercel-storage.com" && strings.Contains(parsedURL.Path, "/_next/image")) {
-		if rawImageURL := parsedURL.Query().Get("url"); rawImageURL != "" {
-			if decodedImageURL, err := url.QueryUnescape(rawImageURL); err == nil {
-				fileName = filepath.Base(decodedImageURL)
+	if request.RetryToken != "" {
+		rerun, ok := rerunBatches.lookup(request.RetryToken, apiKey(r))
+		if !ok {
+			http.Error(w, "Unknown or expired retryToken", http.StatusNotFound)
+			return
+		}
+		request = rerun
+	}
+
+	request.trusted = isTrusted(r)
+	serveDownload(w, r, request)
+}
+
+// countHosts returns the number of distinct hosts among the URLs and mirrors
+// of entries.
+func countHosts(entries []imageEntry) int {
+	hosts := make(map[string]bool)
+	for _, entry := range entries {
+		for _, imageURL := range append([]string{entry.URL}, entry.Mirrors...) {
+			if u, err := url.Parse(imageURL); err == nil {
+				hosts[strings.ToLower(u.Host)] = true
 			}
 		}
 	}
+	return len(hosts)
+}
 
-	if fileName == "" {
-		fileName = filepath.Base(parsedURL.Path)
-		if fileName == "." || fileName == "/" {
-			hash := sha256.Sum256([]byte(originalURL))
-			fileName = fmt.Sprintf("image_%x", hash[:8])
+// serveDownload downloads the images of request, made by r, and writes the
+// archive or report to w.
+func serveDownload(w http.ResponseWriter, r *http.Request, request *downloadRequest) {
+	timer := newPhaseTimer()
+	entries := request.ImageURLs[:0]
+	for _, entry := range request.ImageURLs {
+		if entry.URL = strings.TrimSpace(entry.URL); entry.URL != "" {
+			entries = append(entries, entry)
 		}
 	}
+	emptyEntries := len(request.ImageURLs) - len(entries)
+	request.ImageURLs = entries
 
-	if filepath.Ext(fileName) == "" {
-		pathExt := filepath.Ext(parsedURL.Path)
-		if pathExt != "" {
-			fileName += pathExt
-		} else {
-			fileName += ".jpg"
+	if len(request.ImageURLs) == 0 {
+		http.Error(w, "No URLs provided", http.StatusBadRequest)
+		return
+	}
+
+	for _, entry := range request.ImageURLs {
+		if len(entry.Meta) > cfg.MaxMetaBytes {
+			http.Error(w, fmt.Sprintf("meta for %s exceeds %d bytes", entry.URL, cfg.MaxMetaBytes), http.StatusBadRequest)
+			return
+		}
+		if digest, err := hex.DecodeString(entry.ExpectedSHA256); err != nil || entry.ExpectedSHA256 != "" && len(digest) != sha256.Size {
+			http.Error(w, fmt.Sprintf("expectedSha256 for %s is not a SHA-256 hex digest", entry.URL), http.StatusBadRequest)
+			return
 		}
 	}
 
-	reg := regexp.MustCompile(`[^a-zA-Z0-9\.\-_]`)
-	return reg.ReplaceAllString(fileName, "_")
-}
+	truncated := 0
+	if request.MaxImages > 0 && len(request.ImageURLs) > request.MaxImages {
+		switch request.Overflow {
+		case "", "error":
+			http.Error(w, fmt.Sprintf("Too many URLs: %d provided, maxImages is %d", len(request.ImageURLs), request.MaxImages), http.StatusBadRequest)
+			return
+		case "truncate":
+			truncated = len(request.ImageURLs) - request.MaxImages
+			request.ImageURLs = request.ImageURLs[:request.MaxImages]
+		default:
+			http.Error(w, "Invalid overflow mode", http.StatusBadRequest)
+			return
+		}
+	}
+	request.closeConnections = cfg.KeepAliveMaxHosts > 0 && countHosts(request.ImageURLs) > cfg.KeepAliveMaxHosts
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if len(request.AllowedTypes) > 0 {
+		if !request.trusted {
+			http.Error(w, "allowedTypes requires a trusted API key", http.StatusForbidden)
+			return
+		}
+		if err := checkAllowedTypesOverride(request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid allowedTypes: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkRetryStatusCodes(request.RetryStatusCodes); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid retryStatusCodes: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	var request struct {
-		ImageURLs []string `json:"imageURLs"`
-		DestDir   string   `json:"destDir"`
+	switch request.OrderBy {
+	case "", "input", "name", "size", "sizeDesc":
+	default:
+		http.Error(w, "Invalid orderBy", http.StatusBadRequest)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	switch request.OnConflict {
+	case "", "rename", "overwrite", "skip", "content":
+	default:
+		http.Error(w, "Invalid onConflict policy", http.StatusBadRequest)
 		return
 	}
 
-	if len(request.ImageURLs) == 0 {
-		http.Error(w, "No URLs provided", http.StatusBadRequest)
+	switch request.Duplicates {
+	case "", "keep", "collapse":
+	default:
+		http.Error(w, "Invalid duplicates policy", http.StatusBadRequest)
 		return
 	}
 
-	destDir := "temp_downloads"
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+	switch request.FilenameEncoding {
+	case "", "ascii", "utf8":
+	default:
+		http.Error(w, "Invalid filenameEncoding", http.StatusBadRequest)
 		return
 	}
-	defer os.RemoveAll(destDir)
 
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(request.ImageURLs))
-	downloadedFiles := make([]string, 0, len(request.ImageURLs))
+	switch request.DispositionExtension {
+	case "", "content", "keep":
+	default:
+		http.Error(w, "Invalid dispositionExtension", http.StatusBadRequest)
+		return
+	}
 
-	for _, url := range request.ImageURLs {
-		wg.Add(1)
-		fileName := generateFilename(url)
-		filePath := filepath.Join(destDir, fileName)
-		downloadedFiles = append(downloadedFiles, filePath)
-		go downloadImage(url, filePath, &wg, errChan)
+	if request.Normalize != nil {
+		if err := request.Normalize.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid normalize: %v", err), http.StatusBadRequest)
+			return
+		}
 	}
 
-	wg.Wait()
-	close(errChan)
+	switch request.JPEGScan {
+	case "", "baseline":
+	case "progressive":
+		http.Error(w, "Progressive JPEG output is not supported", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Invalid jpegScan", http.StatusBadRequest)
+		return
+	}
 
-	errorCount := 0
-	for err := range errChan {
-		log.Println("Download error:", err)
-		errorCount++
+	format, ok := archiveFormatFor(request.Format)
+	if !ok {
+		http.Error(w, "Invalid archive format", http.StatusBadRequest)
+		return
+	}
+	if request.FileMode != "" {
+		mode, err := parseEntryMode(request.FileMode)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid fileMode: %v", err), http.StatusBadRequest)
+			return
+		}
+		request.fileMode = mode
 	}
 
-	if len(downloadedFiles) == 0 {
-		http.Error(w, "No files were downloaded", http.StatusInternalServerError)
+	delivery := request.Delivery
+	switch delivery {
+	case "":
+		delivery = cfg.ArchiveDelivery
+	case "stream", "buffered":
+	default:
+		http.Error(w, "Invalid delivery mode", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=images.zip")
+	if request.Pipeline {
+		if request.Output != "" && request.Output != "zip" || delivery == "buffered" {
+			http.Error(w, "pipeline requires a streamed archive", http.StatusBadRequest)
+			return
+		}
+		if request.OrderBy != "" && request.OrderBy != "input" {
+			http.Error(w, "pipeline archives in completion order and cannot be combined with orderBy", http.StatusBadRequest)
+			return
+		}
+	}
 
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
+	if request.Ephemeral && request.DestDir != "" {
+		http.Error(w, "ephemeral cannot be combined with destDir", http.StatusBadRequest)
+		return
+	}
+	defaultDir := ""
+	if !request.Ephemeral && request.DestDir == "" {
+		defaultDir = defaultDestDir(time.Now())
+		request.DestDir = defaultDir
+	}
 
-	for _, filePath := range downloadedFiles {
-		file, err := os.Open(filePath)
-		if err != nil {
-			continue
+	switch request.Output {
+	case "", "zip":
+	case "local", "stream":
+		if request.DestDir == "" || cfg.DestRoot == "" {
+			http.Error(w, "Local output requires destDir and DEST_ROOT", http.StatusBadRequest)
+			return
+		}
+	case "webdav":
+		if cfg.WebDAVURL == "" {
+			http.Error(w, "WebDAV output requires WEBDAV_URL", http.StatusBadRequest)
+			return
 		}
+	default:
+		http.Error(w, "Invalid output mode", http.StatusBadRequest)
+		return
+	}
 
-		entry, err := zipWriter.Create(filepath.Base(filePath))
+	scratchRoot := ""
+	if request.TempProfile != "" {
+		if !request.trusted {
+			http.Error(w, "tempProfile requires a trusted API key", http.StatusForbidden)
+			return
+		}
+		var ok bool
+		if scratchRoot, ok = cfg.TempProfiles[request.TempProfile]; !ok {
+			http.Error(w, "Unknown tempProfile", http.StatusBadRequest)
+			return
+		}
+	}
+
+	request.connections = newConnectionBudget(request.MaxConnections)
+	defer request.connections.close()
+
+	if request.VerifyFirst {
+		if unreachable := unreachableEntries(request); len(unreachable) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(verifyReport{unreachable})
+			return
+		}
+	}
+
+	destDir, persistent, err := resolveDestDir(request.DestDir, scratchRoot)
+	if err == errInvalidDestDir {
+		http.Error(w, "Invalid destDir", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create directory %s: %v", destDir, err)
+		message, status := directoryErrorResponse(err)
+		http.Error(w, message, status)
+		return
+	}
+	if defaultDir != "" {
+		w.Header().Set("X-Dest-Dir", defaultDir)
+	}
+	if !persistent {
+		defer os.RemoveAll(destDir)
+	} else if cfg.DestQuotaBytes > 0 {
+		dropped, err := checkDestQuota(destDir, request)
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		if err != nil {
-			file.Close()
-			continue
+			log.Printf("Failed to measure %s: %v", destDir, err)
+			http.Error(w, "Failed to check destDir quota", http.StatusInternalServerError)
+			return
 		}
+		truncated += dropped
+	}
 
-		if _, err := io.Copy(entry, file); err != nil {
-			file.Close()
-			continue
+	// Scratch files stay next to a persistent destDir unless a tempProfile
+	// puts them elsewhere.
+	scratchParent := destDir
+	if persistent && scratchRoot != "" {
+		scratchParent = scratchRoot
+	}
+	var scratchDir string
+	if err = os.MkdirAll(scratchParent, 0755); err == nil {
+		scratchDir, err = os.MkdirTemp(scratchParent, ".download-")
+	}
+	if err != nil {
+		log.Printf("Failed to create directory in %s: %v", scratchParent, err)
+		message, status := directoryErrorResponse(err)
+		http.Error(w, message, status)
+		return
+	}
+	defer os.RemoveAll(scratchDir)
+
+	results := make([]*downloadResult, len(request.ImageURLs))
+	for i, entry := range request.ImageURLs {
+		results[i] = &downloadResult{
+			URL:      entry.URL,
+			Filename: entryFilename(entry, request.FilenameEncoding),
+			Meta:     entry.Meta,
+			Required: entry.Required,
+			path:     filepath.Join(scratchDir, strconv.Itoa(i)),
+		}
+	}
+
+	duplicates := make([][]int, len(results))
+	if request.Duplicates == "collapse" {
+		duplicates = collapseDuplicates(request.ImageURLs, results)
+	}
+
+	request.budget = newByteBudget(request)
+	request.memory = newMemoryBudget()
+	identity := newAuditIdentity(r)
+	budgetSkipped := 0
+	completed := make(chan int, len(results))
+	// complete reports entry i, followed by the duplicates sharing it.
+	complete := func(i int) {
+		completed <- i
+		for _, duplicate := range duplicates[i] {
+			completed <- duplicate
+		}
+	}
+	// The launcher must not read the results of duplicates, which placing
+	// the files may already be rewriting, so it skips them by index.
+	isDuplicate := make([]bool, len(results))
+	for _, indexes := range duplicates {
+		for _, duplicate := range indexes {
+			isDuplicate[duplicate] = true
 		}
-		file.Close()
 	}
-}
\ No newline at end of file
+	timer.startDownloads()
+	go func() {
+		var wg sync.WaitGroup
+		limiter := newDownloadLimiter(request)
+		for i, entry := range request.ImageURLs {
+			if isDuplicate[i] {
+				continue
+			}
+			limiter.acquire()
+			if request.budget.exhausted() {
+				limiter.release(0, false)
+				results[i].Error = "skipped: " + errBudgetExceeded.Error()
+				budgetSkipped++
+				auditLog.record(identity, results[i])
+				complete(i)
+				continue
+			}
+			acquireGlobal()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				downloadImage(request, entry, results[i])
+				auditLog.record(identity, results[i])
+				latency, failed := time.Since(start), results[i].Error != ""
+				globalLimiter.release(latency, failed)
+				limiter.release(latency, failed)
+				complete(i)
+			}()
+		}
+		wg.Wait()
+		close(completed)
+	}()
+
+	if request.Output == "stream" {
+		streamResults(w, destDir, request, results, completed, timer)
+		return
+	}
+	var pipeline *archiveBuilder
+	if request.Pipeline {
+		// The archive is built alongside the downloads, so it holds its
+		// build slot for the rest of the request.
+		archiveLimiter.acquire()
+		defer archiveLimiter.release(0, false)
+		setArchiveHeaders(w, format, truncated)
+		w.Header().Set("Trailer", "X-Succeeded, X-Failed, X-Total-Bytes, X-Archive-Error, X-Budget-Exceeded, X-Required-Failed, X-Retry-Token, Server-Timing")
+		pipeline = archiveCompleted(w, destDir, format, request, results, completed)
+	} else {
+		for range completed {
+		}
+
+		for _, result := range results {
+			result.Filename = applyPathTemplate(request.PathTemplate, result.URL, result.Filename, result.lastModified)
+		}
+		placeFiles(destDir, results, request)
+		if request.Output == "webdav" {
+			exportWebDAV(results, request)
+		}
+	}
+	timer.downloaded()
+
+	report := newDownloadReport(results)
+	report.Truncated = truncated
+	report.TotalBytes = request.budget.used.Load()
+	report.BudgetExceeded = request.budget.exhausted()
+	report.Timings = timer.timings()
+	report.Deduplicated = deduplicatedGroups(results)
+	report.DestDir = defaultDir
+	report.RetryToken = rerunBatches.save(request, results, apiKey(r))
+	if report.RetryToken != "" {
+		w.Header().Set("X-Retry-Token", report.RetryToken)
+	}
+	if emptyEntries > 0 || budgetSkipped > 0 {
+		report.Skipped = make(map[string]int)
+		if emptyEntries > 0 {
+			report.Skipped["empty"] = emptyEntries
+		}
+		if budgetSkipped > 0 {
+			report.Skipped["budget"] = budgetSkipped
+		}
+	}
+	if pipeline != nil {
+		archiveStart := time.Now()
+		pipeline.startTimeout()
+		total, err := pipeline.finish(request, report)
+		timer.archived(archiveStart)
+		w.Header().Set("Server-Timing", timer.serverTiming())
+		setArchiveTrailers(w, report, total, err)
+		w.Header().Set("X-Budget-Exceeded", strconv.FormatBool(report.BudgetExceeded))
+		w.Header().Set("X-Required-Failed", strconv.Itoa(report.RequiredFailed))
+		return
+	}
+	if request.Output == "local" || request.Output == "webdav" || report.BudgetExceeded || report.RequiredFailed > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Server-Timing", timer.serverTiming())
+		switch {
+		case report.BudgetExceeded:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case report.RequiredFailed > 0:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	if report.Succeeded == 0 {
+		http.Error(w, "No files were downloaded", http.StatusInternalServerError)
+		return
+	}
+
+	setArchiveHeaders(w, format, truncated)
+	// A writer that cannot flush would hold the whole streamed archive
+	// anyway, so it is sent buffered, with a Content-Length.
+	if delivery == "buffered" || responseFlusher(w) == nil {
+		serveBufferedArchive(w, r, scratchDir, format, request, report, timer)
+		return
+	}
+	w.Header().Set("Trailer", "X-Succeeded, X-Failed, X-Total-Bytes, X-Archive-Error, Server-Timing")
+
+	archiveStart := time.Now()
+	total, err := writeArchive(w, format, request, report)
+	timer.archived(archiveStart)
+	w.Header().Set("Server-Timing", timer.serverTiming())
+	setArchiveTrailers(w, report, total, err)
+}
+
+func setArchiveHeaders(w http.ResponseWriter, format archiveFormat, truncated int) {
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=images"+format.extension)
+	if truncated > 0 {
+		w.Header().Set("X-Truncated", strconv.Itoa(truncated))
+	}
+}
+
+// setArchiveTrailers sets the trailers of a streamed archive once it has
+// been written, total being the size of its image entries and err the
+// error finalizing it.
+func setArchiveTrailers(w http.ResponseWriter, report *downloadReport, total int64, err error) {
+	if err != nil {
+		log.Println("Failed to finalize archive:", err)
+	}
+	if errors.Is(err, errArchiveTimeout) {
+		w.Header().Set("X-Archive-Error", err.Error())
+	}
+	w.Header().Set("X-Succeeded", strconv.Itoa(report.Succeeded))
+	w.Header().Set("X-Failed", strconv.Itoa(report.Failed))
+	w.Header().Set("X-Total-Bytes", strconv.FormatInt(total, 10))
+}
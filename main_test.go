@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tests in a scratch working directory, so the
+// temp_downloads directory requests create does not land in the tree.
+//
+// Keep-alives are disabled on the shared transports: a pooled connection
+// can satisfy a request whose own dial then finishes in the background,
+// reading cfg after the test that started it has restored it.
+func TestMain(m *testing.M) {
+	for _, transport := range []*http.Transport{defaultTransport, http1Transport, http2Transport} {
+		transport.DisableKeepAlives = true
+	}
+	dir, err := os.MkdirTemp("", "image-downloader-test-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setConfig applies change to cfg for the rest of the test.
+func setConfig(t *testing.T, change func(c *config)) {
+	t.Helper()
+	saved := cfg
+	change(&cfg)
+	t.Cleanup(func() { cfg = saved })
+}
+
+// pngImage returns a w by h PNG filled with a single colour.
+func pngImage(t testing.TB, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{200, 30, 30, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveBytes returns an upstream that answers every request with body as
+// contentType.
+func serveBytes(t *testing.T, contentType string, body []byte) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// postDownload sends body to downloadHandler and returns the response.
+func postDownload(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, req)
+	return rec
+}
+
+// zipEntries returns the contents of the zip archive in rec, by name.
+func zipEntries(t *testing.T, rec *httptest.ResponseRecorder) map[string][]byte {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.Bytes()
+	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	entries := make(map[string][]byte)
+	for _, file := range reader.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(f)
+		f.Close()
+		entries[file.Name] = buf.Bytes()
+	}
+	return entries
+}
+
+// decodeReport decodes the JSON report in rec.
+func decodeReport(t *testing.T, rec *httptest.ResponseRecorder) downloadReport {
+	t.Helper()
+	var report downloadReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decoding report %q: %v", rec.Body.String(), err)
+	}
+	return report
+}
+
+func TestDownloadArchivesEachImage(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 4, 4))
+
+	rec := postDownload(t, `{"imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b.png"]}`)
+	entries := zipEntries(t, rec)
+	if len(entries) != 2 {
+		t.Errorf("archive has %d entries, want 2", len(entries))
+	}
+}
+
+func TestDownloadRejectsOtherMethods(t *testing.T) {
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, httptest.NewRequest(http.MethodGet, "/download", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDownloadRejectsEmptyList(t *testing.T) {
+	rec := postDownload(t, `{"imageURLs":[" "]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// Collapsed duplicates are rewritten as they are placed, while the launcher
+// is still walking the entries, so these are run under -race.
+func TestPipelineCollapsesDuplicates(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 4, 4))
+	imageURL := upstream.URL + "/same.png"
+
+	rec := postDownload(t, `{"pipeline":true,"duplicates":"collapse","imageURLs":["`+imageURL+`","`+imageURL+`","`+imageURL+`"]}`)
+	entries := zipEntries(t, rec)
+	if len(entries) != 1 {
+		t.Errorf("archive has %d entries, want 1", len(entries))
+	}
+}
+
+func TestStreamCollapsesDuplicates(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "image/png", pngImage(t, 4, 4))
+	imageURL := upstream.URL + "/same.png"
+
+	rec := postDownload(t, `{"output":"stream","destDir":"out","duplicates":"collapse","imageURLs":["`+imageURL+`","`+imageURL+`"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var streamed []struct {
+		Index       int    `json:"index"`
+		Error       string `json:"error"`
+		DuplicateOf *int   `json:"duplicateOf"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &streamed); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	if len(streamed) != 2 {
+		t.Fatalf("streamed %d results, want 2", len(streamed))
+	}
+	for _, result := range streamed {
+		if result.Error != "" {
+			t.Errorf("result %d failed: %s", result.Index, result.Error)
+		}
+	}
+}
+
+// debugURL asks debugURLHandler about rawURL and decodes its answer.
+func debugURL(t *testing.T, rawURL string) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	debugURLHandler(rec, httptest.NewRequest(http.MethodGet, "/debug/url?url="+url.QueryEscape(rawURL), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDebugURL(t *testing.T) {
+	tests := []struct {
+		url, filename, normalized, unwrapped, rule string
+	}{
+		{
+			url:       "https://nextjs.org/_next/image?url=%2Fstatic%2Fblog%2Fcover.png&w=1920&q=75",
+			filename:  "cover.png",
+			unwrapped: "/static/blog/cover.png",
+		},
+		{
+			url:       "https://nextjs.org/_next/image?url=https%3A%2F%2Fcdn.example.org%2Fdog.jpg&w=64",
+			filename:  "dog.jpg",
+			unwrapped: "https://cdn.example.org/dog.jpg",
+		},
+		{
+			url:        "HTTPS://Example.COM:443/b/photo%20one.JPG?x=1#frag",
+			filename:   "photo_one.JPG",
+			normalized: "https://example.com/b/photo%20one.JPG?x=1",
+		},
+		{
+			url:      "ftp://example.com/a.png",
+			filename: "a.png",
+			rule:     "scheme",
+		},
+	}
+	for _, tt := range tests {
+		result := debugURL(t, tt.url)
+		if result["filename"] != tt.filename {
+			t.Errorf("%s: filename = %v, want %s", tt.url, result["filename"], tt.filename)
+		}
+		if tt.normalized != "" && result["normalizedURL"] != tt.normalized {
+			t.Errorf("%s: normalizedURL = %v, want %s", tt.url, result["normalizedURL"], tt.normalized)
+		}
+		if tt.unwrapped != "" && result["cdnUnwrapped"] != tt.unwrapped {
+			t.Errorf("%s: cdnUnwrapped = %v, want %s", tt.url, result["cdnUnwrapped"], tt.unwrapped)
+		}
+		if allowed := tt.rule == ""; result["allowed"] != allowed {
+			t.Errorf("%s: allowed = %v, want %v", tt.url, result["allowed"], allowed)
+		}
+		if tt.rule != "" && result["rule"] != tt.rule {
+			t.Errorf("%s: rule = %v, want %s", tt.url, result["rule"], tt.rule)
+		}
+	}
+}
+
+func TestDebugURLReportsBlockList(t *testing.T) {
+	setConfig(t, func(c *config) { c.BlockHosts = []string{"blocked.example"} })
+
+	result := debugURL(t, "https://blocked.example/a.png")
+	if result["allowed"] != false || result["rule"] != "block-list" {
+		t.Errorf("got allowed %v, rule %v; want false, block-list", result["allowed"], result["rule"])
+	}
+}
+
+func TestDebugEndpointsRequireTrustedKey(t *testing.T) {
+	setConfig(t, func(c *config) { c.TrustedAPIKeys = []string{"secret"} })
+
+	handlers := map[string]http.HandlerFunc{
+		"/debug/url?url=https://example.com/a.png": debugURLHandler,
+		"/metrics": metricsHandler,
+	}
+	for target, handler := range handlers {
+		for key, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusForbidden, "secret": http.StatusOK} {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != want {
+				t.Errorf("%s with key %q: status = %d, want %d", target, key, rec.Code, want)
+			}
+		}
+	}
+}
+
+func TestMaxImagesOverflow(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	urls := `"` + upstream.URL + `/1.png","` + upstream.URL + `/2.png","` + upstream.URL + `/3.png"`
+
+	rec := postDownload(t, `{"maxImages":2,"imageURLs":[`+urls+`]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "3 provided, maxImages is 2") {
+		t.Errorf("error mode: status = %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	rec = postDownload(t, `{"maxImages":2,"overflow":"truncate","imageURLs":[`+urls+`]}`)
+	entries := zipEntries(t, rec)
+	if rec.Header().Get("X-Truncated") != "1" {
+		t.Errorf("X-Truncated = %q, want 1", rec.Header().Get("X-Truncated"))
+	}
+	if _, ok := entries["3.png"]; ok || len(entries) != 2 {
+		t.Errorf("truncated archive holds %d entries, 3.png present %v", len(entries), ok)
+	}
+
+	rec = postDownload(t, `{"maxImages":2,"overflow":"drop","imageURLs":[`+urls+`]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown mode: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBlankEntriesAreSkipped(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["", "  `+upstream.URL+`/a.png\t", "\n ", "`+upstream.URL+`/b.png"]}`)
+	report := decodeReport(t, rec)
+	if report.Succeeded != 2 || report.Failed != 0 || report.Skipped["empty"] != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	if url := report.Entries[0].URL; url != upstream.URL+"/a.png" {
+		t.Errorf("URL not trimmed: %q", url)
+	}
+}
+
+func TestLocalOutputWritesDestDir(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	image := pngImage(t, 2, 2)
+	upstream := serveBytes(t, "image/png", image)
+
+	rec := postDownload(t, `{"output":"local","destDir":"photos/2024","imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b.png"]}`)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want a JSON report", contentType)
+	}
+	report := decodeReport(t, rec)
+	if report.Succeeded != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		saved, err := os.ReadFile(filepath.Join(cfg.DestRoot, "photos", "2024", name))
+		if err != nil || !bytes.Equal(saved, image) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(cfg.DestRoot, "photos", "2024", ".download-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("scratch directories left behind: %v", leftovers)
+	}
+}
+
+func TestLocalOutputRequiresDestRoot(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = "" })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["https://example.com/a.png"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// httptestServer starts an upstream serving handler for the rest of the
+// test.
+func httptestServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// keys returns the names in entries, for failure messages.
+func keys(entries map[string][]byte) []string {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMetaRoundTripsIntoManifest(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+
+	rec := postDownload(t, `{"manifest":true,"imageURLs":[{"url":"`+upstream.URL+`/a.png","meta":{"sku":"A-1","tags":["x",2]}},"`+upstream.URL+`/b.png"]}`)
+	var manifest downloadReport
+	if err := json.Unmarshal(zipEntries(t, rec)["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	var meta bytes.Buffer
+	json.Compact(&meta, manifest.Entries[0].Meta)
+	if got := meta.String(); got != `{"sku":"A-1","tags":["x",2]}` {
+		t.Errorf("meta = %s", got)
+	}
+	if manifest.Entries[1].Meta != nil {
+		t.Errorf("entry without meta has %s", manifest.Entries[1].Meta)
+	}
+}
+
+func TestMetaSizeLimit(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxMetaBytes = 16 })
+
+	rec := postDownload(t, `{"imageURLs":[{"url":"https://example.com/a.png","meta":{"note":"far too long for the limit"}}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
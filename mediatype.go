@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// imageExtensions maps image media types to the extension given to files of
+// that type.
+var imageExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/avif":    ".avif",
+	"image/bmp":     ".bmp",
+	"image/tiff":    ".tiff",
+	"image/svg+xml": ".svg",
+	"image/x-icon":  ".ico",
+}
+
+// extensionTypes maps file extensions, including common variants, to their
+// image media type.
+var extensionTypes = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".jpe": "image/jpeg", ".jfif": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff", ".tiff": "image/tiff",
+	".svg": "image/svg+xml",
+	".ico": "image/x-icon",
+}
+
+// mediaTypeAliases maps non-standard spellings to a canonical media type.
+var mediaTypeAliases = map[string]string{
+	"image/jpg":                "image/jpeg",
+	"image/pjpeg":              "image/jpeg",
+	"image/x-png":              "image/png",
+	"image/vnd.microsoft.icon": "image/x-icon",
+	"image/x-ms-bmp":           "image/bmp",
+	"image/svg":                "image/svg+xml",
+}
+
+// sniffImageType identifies an image format from its leading bytes,
+// returning its media type or "" when no known signature matches.
+func sniffImageType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, pngSignature):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "image/gif"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "image/webp"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && (string(head[8:12]) == "avif" || string(head[8:12]) == "avis"):
+		return "image/avif"
+	case bytes.HasPrefix(head, []byte("BM")):
+		return "image/bmp"
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(head, []byte("\x00\x00\x01\x00")):
+		return "image/x-icon"
+	case isSVG(head):
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// headerMediaType returns the canonical base media type of a Content-Type
+// header, or "" when it is missing, invalid, or a generic binary type that
+// says nothing about the content.
+func headerMediaType(contentType string) string {
+	mediaType := baseMediaType(contentType)
+	if mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		return ""
+	}
+	return mediaType
+}
+
+// baseMediaType returns the canonical media type of value with its
+// parameters removed, so "image/svg+xml; charset=utf-8" is "image/svg+xml"
+// even when the parameters are malformed. It returns "" for an invalid type.
+func baseMediaType(value string) string {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return ""
+	}
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// mediaTypeEvidence holds the three independent indications of a download's
+// type. Any of them may be empty when unknown.
+type mediaTypeEvidence struct {
+	sniffed string
+	header  string
+	url     string
+}
+
+func newMediaTypeEvidence(head []byte, contentType, fileName string) mediaTypeEvidence {
+	return mediaTypeEvidence{
+		sniffed: sniffImageType(head),
+		header:  headerMediaType(contentType),
+		url:     extensionTypes[strings.ToLower(filepath.Ext(fileName))],
+	}
+}
+
+// resolve returns the download's media type using the documented
+// precedence: the sniffed bytes, then the Content-Type header, then the URL's
+// extension.
+func (e mediaTypeEvidence) resolve() string {
+	for _, mediaType := range []string{e.sniffed, e.header, e.url} {
+		if mediaType != "" {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// checkAgreement reports a conflict between any two known indications.
+func (e mediaTypeEvidence) checkAgreement() error {
+	resolved := e.resolve()
+	for _, source := range []struct{ name, mediaType string }{
+		{"sniffed content", e.sniffed}, {"Content-Type", e.header}, {"URL extension", e.url},
+	} {
+		if source.mediaType != "" && source.mediaType != resolved {
+			return &checkError{"type-agreement", fmt.Sprintf("%s says %s but content is %s", source.name, source.mediaType, resolved)}
+		}
+	}
+	return nil
+}
+
+// withImageExtension replaces the extension of fileName with the one for
+// mediaType, unless it already denotes that type or mediaType is not a known
+// image type.
+func withImageExtension(fileName, mediaType string) string {
+	ext, ok := imageExtensions[mediaType]
+	current := filepath.Ext(fileName)
+	if !ok || extensionTypes[strings.ToLower(current)] == mediaType {
+		return fileName
+	}
+	return strings.TrimSuffix(fileName, current) + ext
+}
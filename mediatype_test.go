@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var jpegHead = []byte("\xff\xd8\xff\xe0\x00\x10JFIF")
+
+func TestMediaTypePrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     []byte
+		header   string
+		fileName string
+		resolved string
+		conflict bool
+	}{
+		{"all agree", pngSignature, "image/png", "a.png", "image/png", false},
+		{"bytes over header", jpegHead, "image/png", "a.jpg", "image/jpeg", true},
+		{"bytes over extension", jpegHead, "image/jpeg", "a.png", "image/jpeg", true},
+		{"bytes over both", jpegHead, "image/gif", "a.png", "image/jpeg", true},
+		{"header over extension", []byte("unknown"), "image/gif", "a.png", "image/gif", true},
+		{"header alias", []byte("unknown"), "image/jpg", "a.jpeg", "image/jpeg", false},
+		{"octet-stream ignored", pngSignature, "application/octet-stream", "a", "image/png", false},
+		{"extension only", []byte("unknown"), "", "a.webp", "image/webp", false},
+		{"nothing known", []byte("unknown"), "", "a", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evidence := newMediaTypeEvidence(tt.head, tt.header, tt.fileName)
+			if got := evidence.resolve(); got != tt.resolved {
+				t.Errorf("resolve() = %q, want %q", got, tt.resolved)
+			}
+			if err := evidence.checkAgreement(); (err != nil) != tt.conflict {
+				t.Errorf("checkAgreement() = %v, want conflict %v", err, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestWithImageExtension(t *testing.T) {
+	tests := []struct{ fileName, mediaType, want string }{
+		{"a.png", "image/jpeg", "a.jpg"},
+		{"a.jpeg", "image/jpeg", "a.jpeg"},
+		{"a.JPG", "image/jpeg", "a.JPG"},
+		{"a", "image/gif", "a.gif"},
+		{"a.png", "application/pdf", "a.png"},
+	}
+	for _, tt := range tests {
+		if got := withImageExtension(tt.fileName, tt.mediaType); got != tt.want {
+			t.Errorf("withImageExtension(%q, %q) = %q, want %q", tt.fileName, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestMismatchedDownloadUsesSniffedType(t *testing.T) {
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(jpegHead)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/photo.png"]}`)
+	entry := decodeReport(t, rec).Entries[0]
+	if entry.Error != "" || entry.ContentType != "image/jpeg" || entry.Filename != "photo.jpg" {
+		t.Errorf("entry = %+v, want photo.jpg as image/jpeg", entry)
+	}
+
+	rec = postDownload(t, `{"requireTypeAgreement":true,"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/photo.png"]}`)
+	entry = decodeReport(t, rec).Entries[0]
+	if !strings.Contains(entry.Error, "type-agreement check failed") {
+		t.Errorf("error %q, want a type-agreement rejection", entry.Error)
+	}
+}
+
+func TestBaseMediaType(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"image/svg+xml; charset=utf-8", "image/svg+xml"},
+		{"Image/PNG", "image/png"},
+		{"image/jpg", "image/jpeg"},
+		{"image/svg+xml; charset", "image/svg+xml"},
+		{"image/png;;", "image/png"},
+		{"", ""},
+		{"not a type", ""},
+	}
+	for _, tt := range tests {
+		if got := baseMediaType(tt.value); got != tt.want {
+			t.Errorf("baseMediaType(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestEnvMediaTypes(t *testing.T) {
+	t.Setenv("ALLOWED_TYPES", "image/png, image/svg+xml; charset=utf-8,image/jpg,not a type")
+	if got := envMediaTypes("ALLOWED_TYPES"); strings.Join(got, ",") != "image/png,image/svg+xml,image/jpeg" {
+		t.Errorf("envMediaTypes = %q", got)
+	}
+}
+
+func TestCharsetContentTypeAccepted(t *testing.T) {
+	setConfig(t, func(c *config) { c.AllowedTypes = []string{"image/svg+xml"} })
+	upstream := serveBytes(t, "image/svg+xml; charset=utf-8", []byte(svgDocument))
+
+	for _, body := range []string{
+		`{"imageURLs":["` + upstream.URL + `/a.svg"]}`,
+		`{"strict":true,"imageURLs":["` + upstream.URL + `/a.svg"]}`,
+	} {
+		if entries := zipEntries(t, postDownload(t, body)); len(entries) != 1 {
+			t.Errorf("%s: archive has %v, want the SVG", body, keys(entries))
+		}
+	}
+}
+
+func TestUnknownContent(t *testing.T) {
+	blob := []byte("\x00\x01\x02\x03 not any known format \xfe\xff")
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/octet" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write(blob)
+	})
+	image := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	tests := []struct {
+		policy string
+		path   string
+		want   string
+	}{
+		{"keep", "/blob", "blob.jpg"},
+		{"bin", "/blob", "blob.bin"},
+		{"bin", "/octet", "octet.bin"},
+		{"bin", "/blob.dat", "blob.dat"},
+		{"reject", "/blob", ""},
+	}
+	for i, tt := range tests {
+		setConfig(t, func(c *config) { c.UnknownContent = tt.policy })
+		destDir := "out" + strconv.Itoa(i)
+		report := decodeReport(t, postDownload(t, `{"output":"local","destDir":"`+destDir+`","imageURLs":["`+upstream.URL+tt.path+`","`+image.URL+`/known"]}`))
+		entry, known := report.Entries[0], report.Entries[1]
+		if tt.want == "" {
+			if !strings.Contains(entry.Error, "content-type check failed") {
+				t.Errorf("UNKNOWN_CONTENT=%s %s: error %q, want a content-type rejection", tt.policy, tt.path, entry.Error)
+			}
+		} else if entry.Error != "" || entry.Filename != tt.want || !entry.ContentTypeUnknown {
+			t.Errorf("UNKNOWN_CONTENT=%s %s: saved as %q (unknown %t, error %q), want %q marked unknown",
+				tt.policy, tt.path, entry.Filename, entry.ContentTypeUnknown, entry.Error, tt.want)
+		}
+		if known.Error != "" || known.Filename != "known.png" || known.ContentTypeUnknown {
+			t.Errorf("UNKNOWN_CONTENT=%s: sniffed PNG saved as %q (unknown %t, error %q)", tt.policy, known.Filename, known.ContentTypeUnknown, known.Error)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var errMemoryLimit = errors.New("request memory limit exceeded")
+
+// memoryBudget bounds the memory one request's in-memory image transforms
+// hold at once to MAX_REQUEST_MEMORY. Transforms that fit wait for earlier
+// ones to release their share; a transform that could never fit is
+// refused. A nil budget reserves nothing.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+func newMemoryBudget() *memoryBudget {
+	if cfg.MaxRequestMemory <= 0 {
+		return nil
+	}
+	b := &memoryBudget{limit: cfg.MaxRequestMemory}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// reserve blocks until n bytes are free and returns the function releasing
+// them, or fails at once when n exceeds the whole limit.
+func (b *memoryBudget) reserve(n int64) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	if n > b.limit {
+		return nil, fmt.Errorf("%w: needs %d bytes, MAX_REQUEST_MEMORY is %d", errMemoryLimit, n, b.limit)
+	}
+	b.mu.Lock()
+	for b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		b.used -= n
+		b.mu.Unlock()
+		b.cond.Broadcast()
+	}, nil
+}
+
+// transformMemory estimates the memory the request's in-memory transforms
+// need for the file at path: twice its size, for the original and the
+// rewritten copy, plus eight bytes per pixel when a transform decodes it and
+// four per pixel of a normalize target. It returns 0 when no such transform
+// is requested.
+func transformMemory(path string, request *downloadRequest) (int64, error) {
+	decodes := request.Normalize != nil || request.JPEGScan == "baseline" || request.Optimize
+	if !decodes && !request.EmbedProvenance && !request.NormalizeText {
+		return 0, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	need := 2 * info.Size()
+	if decodes {
+		if width, height, _, err := describeImage(path); err == nil {
+			need += 8 * int64(width) * int64(height)
+		}
+	}
+	if request.Normalize != nil {
+		need += 4 * int64(request.Normalize.Width) * int64(request.Normalize.Height)
+	}
+	return need, nil
+}
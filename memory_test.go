@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetReserve(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxRequestMemory = 100 })
+	budget := newMemoryBudget()
+
+	if _, err := budget.reserve(101); !errors.Is(err, errMemoryLimit) {
+		t.Errorf("reserving past the limit: err = %v, want %v", err, errMemoryLimit)
+	}
+
+	release, err := budget.reserve(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := make(chan struct{})
+	go func() {
+		releaseSecond, _ := budget.reserve(60)
+		close(reserved)
+		releaseSecond()
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("second reservation did not wait for the first to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-reserved:
+	case <-time.After(time.Second):
+		t.Fatal("second reservation still waiting after release")
+	}
+
+	setConfig(t, func(c *config) { c.MaxRequestMemory = 0 })
+	if budget := newMemoryBudget(); budget != nil {
+		t.Error("MAX_REQUEST_MEMORY=0 has a budget")
+	}
+	if _, err := (*memoryBudget)(nil).reserve(1 << 40); err != nil {
+		t.Errorf("nil budget: %v", err)
+	}
+}
+
+func TestTransformMemory(t *testing.T) {
+	image := pngImage(t, 10, 20)
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(image))
+
+	tests := []struct {
+		name    string
+		request downloadRequest
+		want    int64
+	}{
+		{"no transform", downloadRequest{}, 0},
+		{"embedProvenance", downloadRequest{EmbedProvenance: true}, 2 * size},
+		{"optimize", downloadRequest{Optimize: true}, 2*size + 8*10*20},
+		{"normalize", downloadRequest{Normalize: &normalizeOptions{Format: "png", Width: 4, Height: 5}}, 2*size + 8*10*20 + 4*4*5},
+	}
+	for _, tt := range tests {
+		if got, err := transformMemory(path, &tt.request); err != nil || got != tt.want {
+			t.Errorf("%s: transformMemory = %d, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMemoryLimitRejectsLargeTransform(t *testing.T) {
+	image := pngImage(t, 200, 200)
+	upstream := serveBytes(t, "image/png", image)
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.MaxRequestMemory = 100 << 10
+		c.ArchiveDelivery = "buffered"
+	})
+	imageURL := upstream.URL + "/a.png"
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","normalize":{"format":"jpeg"},"imageURLs":["`+imageURL+`"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; !strings.Contains(entry.Error, "request memory limit exceeded") {
+		t.Errorf("200x200 normalize under a 100 KiB limit: error %q, want a memory limit rejection", entry.Error)
+	}
+
+	// Buffered archives are built on disk, so the limit does not apply.
+	body := `{"imageURLs":["` + imageURL + `","` + upstream.URL + `/b.png","` + upstream.URL + `/c.png"]}`
+	if entries := zipEntries(t, postDownload(t, body)); len(entries) != 3 {
+		t.Errorf("buffered archive has %v, want all three images", keys(entries))
+	}
+}
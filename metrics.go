@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otherHost is the host label shared by hosts beyond METRICS_MAX_HOSTS.
+const otherHost = "other"
+
+// durationBuckets are the upper bounds, in seconds, of the download duration
+// histogram.
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// hostStats accumulates the fetch outcomes and durations of one host label.
+type hostStats struct {
+	successes uint64
+	errors    uint64
+	buckets   []uint64
+	sum       float64
+	count     uint64
+}
+
+// hostMetrics records fetches per destination host. Only the first
+// METRICS_MAX_HOSTS hosts get their own label, so a request listing many
+// origins cannot grow the metrics without bound.
+type hostMetrics struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+var metrics = &hostMetrics{hosts: make(map[string]*hostStats)}
+
+// observe records one fetch of imageURL that took d.
+func (m *hostMetrics) observe(imageURL string, d time.Duration, failed bool) {
+	host := otherHost
+	if u, err := url.Parse(imageURL); err == nil && u.Hostname() != "" {
+		host = strings.ToLower(u.Hostname())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.hosts[host]
+	if !ok {
+		named := len(m.hosts)
+		if _, ok := m.hosts[otherHost]; ok {
+			named--
+		}
+		if named >= cfg.MetricsMaxHosts {
+			host = otherHost
+		}
+		if stats = m.hosts[host]; stats == nil {
+			stats = &hostStats{buckets: make([]uint64, len(durationBuckets))}
+			m.hosts[host] = stats
+		}
+	}
+
+	if failed {
+		stats.errors++
+	} else {
+		stats.successes++
+	}
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+	stats.sum += seconds
+	stats.count++
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format.
+func (m *hostMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hosts := make([]string, 0, len(m.hosts))
+	for host := range m.hosts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+
+	fmt.Fprintln(w, "# HELP image_downloads_total Image fetches by destination host and result.")
+	fmt.Fprintln(w, "# TYPE image_downloads_total counter")
+	for _, host := range hosts {
+		stats := m.hosts[host]
+		fmt.Fprintf(w, "image_downloads_total{host=%q,result=\"success\"} %d\n", host, stats.successes)
+		fmt.Fprintf(w, "image_downloads_total{host=%q,result=\"error\"} %d\n", host, stats.errors)
+	}
+
+	fmt.Fprintln(w, "# HELP image_download_duration_seconds Image fetch duration by destination host.")
+	fmt.Fprintln(w, "# TYPE image_download_duration_seconds histogram")
+	for _, host := range hosts {
+		stats := m.hosts[host]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "image_download_duration_seconds_bucket{host=%q,le=\"%g\"} %d\n", host, bound, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "image_download_duration_seconds_bucket{host=%q,le=\"+Inf\"} %d\n", host, stats.count)
+		fmt.Fprintf(w, "image_download_duration_seconds_sum{host=%q} %g\n", host, stats.sum)
+		fmt.Fprintf(w, "image_download_duration_seconds_count{host=%q} %d\n", host, stats.count)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTrusted(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeTo(w)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetMetrics replaces the global metrics with empty ones for the rest of
+// the test.
+func resetMetrics(t *testing.T) {
+	saved := metrics
+	metrics = &hostMetrics{hosts: make(map[string]*hostStats)}
+	t.Cleanup(func() { metrics = saved })
+}
+
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsLabelByHost(t *testing.T) {
+	resetMetrics(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	missingURL := strings.Replace(missing.URL, "127.0.0.1", "localhost", 1)
+
+	postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/a.png","`+upstream.URL+`/b.png","`+missingURL+`/c.png"]}`)
+	body := scrapeMetrics(t)
+	for _, line := range []string{
+		`image_downloads_total{host="127.0.0.1",result="success"} 2`,
+		`image_downloads_total{host="localhost",result="error"} 1`,
+		`image_download_duration_seconds_count{host="127.0.0.1"} 2`,
+		`image_download_duration_seconds_bucket{host="localhost",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %s:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsCapHostCardinality(t *testing.T) {
+	resetMetrics(t)
+	setConfig(t, func(c *config) { c.MetricsMaxHosts = 2 })
+
+	for _, host := range []string{"a.example", "b.example", "c.example", "d.example", "a.example"} {
+		metrics.observe("https://"+host+"/x.png", 10*time.Millisecond, false)
+	}
+	body := scrapeMetrics(t)
+	for line, want := range map[string]bool{
+		`image_downloads_total{host="a.example",result="success"} 2`: true,
+		`image_downloads_total{host="b.example",result="success"} 1`: true,
+		`image_downloads_total{host="other",result="success"} 2`:     true,
+		`host="c.example"`: false,
+		`host="d.example"`: false,
+	} {
+		if strings.Contains(body, line) != want {
+			t.Errorf("metrics containing %s = %v, want %v:\n%s", line, !want, want, body)
+		}
+	}
+}
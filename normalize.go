@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+)
+
+// normalizeJPEGQuality is the quality of JPEGs written by normalization.
+const normalizeJPEGQuality = 90
+
+// maxNormalizeDimension bounds the width and height a request may normalize
+// images to.
+const maxNormalizeDimension = 8192
+
+// normalizeOptions converts every image of a request to one format and,
+// when Width and Height are set, one resolution.
+type normalizeOptions struct {
+	// Format is "png" or "jpeg".
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Mode is "fit" (default) to shrink images that exceed Width x Height,
+	// keeping their aspect ratio; "fill" to scale and center-crop them to
+	// exactly Width x Height; or "pad" to scale them to fit and center them
+	// on a Width x Height canvas, transparent in PNG and black in JPEG.
+	Mode string `json:"mode"`
+}
+
+// validate reports what is wrong with the options, if anything.
+func (o *normalizeOptions) validate() error {
+	switch o.Format {
+	case "png", "jpeg":
+	default:
+		return fmt.Errorf("format must be png or jpeg")
+	}
+	switch o.Mode {
+	case "", "fit", "fill", "pad":
+	default:
+		return fmt.Errorf("mode must be fit, fill or pad")
+	}
+	if o.Width < 0 || o.Height < 0 || o.Width > maxNormalizeDimension || o.Height > maxNormalizeDimension {
+		return fmt.Errorf("width and height must be between 0 and %d", maxNormalizeDimension)
+	}
+	if (o.Width == 0) != (o.Height == 0) {
+		return fmt.Errorf("width and height must be given together")
+	}
+	return nil
+}
+
+// normalizeImage rewrites the image at path in the format and resolution of
+// options, returning its new size and media type. Images the standard
+// library cannot decode, such as SVG or WebP, fail.
+func normalizeImage(path string, options *normalizeOptions) (int64, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot decode image: %v", err)
+	}
+	if options.Width > 0 {
+		img = resizeImage(img, options.Width, options.Height, options.Mode)
+	}
+
+	var out bytes.Buffer
+	mediaType := "image/png"
+	if options.Format == "jpeg" {
+		mediaType = "image/jpeg"
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: normalizeJPEGQuality})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		return 0, "", err
+	}
+	return int64(out.Len()), mediaType, nil
+}
+
+// resizeImage scales img for a width x height target according to mode.
+func resizeImage(img image.Image, width, height int, mode string) image.Image {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw == 0 || sh == 0 {
+		return img
+	}
+	// Scale factors are kept as fractions, comparing sw/sh with width/height
+	// by cross-multiplying.
+	wider := sw*height > sh*width
+
+	switch mode {
+	case "fill":
+		crop := bounds
+		if wider {
+			cw := sh * width / height
+			crop.Min.X += (sw - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := sw * height / width
+			crop.Min.Y += (sh - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+		return scaleImage(img, crop, image.Rect(0, 0, width, height))
+	case "pad":
+		dw, dh := fitSize(sw, sh, width, height, wider)
+		canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+		offset := image.Pt((width-dw)/2, (height-dh)/2)
+		scaled := scaleImage(img, bounds, image.Rect(0, 0, dw, dh))
+		draw.Draw(canvas, scaled.Bounds().Add(offset), scaled, image.Point{}, draw.Src)
+		return canvas
+	default:
+		if sw <= width && sh <= height {
+			return img
+		}
+		dw, dh := fitSize(sw, sh, width, height, wider)
+		return scaleImage(img, bounds, image.Rect(0, 0, dw, dh))
+	}
+}
+
+// fitSize returns the largest size with the aspect ratio of sw x sh that
+// fits in width x height.
+func fitSize(sw, sh, width, height int, wider bool) (int, int) {
+	if wider {
+		return width, max(1, sh*width/sw)
+	}
+	return max(1, sw*height/sh), height
+}
+
+// scaleImage resamples the src rectangle of img to dst. Each destination
+// pixel averages the source pixels it covers, which for enlargements is the
+// nearest source pixel.
+func scaleImage(img image.Image, src, dst image.Rectangle) *image.RGBA {
+	out := image.NewRGBA(dst)
+	sw, sh := src.Dx(), src.Dy()
+	dw, dh := dst.Dx(), dst.Dy()
+	for dy := 0; dy < dh; dy++ {
+		y0 := src.Min.Y + dy*sh/dh
+		y1 := max(y0+1, src.Min.Y+(dy+1)*sh/dh)
+		for dx := 0; dx < dw; dx++ {
+			x0 := src.Min.X + dx*sw/dw
+			x1 := max(x0+1, src.Min.X+(dx+1)*sw/dw)
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			out.SetRGBA(dst.Min.X+dx, dst.Min.Y+dy, color.RGBA{
+				R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return out
+}
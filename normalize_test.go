@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// mixedUpstream serves a 40x20 PNG, an 8x8 JPEG and a 10x30 GIF.
+func mixedUpstream(t *testing.T) string {
+	t.Helper()
+	var gifImage bytes.Buffer
+	if err := gif.Encode(&gifImage, image.NewPaletted(image.Rect(0, 0, 10, 30), color.Palette{color.White, color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	images := map[string][]byte{
+		"/a.png": pngImage(t, 40, 20),
+		"/b.jpg": baselineJPEG(t),
+		"/c.gif": gifImage.Bytes(),
+	}
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(images[r.URL.Path])
+	})
+	return `["` + upstream.URL + `/a.png","` + upstream.URL + `/b.jpg","` + upstream.URL + `/c.gif"]`
+}
+
+func TestNormalizeMixedInputs(t *testing.T) {
+	urls := mixedUpstream(t)
+
+	tests := []struct {
+		normalize string
+		format    string
+		sizes     map[string]image.Point
+	}{
+		{`{"format":"png","width":16,"height":16,"mode":"fill"}`, "png",
+			map[string]image.Point{"a.png": {16, 16}, "b.png": {16, 16}, "c.png": {16, 16}}},
+		{`{"format":"png","width":16,"height":16,"mode":"pad"}`, "png",
+			map[string]image.Point{"a.png": {16, 16}, "b.png": {16, 16}, "c.png": {16, 16}}},
+		{`{"format":"jpeg","width":16,"height":16}`, "jpeg",
+			map[string]image.Point{"a.jpg": {16, 8}, "b.jpg": {8, 8}, "c.jpg": {5, 16}}},
+		{`{"format":"png"}`, "png",
+			map[string]image.Point{"a.png": {40, 20}, "b.png": {8, 8}, "c.png": {10, 30}}},
+	}
+	for _, tt := range tests {
+		entries := zipEntries(t, postDownload(t, `{"normalize":`+tt.normalize+`,"imageURLs":`+urls+`}`))
+		if len(entries) != len(tt.sizes) {
+			t.Errorf("normalize %s: archive has %v", tt.normalize, keys(entries))
+		}
+		for name, data := range entries {
+			config, format, err := image.DecodeConfig(bytes.NewReader(data))
+			size, ok := tt.sizes[name]
+			if err != nil || !ok || format != tt.format || config.Width != size.X || config.Height != size.Y {
+				t.Errorf("normalize %s: %s is %s %dx%d (%v), want %s %v", tt.normalize, name, format, config.Width, config.Height, err, tt.format, size)
+			}
+		}
+	}
+}
+
+func TestNormalizePadIsTransparent(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	padded := resizeImage(src, 10, 10, "pad")
+	if padded.Bounds().Dx() != 10 || padded.Bounds().Dy() != 10 {
+		t.Fatalf("padded to %v, want 10x10", padded.Bounds())
+	}
+	if _, _, _, a := padded.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("padding alpha = %d, want transparent", a)
+	}
+	if _, _, _, a := padded.At(5, 5).RGBA(); a != 0xffff {
+		t.Errorf("image alpha = %d, want opaque", a)
+	}
+}
+
+func TestNormalizeValidation(t *testing.T) {
+	for _, normalize := range []string{
+		`{"format":"webp"}`,
+		`{"format":"png","mode":"stretch","width":10,"height":10}`,
+		`{"format":"png","width":10}`,
+		`{"format":"png","width":10000,"height":10}`,
+	} {
+		rec := postDownload(t, `{"normalize":`+normalize+`,"imageURLs":["https://example.com/a.png"]}`)
+		if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Body.String(), "Invalid normalize") {
+			t.Errorf("normalize %s: status %d, body %q", normalize, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestNormalizeUndecodableFails(t *testing.T) {
+	upstream := serveBytes(t, "image/svg+xml", []byte(svgDocument))
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","normalize":{"format":"png"},"imageURLs":["`+upstream.URL+`/a.svg"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; !strings.Contains(entry.Error, "failed to normalize") {
+		t.Errorf("SVG error %q, want a normalize failure", entry.Error)
+	}
+}
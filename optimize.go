@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/png"
+	"os"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// errOptimizeJPEG is returned for JPEG entries of optimize requests, which
+// are kept as downloaded: the standard library can only re-encode JPEGs
+// lossily, so they cannot be optimized without changing their pixels.
+var errOptimizeJPEG = errors.New("lossless JPEG optimization is not supported")
+
+// pngColorChunks are the ancillary chunks that change how a PNG's pixels are
+// displayed, and survive optimization.
+var pngColorChunks = map[string]bool{"cHRM": true, "gAMA": true, "iCCP": true, "sRGB": true}
+
+// optimizeImage losslessly shrinks the image at path in place and returns its
+// resulting size. PNGs are re-encoded at the highest zlib compression level,
+// which drops ancillary chunks other than those describing their colour
+// space; the result is kept only if smaller. JPEGs are left untouched with
+// errOptimizeJPEG, and other formats silently.
+func optimizeImage(path string, size int64) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return size, err
+	}
+	if bytes.HasPrefix(data, []byte("\xff\xd8\xff")) {
+		return size, errOptimizeJPEG
+	}
+	if !bytes.HasPrefix(data, pngSignature) {
+		return size, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return size, err
+	}
+	var encoded bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&encoded, img); err != nil {
+		return size, err
+	}
+	optimized := withPNGChunks(encoded.Bytes(), pngChunks(data, pngColorChunks))
+	if len(optimized) >= len(data) {
+		return size, nil
+	}
+	if err := os.WriteFile(path, optimized, 0644); err != nil {
+		return size, err
+	}
+	return int64(len(optimized)), nil
+}
+
+// pngChunks returns the raw chunks of the PNG data, CRCs included, whose
+// types are in types, in the order they appear.
+func pngChunks(data []byte, types map[string]bool) []byte {
+	var chunks []byte
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		if types[string(data[i+4:i+8])] {
+			chunks = append(chunks, data[i:end]...)
+		}
+		i = end
+	}
+	return chunks
+}
+
+// withPNGChunks inserts chunks right after the IHDR chunk of the PNG data,
+// which is where chunks that must precede PLTE and IDAT belong.
+func withPNGChunks(data, chunks []byte) []byte {
+	if len(chunks) == 0 {
+		return data
+	}
+	ihdrEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	out := make([]byte, 0, len(data)+len(chunks))
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunks...)
+	return append(out, data[ihdrEnd:]...)
+}
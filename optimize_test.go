@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gradientPNG returns an uncompressed PNG with varied pixels, which
+// optimization can shrink.
+func gradientPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngChunk encodes a chunk of type kind holding data.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOptimizePNGIsSmallerAndPixelIdentical(t *testing.T) {
+	original := gradientPNG(t)
+	path := writeTemp(t, original)
+
+	size, err := optimizeImage(path, int64(len(original)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized, _ := os.ReadFile(path)
+	if size >= int64(len(original)) || size != int64(len(optimized)) {
+		t.Fatalf("size = %d (file %d), original %d", size, len(optimized), len(original))
+	}
+
+	before, _ := png.Decode(bytes.NewReader(original))
+	after, err := png.Decode(bytes.NewReader(optimized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := before.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if before.At(x, y) != after.At(x, y) {
+				t.Fatalf("pixel %d,%d changed from %v to %v", x, y, before.At(x, y), after.At(x, y))
+			}
+		}
+	}
+}
+
+func TestOptimizePNGKeepsColorChunks(t *testing.T) {
+	original := gradientPNG(t)
+	gama := pngChunk("gAMA", binary.BigEndian.AppendUint32(nil, 45455))
+	srgb := pngChunk("sRGB", []byte{0})
+	text := pngChunk("tEXt", []byte("Comment\x00dropped"))
+	ihdrEnd := len(pngSignature) + 25
+	withChunks := append(append([]byte{}, original[:ihdrEnd]...), append(append(append(gama, srgb...), text...), original[ihdrEnd:]...)...)
+	path := writeTemp(t, withChunks)
+
+	if _, err := optimizeImage(path, int64(len(withChunks))); err != nil {
+		t.Fatal(err)
+	}
+	optimized, _ := os.ReadFile(path)
+	if kept := pngChunks(optimized, map[string]bool{"gAMA": true, "sRGB": true, "tEXt": true}); !bytes.Equal(kept, append(gama, srgb...)) {
+		t.Errorf("kept chunks %q, want gAMA and sRGB only", kept)
+	}
+	if _, err := png.Decode(bytes.NewReader(optimized)); err != nil {
+		t.Errorf("optimized PNG does not decode: %v", err)
+	}
+}
+
+func TestOptimizeKeepsJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	path := writeTemp(t, buf.Bytes())
+
+	if _, err := optimizeImage(path, int64(buf.Len())); err != errOptimizeJPEG {
+		t.Errorf("err = %v, want %v", err, errOptimizeJPEG)
+	}
+	if kept, _ := os.ReadFile(path); !bytes.Equal(kept, buf.Bytes()) {
+		t.Error("JPEG was rewritten")
+	}
+}
+
+func TestOptimizeNotesJPEGEntries(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	photo := serveBytes(t, "image/jpeg", buf.Bytes())
+	icon := serveBytes(t, "image/png", gradientPNG(t))
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","optimize":true,"imageURLs":["`+photo.URL+`/a.jpg","`+icon.URL+`/b.png"]}`)
+	report := decodeReport(t, rec)
+	jpegEntry, pngEntry := report.Entries[0], report.Entries[1]
+	if jpegEntry.Error != "" || jpegEntry.NotOptimized != errOptimizeJPEG.Error() || jpegEntry.Bytes != int64(buf.Len()) {
+		t.Errorf("JPEG entry = %+v, want it kept with a note", jpegEntry)
+	}
+	if saved, err := os.ReadFile(filepath.Join(cfg.DestRoot, "out", jpegEntry.Filename)); err != nil || !bytes.Equal(saved, buf.Bytes()) {
+		t.Errorf("saved JPEG differs from the download: %v", err)
+	}
+	if pngEntry.Error != "" || pngEntry.NotOptimized != "" {
+		t.Errorf("PNG entry = %+v", pngEntry)
+	}
+
+	rec = postDownload(t, `{"output":"local","destDir":"normalized","optimize":true,"normalize":{"format":"jpeg"},"imageURLs":["`+icon.URL+`/b.png"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" || entry.NotOptimized == "" {
+		t.Errorf("jpeg normalize entry = %+v, want it normalized with a note", entry)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "net/http"
+
+// archiveCompleted starts a streamed archive on w and adds each download to
+// it as soon as it completes, overlapping archiving with the downloads still
+// running. Files are placed in dir as they arrive, so, as with streamed
+// reports, collision suffixes and entry order follow completion order. Only
+// this goroutine touches the archive; downloads hand over results through
+// completed. The returned builder still needs finishing.
+func archiveCompleted(w http.ResponseWriter, dir string, format archiveFormat, request *downloadRequest, results []*downloadResult, completed <-chan int) *archiveBuilder {
+	builder := newArchiveBuilder(w, format, request)
+	placer := newFilePlacer(dir, request)
+	for i := range completed {
+		result := results[i]
+		result.Filename = applyPathTemplate(request.PathTemplate, result.URL, result.Filename, result.lastModified)
+		unlock := lockDir(dir)
+		placer.place(result)
+		unlock()
+		runPlacedHook(result)
+		// The archive timeout has not started yet, so add cannot fail.
+		builder.add(result)
+	}
+	return builder
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// policyError reports a URL refused by the fetch policy. rule names the rule
+// that fired: "scheme", "host", "block-list", "allow-list", "private-ip",
+// "cross-host-redirect" or "https".
+type policyError struct {
+	rule   string
+	detail string
+}
+
+func (e *policyError) Error() string {
+	return e.detail
+}
+
+// checkURLPolicy reports whether the service is willing to fetch u, returning
+// a *policyError describing the rejection when it is not.
+func checkURLPolicy(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &policyError{"scheme", fmt.Sprintf("scheme %q is not allowed", u.Scheme)}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return &policyError{"host", "URL has no host"}
+	}
+
+	for _, pattern := range cfg.BlockHosts {
+		if hostMatches(host, pattern) {
+			return &policyError{"block-list", fmt.Sprintf("host %s is blocked", host)}
+		}
+	}
+
+	if len(cfg.AllowHosts) > 0 && !hostAllowed(host) {
+		return &policyError{"allow-list", fmt.Sprintf("host %s is not in the allow list", host)}
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return checkAddr(addr)
+	}
+	return nil
+}
+
+func hostAllowed(host string) bool {
+	for _, pattern := range cfg.AllowHosts {
+		if hostMatches(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr rejects loopback, private, link-local and unspecified addresses
+// when BLOCK_PRIVATE_IPS is set.
+func checkAddr(addr netip.Addr) error {
+	if !cfg.BlockPrivateIPs {
+		return nil
+	}
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return &policyError{"private-ip", fmt.Sprintf("address %s is private", addr)}
+	}
+	return nil
+}
+
+// dialControl applies checkAddr to every address actually dialed, so host
+// names resolving to private addresses are refused too.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	return checkAddr(addr)
+}
+
+// lookupNetIP resolves host names for validatedDial.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// validatedDial returns a dial function that, when BLOCK_PRIVATE_IPS is set,
+// resolves the host itself and checks every address it resolves to, not
+// just the one dialed. Under MIXED_ADDRESSES=reject a single private answer
+// refuses the host; under "skip" only the allowed answers are tried. The
+// checked addresses are dialed directly, so a second lookup cannot swap in
+// a different one.
+func validatedDial(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if !cfg.BlockPrivateIPs {
+			return dialer.DialContext(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := lookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+
+		var allowed []netip.Addr
+		var blocked error
+		for _, addr := range addrs {
+			if err := checkAddr(addr); err != nil {
+				blocked = &policyError{"private-ip", fmt.Sprintf("host %s resolves to private address %s", host, addr.Unmap())}
+				continue
+			}
+			allowed = append(allowed, addr)
+		}
+		if blocked != nil && (cfg.MixedAddresses != "skip" || len(allowed) == 0) {
+			return nil, blocked
+		}
+
+		var dialErr error
+		for _, addr := range allowed {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+		}
+		return nil, dialErr
+	}
+}
+
+// checkRedirect applies the fetch policy, ALLOW_HOSTS and BLOCK_HOSTS
+// included, to a redirect to u after the requests in via. Hops to another
+// host are refused when BLOCK_CROSS_HOST_REDIRECTS is set, or once there have
+// been more than MAX_REDIRECT_HOST_CHANGES of them.
+func checkRedirect(u *url.URL, via []*http.Request) error {
+	if err := checkURLPolicy(u); err != nil {
+		return err
+	}
+	origin := via[0].URL
+	if cfg.BlockCrossHostRedirects && !strings.EqualFold(u.Hostname(), origin.Hostname()) {
+		return &policyError{"cross-host-redirect", fmt.Sprintf("redirect from %s to %s leaves the original host", origin.Hostname(), u.Hostname())}
+	}
+	if cfg.MaxRedirectHostChanges > 0 {
+		changes := 0
+		previous := origin.Hostname()
+		for _, hop := range append(via[1:], &http.Request{URL: u}) {
+			if !strings.EqualFold(hop.URL.Hostname(), previous) {
+				changes++
+			}
+			previous = hop.URL.Hostname()
+		}
+		if changes > cfg.MaxRedirectHostChanges {
+			return &policyError{"cross-host-redirect", fmt.Sprintf("redirect to %s changes host more than %d times", u.Hostname(), cfg.MaxRedirectHostChanges)}
+		}
+	}
+	return nil
+}
+
+// checkHTTPS rejects plain http URLs for requests that require HTTPS.
+func checkHTTPS(u *url.URL) error {
+	if u.Scheme == "http" {
+		return &policyError{"https", "plain http is not allowed when requireHTTPS is set"}
+	}
+	return nil
+}
+
+// hostMatches reports whether host equals pattern or, for patterns of the
+// form "*.example.com", is a subdomain of it.
+func hostMatches(host, pattern string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// normalizeURL returns the canonical form of rawURL: lower-cased scheme and
+// host, default ports and fragments removed, and an empty path set to "/".
+func normalizeURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRequireHTTPS(t *testing.T) {
+	plain := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngImage(t, 2, 2))
+	}))
+	t.Cleanup(secure.Close)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","requireHTTPS":true,"imageURLs":["`+plain.URL+`/a.png","`+secure.URL+`/b.png"]}`)
+	report := decodeReport(t, rec)
+	httpEntry, httpsEntry := report.Entries[0], report.Entries[1]
+	if httpEntry.BlockedBy != "https" || !strings.Contains(httpEntry.Error, "plain http is not allowed") {
+		t.Errorf("http entry = %+v", httpEntry)
+	}
+	// The test server's certificate is not trusted, so the https entry
+	// fails, but on the TLS handshake rather than the policy.
+	if httpsEntry.BlockedBy != "" {
+		t.Errorf("https entry blocked by %s", httpsEntry.BlockedBy)
+	}
+
+	rec = postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+plain.URL+`/a.png"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" {
+		t.Errorf("http refused without requireHTTPS: %s", entry.Error)
+	}
+}
+
+func TestCheckHTTPS(t *testing.T) {
+	for rawURL, allowed := range map[string]bool{"http://example.com/a.png": false, "https://example.com/a.png": true, "data:image/png;base64,AA==": true} {
+		u, _ := url.Parse(rawURL)
+		if err := checkHTTPS(u); (err == nil) != allowed {
+			t.Errorf("checkHTTPS(%s) = %v", rawURL, err)
+		}
+	}
+}
+
+func TestBlockReasons(t *testing.T) {
+	image := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	port := strings.TrimPrefix(image.URL, "http://127.0.0.1:")
+	redirect := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+port+"/a.png", http.StatusFound)
+	})
+
+	tests := []struct {
+		rule   string
+		url    string
+		change func(c *config)
+	}{
+		{"scheme", "ftp://example.com/a.png", nil},
+		{"block-list", image.URL + "/a.png", func(c *config) { c.BlockHosts = []string{"127.0.0.1"} }},
+		{"allow-list", image.URL + "/a.png", func(c *config) { c.AllowHosts = []string{"*.example.com"} }},
+		{"private-ip", image.URL + "/a.png", func(c *config) { c.BlockPrivateIPs = true }},
+		{"private-ip", "http://localhost:" + port + "/a.png", func(c *config) { c.BlockPrivateIPs = true }},
+		{"cross-host-redirect", redirect.URL + "/a.png", func(c *config) { c.BlockCrossHostRedirects = true }},
+		{"", image.URL + "/a.png", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+" "+tt.url, func(t *testing.T) {
+			setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+			if tt.change != nil {
+				setConfig(t, tt.change)
+			}
+			rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+tt.url+`"]}`)
+			entry := decodeReport(t, rec).Entries[0]
+			if entry.BlockedBy != tt.rule || (tt.rule == "") != (entry.Error == "") {
+				t.Errorf("blockedBy %q (error %q), want %q", entry.BlockedBy, entry.Error, tt.rule)
+			}
+		})
+	}
+}
+
+func TestRedirectHopsCheckedAgainstHostPolicy(t *testing.T) {
+	image := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	port := strings.TrimPrefix(image.URL, "http://127.0.0.1:")
+	redirect := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		target := image.URL
+		if r.URL.Path == "/elsewhere.png" {
+			target = "http://localhost:" + port
+		}
+		http.Redirect(w, r, target+"/a.png", http.StatusFound)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir(); c.AllowHosts = []string{"127.0.0.1"} })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+redirect.URL+`/allowed.png","`+redirect.URL+`/elsewhere.png"]}`)
+	entries := decodeReport(t, rec).Entries
+	if entries[0].Error != "" {
+		t.Errorf("redirect to an allowed host failed: %s", entries[0].Error)
+	}
+	if entries[1].BlockedBy != "allow-list" || !strings.Contains(entries[1].Error, "refusing redirect to http://localhost:") {
+		t.Errorf("redirect to a host outside ALLOW_HOSTS: blockedBy %q, error %q", entries[1].BlockedBy, entries[1].Error)
+	}
+}
+
+func TestCheckRedirectCountsHostChanges(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxRedirectHostChanges = 2 })
+	chain := func(urls ...string) []*http.Request {
+		var via []*http.Request
+		for _, rawURL := range urls {
+			u, _ := url.Parse(rawURL)
+			via = append(via, &http.Request{URL: u})
+		}
+		return via
+	}
+	next, _ := url.Parse("https://a.example/end.png")
+
+	if err := checkRedirect(next, chain("https://a.example/1", "https://A.example/2", "https://b.example/3")); err != nil {
+		t.Errorf("two host changes refused: %v", err)
+	}
+	err := checkRedirect(next, chain("https://a.example/1", "https://b.example/2", "https://c.example/3"))
+	if policy, ok := err.(*policyError); !ok || policy.rule != "cross-host-redirect" {
+		t.Errorf("three host changes: error %v, want a cross-host-redirect refusal", err)
+	}
+}
+
+// fakeResolver answers validatedDial's lookups from answers for the rest
+// of the test.
+func fakeResolver(t *testing.T, answers map[string][]string) {
+	t.Helper()
+	previous := lookupNetIP
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		var addrs []netip.Addr
+		for _, answer := range answers[host] {
+			addrs = append(addrs, netip.MustParseAddr(answer))
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+	t.Cleanup(func() { lookupNetIP = previous })
+}
+
+func TestValidatedDialWithoutAddresses(t *testing.T) {
+	previous := lookupNetIP
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) { return nil, nil }
+	t.Cleanup(func() { lookupNetIP = previous })
+	setConfig(t, func(c *config) { c.BlockPrivateIPs = true })
+
+	conn, err := validatedDial(&net.Dialer{})(context.Background(), "tcp", "empty.test:80")
+	if conn != nil || err == nil || !strings.Contains(err.Error(), "no addresses for empty.test") {
+		t.Errorf("validatedDial = %v, %v; want a no-addresses error", conn, err)
+	}
+}
+
+func TestMixedAddressesRejected(t *testing.T) {
+	image := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	u, _ := url.Parse(image.URL)
+	fakeResolver(t, map[string][]string{"mixed.test": {"203.0.113.7", "127.0.0.1"}})
+	setConfig(t, func(c *config) { c.BlockPrivateIPs = true; c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["http://mixed.test:`+u.Port()+`/a.png"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.BlockedBy != "private-ip" {
+		t.Errorf("blockedBy %q (error %q), want private-ip", entry.BlockedBy, entry.Error)
+	}
+}
+
+func TestValidatedDial(t *testing.T) {
+	fakeResolver(t, map[string][]string{
+		"mixed.test":   {"10.0.0.5", "203.0.113.7", "::ffff:198.51.100.2"},
+		"private.test": {"10.0.0.5", "192.168.1.1"},
+	})
+	errStop := errors.New("stop before connecting")
+
+	tests := []struct {
+		mixed  string
+		host   string
+		rule   string
+		dialed []string
+	}{
+		{"reject", "mixed.test", "private-ip", nil},
+		{"skip", "mixed.test", "", []string{"203.0.113.7:80", "198.51.100.2:80"}},
+		{"skip", "private.test", "private-ip", nil},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.BlockPrivateIPs = true; c.MixedAddresses = tt.mixed })
+		var dialed []string
+		dialer := &net.Dialer{Control: func(network, address string, _ syscall.RawConn) error {
+			dialed = append(dialed, address)
+			return errStop
+		}}
+
+		_, err := validatedDial(dialer)(context.Background(), "tcp", tt.host+":80")
+		var policy *policyError
+		if errors.As(err, &policy) != (tt.rule != "") || (tt.rule != "" && policy.rule != tt.rule) {
+			t.Errorf("MIXED_ADDRESSES=%s, %s: err = %v, want rule %q", tt.mixed, tt.host, err, tt.rule)
+		}
+		if !slices.Equal(dialed, tt.dialed) {
+			t.Errorf("MIXED_ADDRESSES=%s, %s: dialed %v, want %v", tt.mixed, tt.host, dialed, tt.dialed)
+		}
+	}
+}
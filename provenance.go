@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+// xmpJPEGNamespace starts the APP1 segment holding a JPEG's XMP packet.
+const xmpJPEGNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// xmpPNGKeyword is the keyword of the iTXt chunk holding a PNG's XMP packet.
+const xmpPNGKeyword = "XML:com.adobe.xmp"
+
+// provenancePacket returns an XMP packet recording sourceURL as the image's
+// dc:source and fetched as its xmp:MetadataDate.
+func provenancePacket(sourceURL string, fetched time.Time) []byte {
+	var source bytes.Buffer
+	xml.EscapeText(&source, []byte(sourceURL))
+	return fmt.Appendf(nil, `<?xpacket begin="%s" id="W5M0MpCehiHzreSzNTczkc9d"?>`+
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/">`+
+		`<dc:source>%s</dc:source><xmp:MetadataDate>%s</xmp:MetadataDate>`+
+		`</rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`,
+		"\ufeff", source.String(), fetched.UTC().Format(time.RFC3339))
+}
+
+// embedProvenance writes an XMP packet naming sourceURL and the fetch time
+// into the JPEG, PNG or WebP at path, replacing any XMP packet it already
+// carried, and returns its resulting size. Only metadata is rewritten, never
+// pixels; other formats are left untouched.
+func embedProvenance(path string, size int64, sourceURL string, fetched time.Time) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return size, err
+	}
+	packet := provenancePacket(sourceURL, fetched)
+
+	var embedded []byte
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		embedded, err = embedJPEGXMP(data, packet)
+	case bytes.HasPrefix(data, pngSignature):
+		embedded, err = embedPNGXMP(data, packet)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		embedded, err = embedWebPXMP(data, packet)
+	default:
+		return size, nil
+	}
+	if err != nil {
+		return size, err
+	}
+	if err := os.WriteFile(path, embedded, 0644); err != nil {
+		return size, err
+	}
+	return int64(len(embedded)), nil
+}
+
+// embedJPEGXMP inserts packet as an APP1 segment after the JFIF and Exif
+// segments leading data, dropping any existing XMP segment.
+func embedJPEGXMP(data, packet []byte) ([]byte, error) {
+	length := 2 + len(xmpJPEGNamespace) + len(packet)
+	if length > 0xffff {
+		return nil, fmt.Errorf("XMP packet too large for a JPEG segment")
+	}
+	segment := []byte{0xff, 0xe1, byte(length >> 8), byte(length)}
+	segment = append(append(segment, xmpJPEGNamespace...), packet...)
+
+	out := append([]byte(nil), data[:2]...)
+	i, inserted := 2, false
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		end := i + 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated JPEG segment")
+		}
+		if marker == 0xda {
+			break
+		}
+		body := data[i+4 : end]
+		isXMP := marker == 0xe1 && bytes.HasPrefix(body, []byte(xmpJPEGNamespace))
+		if !inserted && marker != 0xe0 && (marker != 0xe1 || isXMP) {
+			out = append(out, segment...)
+			inserted = true
+		}
+		if !isXMP {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	if !inserted {
+		out = append(out, segment...)
+	}
+	return append(out, data[i:]...), nil
+}
+
+// embedPNGXMP inserts packet as an iTXt chunk after IHDR, dropping any
+// existing XMP chunk.
+func embedPNGXMP(data, packet []byte) ([]byte, error) {
+	// Keyword, then no compression, no language tag and no translated
+	// keyword.
+	text := append([]byte(xmpPNGKeyword+"\x00\x00\x00\x00\x00"), packet...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(append(chunk, "iTXt"...), text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := append([]byte(nil), pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+12 > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+		kind, body := string(data[i+4:i+8]), data[i+8:end-4]
+		if kind != "iTXt" || !bytes.HasPrefix(body, []byte(xmpPNGKeyword+"\x00")) {
+			out = append(out, data[i:end]...)
+		}
+		if kind == "IHDR" {
+			out = append(out, chunk...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// embedWebPXMP appends packet as an XMP chunk, dropping any existing one.
+// Simple lossy and lossless files are first converted to the extended
+// format, whose VP8X header flags the metadata.
+func embedWebPXMP(data, packet []byte) ([]byte, error) {
+	var chunks [][]byte
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, fmt.Errorf("truncated WebP chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size&1
+		if end > len(data) || end < i {
+			return nil, fmt.Errorf("truncated WebP chunk")
+		}
+		if string(data[i:i+4]) != "XMP " {
+			chunks = append(chunks, data[i:end])
+		}
+		i = end
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("empty WebP file")
+	}
+
+	var header []byte
+	switch first := chunks[0]; string(first[:4]) {
+	case "VP8X":
+		if len(first) < 18 {
+			return nil, fmt.Errorf("truncated VP8X chunk")
+		}
+		header = append([]byte(nil), first...)
+		chunks = chunks[1:]
+	case "VP8 ", "VP8L":
+		width, height, alpha, err := webPCanvas(first)
+		if err != nil {
+			return nil, err
+		}
+		header = append([]byte("VP8X"), 10, 0, 0, 0)
+		var flags byte
+		if alpha {
+			flags |= 0x10
+		}
+		header = append(header, flags, 0, 0, 0)
+		header = append(header, byte(width-1), byte((width-1)>>8), byte((width-1)>>16))
+		header = append(header, byte(height-1), byte((height-1)>>8), byte((height-1)>>16))
+	default:
+		return nil, fmt.Errorf("unsupported WebP chunk %q", first[:4])
+	}
+	header[8] |= 0x04
+
+	xmp := append([]byte("XMP "), binary.LittleEndian.AppendUint32(nil, uint32(len(packet)))...)
+	xmp = append(xmp, packet...)
+	if len(packet)%2 == 1 {
+		xmp = append(xmp, 0)
+	}
+
+	out := append([]byte("RIFF\x00\x00\x00\x00WEBP"), header...)
+	for _, chunk := range chunks {
+		out = append(out, chunk...)
+	}
+	out = append(out, xmp...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// webPCanvas reads the canvas size of a simple WebP from its VP8 or VP8L
+// chunk, and whether a lossless image uses alpha.
+func webPCanvas(chunk []byte) (width, height int, alpha bool, err error) {
+	body := chunk[8:]
+	if string(chunk[:4]) == "VP8L" {
+		if len(body) < 5 || body[0] != 0x2f {
+			return 0, 0, false, fmt.Errorf("invalid VP8L header")
+		}
+		bits := binary.LittleEndian.Uint32(body[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, bits>>28&1 == 1, nil
+	}
+	if len(body) < 10 || !bytes.Equal(body[3:6], []byte{0x9d, 0x01, 0x2a}) {
+		return 0, 0, false, fmt.Errorf("invalid VP8 header")
+	}
+	width = int(binary.LittleEndian.Uint16(body[6:]) & 0x3fff)
+	height = int(binary.LittleEndian.Uint16(body[8:]) & 0x3fff)
+	return width, height, false, nil
+}
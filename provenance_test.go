@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fetchedAt = time.Date(2024, time.May, 1, 12, 30, 0, 0, time.UTC)
+
+// jpegXMPPackets returns the XMP packets in the APP1 segments of a JPEG.
+func jpegXMPPackets(t *testing.T, data []byte) []string {
+	t.Helper()
+	var packets []string
+	for i := 2; i+4 <= len(data) && data[i] == 0xff && data[i+1] != 0xda; {
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			t.Fatalf("truncated JPEG segment at %d", i)
+		}
+		if body, ok := bytes.CutPrefix(data[i+4:end], []byte(xmpJPEGNamespace)); ok && data[i+1] == 0xe1 {
+			packets = append(packets, string(body))
+		}
+		i = end
+	}
+	return packets
+}
+
+func TestEmbedProvenanceJPEG(t *testing.T) {
+	image := baselineJPEG(t)
+	upstream := serveBytes(t, "image/jpeg", image)
+	imageURL := upstream.URL + "/photo.jpg?a=1&b=2"
+
+	entries := zipEntries(t, postDownload(t, `{"embedProvenance":true,"imageURLs":["`+imageURL+`"]}`))
+	saved := entries["photo.jpg"]
+	packets := jpegXMPPackets(t, saved)
+	if len(packets) != 1 || !strings.Contains(packets[0], "<dc:source>"+strings.ReplaceAll(imageURL, "&", "&amp;")+"</dc:source>") ||
+		!strings.Contains(packets[0], "<xmp:MetadataDate>") {
+		t.Fatalf("XMP packets %q, want one naming %s", packets, imageURL)
+	}
+
+	before, err := jpeg.Decode(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := jpeg.Decode(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatalf("decoding the embedded JPEG: %v", err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Error("embedding changed the pixels")
+	}
+}
+
+func TestEmbedProvenanceReplacesPacket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(path, baselineJPEG(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	embedProvenance(path, 0, "https://old.example/a.jpg", fetchedAt)
+	embedProvenance(path, 0, "https://new.example/a.jpg", fetchedAt)
+
+	data, _ := os.ReadFile(path)
+	packets := jpegXMPPackets(t, data)
+	if len(packets) != 1 || !strings.Contains(packets[0], "https://new.example/a.jpg") {
+		t.Errorf("XMP packets %q, want only the new one", packets)
+	}
+}
+
+func TestEmbedProvenancePNG(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := embedProvenance(path, int64(len(image)), "https://example.com/a.png", fetchedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if size != int64(len(data)) {
+		t.Errorf("size %d, file has %d bytes", size, len(data))
+	}
+	chunk := pngChunks(data, map[string]bool{"iTXt": true})
+	if !bytes.Contains(chunk, []byte(xmpPNGKeyword+"\x00")) || !bytes.Contains(chunk, []byte("<dc:source>https://example.com/a.png</dc:source>")) ||
+		!bytes.Contains(chunk, []byte("<xmp:MetadataDate>2024-05-01T12:30:00Z</xmp:MetadataDate>")) {
+		t.Errorf("iTXt chunks %q lack the provenance packet", chunk)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decoding the embedded PNG: %v", err)
+	}
+}
+
+func TestEmbedProvenanceWebP(t *testing.T) {
+	// A simple lossless WebP header for a 3x5 image with alpha.
+	bits := binary.LittleEndian.AppendUint32([]byte{0x2f}, 2|4<<14|1<<28)
+	vp8l := append([]byte("VP8L\x05\x00\x00\x00"), append(bits, 0)...)
+	webp := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(vp8l)))...)
+	webp = append(append(webp, "WEBP"...), vp8l...)
+
+	path := filepath.Join(t.TempDir(), "a.webp")
+	if err := os.WriteFile(path, webp, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := embedProvenance(path, 0, "https://example.com/a.webp", fetchedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data[12:16]) != "VP8X" || data[20] != 0x14 {
+		t.Fatalf("header chunk %q flags %#x, want VP8X with alpha and XMP flags", data[12:16], data[20])
+	}
+	if width, height := int(data[24])|int(data[25])<<8+1, int(data[27])|int(data[28])<<8+1; width != 3 || height != 5 {
+		t.Errorf("canvas %dx%d, want 3x5", width, height)
+	}
+	if !bytes.Contains(data, vp8l) || !bytes.Contains(data, []byte("XMP ")) || !bytes.Contains(data, []byte("https://example.com/a.webp")) {
+		t.Error("embedded WebP lacks its image or XMP chunk")
+	}
+	if riffSize := binary.LittleEndian.Uint32(data[4:]); int(riffSize) != len(data)-8 {
+		t.Errorf("RIFF size %d, file has %d bytes", riffSize, len(data))
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("destDir quota exceeded")
+
+// probeConcurrency bounds the probes of a request's pre-flight checks.
+const probeConcurrency = 8
+
+// dirUsage returns the total size of the regular files under dir.
+func dirUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// advertisedLengths asks each entry's URL for its Content-Length with a HEAD
+// request. Lengths that are unknown, including those of entries uploaded
+// elsewhere instead of saved, are -1.
+func advertisedLengths(request *downloadRequest) []int64 {
+	lengths := make([]int64, len(request.ImageURLs))
+	limiter := make(fixedLimiter, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, entry := range request.ImageURLs {
+		lengths[i] = -1
+		if entry.UploadURL != "" {
+			continue
+		}
+		limiter.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limiter.release(0, false)
+			if length, err := probeURL(request, entry.URL, false); err == nil {
+				lengths[i] = length
+			}
+		}()
+	}
+	wg.Wait()
+	return lengths
+}
+
+// probeURL checks that imageURL can be fetched, subject to the fetch policy
+// and the request's headers, without downloading it, and returns its
+// advertised length or -1. It sends a HEAD request and, when ranged is set
+// and the server refuses HEAD, a GET for the first byte.
+func probeURL(request *downloadRequest, imageURL string, ranged bool) (int64, error) {
+	parsedURL, err := url.Parse(imageURL)
+	if err == nil {
+		err = checkURLPolicy(parsedURL)
+	}
+	if err == nil && request.RequireHTTPS {
+		err = checkHTTPS(parsedURL)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("refusing to fetch %s: %w", imageURL, err)
+	}
+	client := &http.Client{
+		Transport: request.connections.transportFor(parsedURL.Hostname()),
+		Timeout:   cfg.ConnectTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme == "data" && cfg.DataRedirects == "follow" {
+				return &dataRedirect{uri: req.URL, proto: req.Response.Proto}
+			}
+			if err := checkRedirect(req.URL, via); err != nil {
+				return fmt.Errorf("refusing redirect to %s: %w", abbreviateURL(req.URL), err)
+			}
+			if request.RequireHTTPS {
+				if err := checkHTTPS(req.URL); err != nil {
+					return fmt.Errorf("refusing redirect to %s: %w", req.URL, err)
+				}
+			}
+			return nil
+		},
+	}
+
+	probe := func(method string) (*http.Response, error) {
+		req, err := http.NewRequest(method, imageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = downloadHeaders(parsedURL, request)
+		if method == http.MethodGet {
+			req.Header.Set("Range", "bytes=0-0")
+		}
+		resp, err := client.Do(req)
+		var inline *dataRedirect
+		if errors.As(err, &inline) {
+			resp, err = inline.response()
+		}
+		if err != nil {
+			return nil, abbreviateURLError(err)
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	resp, err := probe(http.MethodHead)
+	if err == nil && ranged && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = probe(http.MethodGet)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to reach %s: %w", imageURL, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusPartialContent:
+		return -1, nil
+	}
+	return -1, &statusError{url: imageURL, code: resp.StatusCode}
+}
+
+// checkDestQuota compares request's batch with the DEST_QUOTA_BYTES left in
+// dir. Entries whose advertised lengths do not fit are rejected, or cut off
+// when the request's overflow mode is "truncate", in which case the number
+// dropped is returned. The space left is then enforced at runtime through
+// the request's byte budget, covering lengths that were not advertised.
+func checkDestQuota(dir string, request *downloadRequest) (int, error) {
+	used, err := dirUsage(dir)
+	if err != nil {
+		return 0, err
+	}
+	free := cfg.DestQuotaBytes - used
+	if free <= 0 {
+		return 0, fmt.Errorf("%w: it holds %d bytes, its quota is %d bytes", errQuotaExceeded, used, cfg.DestQuotaBytes)
+	}
+
+	var needed int64
+	for i, length := range advertisedLengths(request) {
+		needed += max(length, 0)
+		if needed <= free {
+			continue
+		}
+		if request.Overflow != "truncate" || i == 0 {
+			return 0, fmt.Errorf("%w: the batch needs at least %d bytes, %d of its %d byte quota are free", errQuotaExceeded, needed, free, cfg.DestQuotaBytes)
+		}
+		dropped := len(request.ImageURLs) - i
+		request.ImageURLs = request.ImageURLs[:i]
+		request.quotaFree = free
+		return dropped, nil
+	}
+	request.quotaFree = free
+	return 0, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// quotaUpstream serves image, counting the GET requests it answers. With
+// advertise unset it sends no Content-Length.
+func quotaUpstream(t *testing.T, image []byte, advertise bool) (url string, gets *atomic.Int32) {
+	t.Helper()
+	gets = new(atomic.Int32)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		if !advertise {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(image)
+	})
+	return upstream.URL, gets
+}
+
+func quotaBatch(upstream string, n int, options string) string {
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, `"`+upstream+"/"+strconv.Itoa(i)+`.png"`)
+	}
+	return `{"output":"local","destDir":"out",` + options + `"imageURLs":[` + strings.Join(urls, ",") + `]}`
+}
+
+func TestDestQuotaPreflightRejects(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream, gets := quotaUpstream(t, image, true)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir(); c.DestQuotaBytes = int64(2 * len(image)) })
+
+	rec := postDownload(t, quotaBatch(upstream, 3, ""))
+	if rec.Code != http.StatusInsufficientStorage || !strings.Contains(rec.Body.String(), "quota exceeded") {
+		t.Errorf("status %d, body %q; want a 507 quota rejection", rec.Code, rec.Body.String())
+	}
+	if n := gets.Load(); n != 0 {
+		t.Errorf("%d images downloaded before the rejection, want none", n)
+	}
+}
+
+func TestDestQuotaTruncates(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream, _ := quotaUpstream(t, image, true)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir(); c.DestQuotaBytes = int64(2 * len(image)) })
+
+	rec := postDownload(t, quotaBatch(upstream, 3, `"overflow":"truncate",`))
+	report := decodeReport(t, rec)
+	if report.Truncated != 1 || report.Succeeded != 2 || len(report.Entries) != 2 {
+		t.Errorf("truncated %d, %d of %d entries succeeded; want 1 truncated and 2 saved", report.Truncated, report.Succeeded, len(report.Entries))
+	}
+}
+
+func TestDestQuotaCountsExistingFiles(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream, _ := quotaUpstream(t, image, true)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir(); c.DestQuotaBytes = int64(2 * len(image)) })
+	if err := os.MkdirAll(filepath.Join(cfg.DestRoot, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.DestRoot, "out", "old.png"), image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := postDownload(t, quotaBatch(upstream, 2, "")); rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("status %d, want %d with half the quota already used", rec.Code, http.StatusInsufficientStorage)
+	}
+	if rec := postDownload(t, quotaBatch(upstream, 1, "")); rec.Code != http.StatusOK {
+		t.Errorf("status %d, want %d for a batch fitting the space left", rec.Code, http.StatusOK)
+	}
+}
+
+func TestDestQuotaEnforcedWithoutLengths(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream, _ := quotaUpstream(t, image, false)
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.DestQuotaBytes = int64(2 * len(image))
+		c.Concurrency = 1
+	})
+
+	rec := postDownload(t, quotaBatch(upstream, 4, ""))
+	if report := decodeReport(t, rec); rec.Code != http.StatusRequestEntityTooLarge || !report.BudgetExceeded {
+		t.Errorf("status %d, budgetExceeded %v; want the quota enforced while downloading", rec.Code, report.BudgetExceeded)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// fdUsage reports open and maximum file descriptors; it is a variable so the
+// source can be replaced.
+var fdUsage = currentFDUsage
+
+// checkReady returns an error explaining why the service should not accept
+// new downloads, or nil when it can.
+func checkReady() error {
+	if cfg.MinFreeFDs > 0 {
+		if used, limit, err := fdUsage(); err == nil {
+			if free := limit - used; free < cfg.MinFreeFDs {
+				return fmt.Errorf("only %d free file descriptors, need %d", free, cfg.MinFreeFDs)
+			}
+		}
+	}
+	return checkLoad()
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := checkReady(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "not ready", "reason": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setFDUsage replaces the file descriptor source for the rest of the test.
+func setFDUsage(t *testing.T, used, limit int, err error) {
+	t.Helper()
+	saved := fdUsage
+	fdUsage = func() (int, int, error) { return used, limit, err }
+	t.Cleanup(func() { fdUsage = saved })
+}
+
+func readyStatus(t *testing.T) (int, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	readyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, body
+}
+
+func TestReadinessFlipsBelowFreeFDs(t *testing.T) {
+	setConfig(t, func(c *config) { c.MinFreeFDs = 100 })
+
+	setFDUsage(t, 900, 1024, nil)
+	if code, body := readyStatus(t); code != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("124 free: %d %v", code, body)
+	}
+
+	setFDUsage(t, 950, 1024, nil)
+	code, body := readyStatus(t)
+	if code != http.StatusServiceUnavailable || body["reason"] != "only 74 free file descriptors, need 100" {
+		t.Errorf("74 free: %d %v", code, body)
+	}
+	if rec := postDownload(t, `{"imageURLs":["https://example.com/a.png"]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("download while not ready: status = %d", rec.Code)
+	}
+}
+
+func TestReadinessIgnoresUnavailableFDUsage(t *testing.T) {
+	setConfig(t, func(c *config) { c.MinFreeFDs = 100 })
+	setFDUsage(t, 0, 0, errors.New("no /proc"))
+
+	if code, _ := readyStatus(t); code != http.StatusOK {
+		t.Errorf("status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestCurrentFDUsage(t *testing.T) {
+	used, limit, err := currentFDUsage()
+	if err != nil {
+		if strings.Contains(err.Error(), "not available") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if used <= 0 || limit < used {
+		t.Errorf("used %d of %d", used, limit)
+	}
+}
+
+func healthStatus(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body["status"]
+}
+
+// waitUntil polls condition until it holds, failing the test after a second.
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestHealthDegradesUnderLoad(t *testing.T) {
+	image := pngImage(t, 2, 2)
+	release := make(chan struct{})
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.HealthMode = "load"
+		c.HealthMaxQueued = 0
+	})
+	setGlobalLimit(t, 1)
+
+	if status := healthStatus(t); status != "OK" {
+		t.Errorf("idle: health %q", status)
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+	download := func(destDir string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postDownload(t, `{"output":"local","destDir":"`+destDir+`","imageURLs":["`+upstream.URL+`/a.png"]}`)
+		}()
+	}
+
+	download("first")
+	waitUntil(t, "the global slot is taken", globalSaturated)
+	if status := healthStatus(t); status != "degraded" {
+		t.Errorf("saturated: health %q, want degraded", status)
+	}
+	if code, body := readyStatus(t); code != http.StatusOK {
+		t.Errorf("saturated with nothing queued: %d %v", code, body)
+	}
+
+	download("second")
+	waitUntil(t, "a request waits for the slot", func() bool { return globalWaiting.Load() == 1 })
+	code, body := readyStatus(t)
+	if code != http.StatusServiceUnavailable || !strings.Contains(body["reason"], "HEALTH_MAX_QUEUED is 0") {
+		t.Errorf("one queued: %d %v", code, body)
+	}
+	if rec := postDownload(t, `{"imageURLs":["`+upstream.URL+`/b.png"]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("download while queue is full: status = %d", rec.Code)
+	}
+
+	setConfig(t, func(c *config) { c.HealthMode = "basic" })
+	if status := healthStatus(t); status != "OK" {
+		t.Errorf("HEALTH_MODE=basic while saturated: health %q", status)
+	}
+	if code, body := readyStatus(t); code != http.StatusOK {
+		t.Errorf("HEALTH_MODE=basic while queued: %d %v", code, body)
+	}
+}
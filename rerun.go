@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rerunBatches keeps the failed entries of recent batches for
+// RETRY_TOKEN_TTL, so a caller can re-run just those by sending the
+// report's retryToken.
+var rerunBatches = &rerunStore{batches: make(map[string]rerunBatch)}
+
+type rerunStore struct {
+	mu      sync.Mutex
+	batches map[string]rerunBatch
+}
+
+// rerunBatch is a request narrowed to its failed entries, together with the
+// API key it was made with.
+type rerunBatch struct {
+	request downloadRequest
+	key     string
+	expires time.Time
+}
+
+// save records the entries of request whose results failed and returns the
+// token that re-runs them, or "" when none failed or tokens are disabled.
+// results must be aligned with request.ImageURLs.
+func (s *rerunStore) save(request *downloadRequest, results []*downloadResult, key string) string {
+	if cfg.RetryTokenTTL <= 0 {
+		return ""
+	}
+	var failed []imageEntry
+	for i, result := range results {
+		if result.Error != "" {
+			failed = append(failed, request.ImageURLs[i])
+		}
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+
+	batch := rerunBatch{request: *request, key: key, expires: time.Now().Add(cfg.RetryTokenTTL)}
+	batch.request.ImageURLs = failed
+	batch.request.RetryToken = ""
+	batch.request.budget = nil
+	batch.request.memory = nil
+	token := rand.Text()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for old, stored := range s.batches {
+		if now.After(stored.expires) {
+			delete(s.batches, old)
+		}
+	}
+	s.batches[token] = batch
+	return token
+}
+
+// lookup returns a copy of the request saved under token, provided it has
+// not expired and key matches the API key the batch was made with. Tokens
+// stay valid until they expire, so re-sending one re-runs the same entries.
+func (s *rerunStore) lookup(token, key string) (*downloadRequest, bool) {
+	s.mu.Lock()
+	batch, ok := s.batches[token]
+	s.mu.Unlock()
+	if !ok || time.Now().After(batch.expires) || subtle.ConstantTimeCompare([]byte(key), []byte(batch.key)) != 1 {
+		return nil, false
+	}
+	request := batch.request
+	request.ImageURLs = slices.Clone(batch.request.ImageURLs)
+	return &request, true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flakyUpstream serves images, failing the first request for /bad.png,
+// and records the paths requested.
+func flakyUpstream(t *testing.T) (url string, requested func() []string) {
+	t.Helper()
+	image := pngImage(t, 3, 3)
+	var mu sync.Mutex
+	var paths []string
+	failed := false
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		fail := r.URL.Path == "/bad.png" && !failed
+		failed = failed || fail
+		mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	return upstream.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		requested := slices.Clone(paths)
+		paths = nil
+		return requested
+	}
+}
+
+func TestRetryTokenRefetchesOnlyFailures(t *testing.T) {
+	upstream, requested := flakyUpstream(t)
+
+	rec := postWithKey(t, "alice", `{"imageURLs":["`+upstream+`/good.png","`+upstream+`/bad.png"]}`)
+	token := rec.Header().Get("X-Retry-Token")
+	if token == "" {
+		t.Fatal("no X-Retry-Token for a batch with a failure")
+	}
+	requested()
+
+	rec = postWithKey(t, "alice", `{"retryToken":"`+token+`"}`)
+	if entries := zipEntries(t, rec); len(entries) != 1 || entries["bad.png"] == nil {
+		t.Errorf("re-run archive has %v, want only bad.png", keys(entries))
+	}
+	if got := requested(); !slices.Equal(got, []string{"/bad.png"}) {
+		t.Errorf("re-run fetched %v, want only /bad.png", got)
+	}
+	if got := rec.Header().Get("X-Retry-Token"); got != "" {
+		t.Errorf("fully successful re-run returned retry token %q", got)
+	}
+}
+
+func TestRetryTokenLeftOutOfManifest(t *testing.T) {
+	upstream, _ := flakyUpstream(t)
+
+	rec := postWithKey(t, "alice", `{"manifest":true,"imageURLs":["`+upstream+`/good.png","`+upstream+`/bad.png"]}`)
+	token := rec.Header().Get("X-Retry-Token")
+	if manifest := zipEntries(t, rec)["manifest.json"]; token == "" || strings.Contains(string(manifest), token) {
+		t.Errorf("X-Retry-Token %q, manifest.json %s; want the token in the header only", token, manifest)
+	}
+}
+
+func TestRetryTokenRejected(t *testing.T) {
+	upstream, _ := flakyUpstream(t)
+	token := postWithKey(t, "alice", `{"imageURLs":["`+upstream+`/bad.png"]}`).Header().Get("X-Retry-Token")
+
+	tests := []struct {
+		name, key, token string
+	}{
+		{"unknown token", "alice", "unknown"},
+		{"other API key", "bob", token},
+	}
+	for _, tt := range tests {
+		if rec := postWithKey(t, tt.key, `{"retryToken":"`+tt.token+`"}`); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRetryTokensDisabled(t *testing.T) {
+	setConfig(t, func(c *config) { c.RetryTokenTTL = 0 })
+	upstream, _ := flakyUpstream(t)
+
+	if token := postWithKey(t, "", `{"imageURLs":["`+upstream+`/bad.png"]}`).Header().Get("X-Retry-Token"); token != "" {
+		t.Errorf("X-Retry-Token = %q with RETRY_TOKEN_TTL=0", token)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// statusError reports an upstream response with an unexpected status code.
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status code for %s: %d", e.url, e.code)
+}
+
+// isRetryable reports whether a failed fetch may succeed if attempted again:
+// network errors, truncated bodies, 5xx responses and responses with one of
+// extra status codes are, policy and content rejections are not.
+func isRetryable(err error, extra []int) bool {
+	var policy *policyError
+	if errors.As(err, &policy) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || slices.Contains(extra, status.code)
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, errTruncated)
+}
+
+// checkRetryStatusCodes accepts only 4xx codes as extra retryable
+// statuses: 5xx are retried already, and other codes never fail a fetch
+// as a status.
+func checkRetryStatusCodes(codes []int) error {
+	for _, code := range codes {
+		if code < 400 || code > 499 {
+			return fmt.Errorf("%d is not a 4xx status code", code)
+		}
+	}
+	return nil
+}
+
+// retryDelay returns how long to wait before retry number attempt (from 0).
+func retryDelay(attempt int) time.Duration {
+	delay := cfg.RetryMaxDelay
+	if attempt < 32 {
+		if d := cfg.RetryBaseDelay << attempt; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	if cfg.RetryJitter && delay > 0 {
+		delay = rand.N(delay + 1)
+	}
+	return delay
+}
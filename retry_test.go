@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelayJitter(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.RetryBaseDelay = 100 * time.Millisecond
+		c.RetryMaxDelay = time.Second
+		c.RetryJitter = true
+	})
+
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		distinct := make(map[time.Duration]bool)
+		for i := 0; i < 200; i++ {
+			delay := retryDelay(attempt)
+			if delay < 0 || delay > ceiling {
+				t.Fatalf("attempt %d: delay %v outside [0, %v]", attempt, delay, ceiling)
+			}
+			distinct[delay] = true
+		}
+		if len(distinct) < 100 {
+			t.Errorf("attempt %d: only %d distinct delays in 200 draws", attempt, len(distinct))
+		}
+	}
+}
+
+func TestRetryDelayWithoutJitter(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.RetryBaseDelay = 100 * time.Millisecond
+		c.RetryMaxDelay = time.Second
+		c.RetryJitter = false
+	})
+
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second} {
+		if got := retryDelay(attempt); got != want {
+			t.Errorf("attempt %d: delay %v, want %v", attempt, got, want)
+		}
+	}
+	if got := retryDelay(70); got != time.Second {
+		t.Errorf("attempt 70: delay %v, want the cap", got)
+	}
+}
+
+// failingUpstream serves a PNG, after failing the first failures[path]
+// requests for each path with a 503.
+func failingUpstream(t *testing.T, failures map[string]int) *httptest.Server {
+	t.Helper()
+	image := pngImage(t, 2, 2)
+	var mu sync.Mutex
+	return httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failures[r.URL.Path] > 0
+		failures[r.URL.Path]--
+		mu.Unlock()
+		if fail {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+}
+
+func TestAttemptsRecorded(t *testing.T) {
+	upstream := failingUpstream(t, map[string]int{"/flaky.png": 2, "/down.png": 10, "/primary.png": 10})
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.RetryAttempts = 2
+		c.RetryBaseDelay = time.Millisecond
+		c.RetryMaxDelay = time.Millisecond
+	})
+
+	body := `{"output":"local","destDir":"out","imageURLs":[
+		"` + upstream.URL + `/ok.png",
+		"` + upstream.URL + `/flaky.png",
+		"` + upstream.URL + `/down.png",
+		{"url":"` + upstream.URL + `/primary.png","mirrors":["` + upstream.URL + `/mirror.png"]}]}`
+	report := decodeReport(t, postDownload(t, body))
+
+	tests := []struct {
+		urls   []string
+		failed []bool
+	}{
+		{nil, nil},
+		{[]string{"/flaky.png", "/flaky.png", "/flaky.png"}, []bool{true, true, false}},
+		{[]string{"/down.png", "/down.png", "/down.png"}, []bool{true, true, true}},
+		{[]string{"/primary.png", "/primary.png", "/primary.png", "/mirror.png"}, []bool{true, true, true, false}},
+	}
+	for i, tt := range tests {
+		entry := report.Entries[i]
+		if len(entry.Attempts) != len(tt.urls) {
+			t.Errorf("%s: %d attempts recorded, want %d", entry.URL, len(entry.Attempts), len(tt.urls))
+			continue
+		}
+		for j, attempt := range entry.Attempts {
+			if !strings.HasSuffix(attempt.URL, tt.urls[j]) || (attempt.Error != "") != tt.failed[j] {
+				t.Errorf("%s: attempt %d is %s with error %q, want %s failed %t",
+					entry.URL, j, attempt.URL, attempt.Error, tt.urls[j], tt.failed[j])
+			}
+		}
+	}
+}
+
+func TestRetryStatusCodes(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		code, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".png"))
+		http.Error(w, "try later", code)
+	})
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.RetryAttempts = 2
+		c.RetryBaseDelay = time.Millisecond
+		c.RetryMaxDelay = time.Millisecond
+	})
+
+	body := `{"output":"local","destDir":"out","retryStatusCodes":[408,429],"imageURLs":["` +
+		upstream.URL + `/429.png","` + upstream.URL + `/404.png","` + upstream.URL + `/420.png","` + upstream.URL + `/503.png"]}`
+	postDownload(t, body)
+	want := map[string]int{"/429.png": 3, "/404.png": 1, "/420.png": 1, "/503.png": 3}
+	mu.Lock()
+	defer mu.Unlock()
+	for path, n := range want {
+		if requests[path] != n {
+			t.Errorf("%s fetched %d times, want %d", path, requests[path], n)
+		}
+	}
+
+	for _, codes := range []string{"[200]", "[503]", "[99]"} {
+		if rec := postDownload(t, `{"retryStatusCodes":`+codes+`,"imageURLs":["`+upstream.URL+`/429.png"]}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("retryStatusCodes %s: status %d, want %d", codes, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
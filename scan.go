@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultScanDeny lists the content kinds rejected when CONTENT_SCAN is on
+// and CONTENT_SCAN_DENY is not set.
+var defaultScanDeny = []string{"pe", "elf", "macho", "zip", "rar", "7z", "gzip", "pdf", "html", "script"}
+
+var contentSignatures = []struct {
+	kind     string
+	prefixes []string
+}{
+	{"pe", []string{"MZ"}},
+	{"elf", []string{"\x7fELF"}},
+	{"macho", []string{"\xfe\xed\xfa\xce", "\xfe\xed\xfa\xcf", "\xce\xfa\xed\xfe", "\xcf\xfa\xed\xfe", "\xca\xfe\xba\xbe"}},
+	{"zip", []string{"PK\x03\x04", "PK\x05\x06", "PK\x07\x08"}},
+	{"rar", []string{"Rar!\x1a\x07"}},
+	{"7z", []string{"7z\xbc\xaf\x27\x1c"}},
+	{"gzip", []string{"\x1f\x8b"}},
+	{"pdf", []string{"%PDF-"}},
+	{"script", []string{"#!"}},
+}
+
+// detectContentKind identifies non-image content from its leading bytes,
+// returning "" when none of the known signatures match.
+func detectContentKind(head []byte) string {
+	for _, signature := range contentSignatures {
+		for _, prefix := range signature.prefixes {
+			if bytes.HasPrefix(head, []byte(prefix)) {
+				return signature.kind
+			}
+		}
+	}
+	if strings.HasPrefix(http.DetectContentType(head), "text/html") {
+		return "html"
+	}
+	return ""
+}
+
+// scanContent rejects head when content scanning is enabled and it is
+// detected as a denied kind.
+func scanContent(head []byte) error {
+	if !cfg.ContentScan {
+		return nil
+	}
+	kind := detectContentKind(head)
+	if kind == "" || slices.Contains(cfg.ContentScanAllow, kind) {
+		return nil
+	}
+	deny := cfg.ContentScanDeny
+	if len(deny) == 0 {
+		deny = defaultScanDeny
+	}
+	if slices.Contains(deny, kind) {
+		return fmt.Errorf("content detected as %s", kind)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func zipFile(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("payload.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestContentScanRejectsDisguisedFiles(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.ContentScan = true
+		c.DestRoot = t.TempDir()
+	})
+
+	tests := map[string][]byte{
+		"zip": zipFile(t),
+		"elf": append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 64)...),
+	}
+	for kind, body := range tests {
+		upstream := serveBytes(t, "image/png", body)
+		rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/photo.png"]}`)
+		entry := decodeReport(t, rec).Entries[0]
+		if !strings.Contains(entry.Error, "content detected as "+kind) {
+			t.Errorf("%s disguised as .png: error %q", kind, entry.Error)
+		}
+	}
+}
+
+func TestContentScanLists(t *testing.T) {
+	elf := []byte("\x7fELF\x02\x01")
+	setConfig(t, func(c *config) { c.ContentScan = false })
+	if err := scanContent(elf); err != nil {
+		t.Errorf("scan disabled: %v", err)
+	}
+
+	setConfig(t, func(c *config) { c.ContentScan, c.ContentScanAllow = true, []string{"elf"} })
+	if err := scanContent(elf); err != nil {
+		t.Errorf("elf allowed: %v", err)
+	}
+
+	setConfig(t, func(c *config) { c.ContentScanAllow, c.ContentScanDeny = nil, []string{"pdf"} })
+	if err := scanContent(elf); err != nil {
+		t.Errorf("elf not in CONTENT_SCAN_DENY: %v", err)
+	}
+	if err := scanContent([]byte("%PDF-1.7")); err == nil {
+		t.Error("pdf in CONTENT_SCAN_DENY was accepted")
+	}
+	if err := scanContent(pngImage(t, 1, 1)); err != nil {
+		t.Errorf("png rejected: %v", err)
+	}
+}
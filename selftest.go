@@ -0,0 +1,50 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runSelfTest downloads SELF_TEST_URL through the same fetch, validation
+// and archiving steps as a strict request and checks the archive holds the
+// image, returning the first step that fails. It surfaces broken egress,
+// policy or codec setup at startup rather than on the first request.
+func runSelfTest() error {
+	if err := os.MkdirAll(tempRoot, 0755); err != nil {
+		return fmt.Errorf("scratch directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(tempRoot, "self-test-")
+	if err != nil {
+		return fmt.Errorf("scratch directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	entry := imageEntry{URL: cfg.SelfTestURL}
+	request := &downloadRequest{ImageURLs: []imageEntry{entry}, Strict: true}
+	result := &downloadResult{
+		URL:      entry.URL,
+		Filename: generateFilename(entry.URL, ""),
+		path:     filepath.Join(dir, "0"),
+	}
+	downloadImage(request, entry, result)
+	if result.Error != "" {
+		return fmt.Errorf("download: %s", result.Error)
+	}
+
+	var archive bytes.Buffer
+	report := newDownloadReport([]*downloadResult{result})
+	if _, err := writeArchive(&archive, archiveFormats["zip"], request, report); err != nil {
+		return fmt.Errorf("archive: %v", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		return fmt.Errorf("archive: %v", err)
+	}
+	if len(reader.File) != 1 || int64(reader.File[0].UncompressedSize64) != result.Bytes {
+		return fmt.Errorf("archive: does not hold the %d byte image", result.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	image := serveBytes(t, "image/png", pngImage(t, 4, 4))
+	page := serveBytes(t, "text/html", []byte("<html>captive portal</html>"))
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{image.URL + "/canary.png", ""},
+		{page.URL + "/canary.png", "download: "},
+		{missing.URL + "/canary.png", "download: "},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.SelfTestURL = tt.url })
+		err := runSelfTest()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: self-test failed: %v", tt.url, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+			t.Errorf("%s: self-test error %v, want one starting %q", tt.url, err, tt.wantErr)
+		}
+	}
+}
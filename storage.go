@@ -0,0 +1,340 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// directoryErrorResponse maps a failure to create a download directory to the
+// message and status code returned to the client.
+func directoryErrorResponse(err error) (string, int) {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return "Insufficient storage to create directory", http.StatusInsufficientStorage
+	case errors.Is(err, fs.ErrPermission):
+		return "Permission denied creating directory", http.StatusInternalServerError
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.ENAMETOOLONG),
+		errors.Is(err, syscall.EINVAL), errors.Is(err, fs.ErrExist):
+		return "Invalid directory path", http.StatusInternalServerError
+	default:
+		return "Failed to create directory", http.StatusInternalServerError
+	}
+}
+
+// defaultDestDir renders DEFAULT_DEST_DIR for a request made at now, with
+// {yyyy}, {mm} and {dd} giving its UTC date. It returns "" when no default
+// is configured.
+func defaultDestDir(now time.Time) string {
+	if cfg.DefaultDestDir == "" || cfg.DestRoot == "" {
+		return ""
+	}
+	now = now.UTC()
+	replacer := strings.NewReplacer(
+		"{yyyy}", now.Format("2006"),
+		"{mm}", now.Format("01"),
+		"{dd}", now.Format("02"),
+	)
+	return templatePath(replacer.Replace(cfg.DefaultDestDir))
+}
+
+// tempRoot holds the per-request directories of downloads that are not kept.
+const tempRoot = "temp_downloads"
+
+// resolveDestDir returns the directory a request's files are placed in and
+// whether it persists after the request. A destDir is honored only when
+// DEST_ROOT is configured, and must be a relative path inside it; otherwise a
+// fresh temporary directory is created in scratchRoot, or tempRoot when that
+// is empty.
+func resolveDestDir(destDir, scratchRoot string) (string, bool, error) {
+	if cfg.DestRoot == "" || destDir == "" {
+		root := cmp.Or(scratchRoot, tempRoot)
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return root, false, err
+		}
+		dir, err := os.MkdirTemp(root, "request-")
+		return dir, false, err
+	}
+
+	if !filepath.IsLocal(destDir) {
+		return "", true, errInvalidDestDir
+	}
+	dir := filepath.Join(cfg.DestRoot, destDir)
+	return dir, true, os.MkdirAll(dir, 0755)
+}
+
+var errInvalidDestDir = errors.New("destDir must be a relative path inside DEST_ROOT")
+
+var dirLocks = struct {
+	sync.Mutex
+	locks map[string]*dirLock
+}{locks: make(map[string]*dirLock)}
+
+type dirLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockDir serializes placement of files into dir across concurrent requests.
+// The returned function releases the lock.
+func lockDir(dir string) func() {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		key = filepath.Clean(dir)
+	}
+
+	dirLocks.Lock()
+	lock := dirLocks.locks[key]
+	if lock == nil {
+		lock = &dirLock{}
+		dirLocks.locks[key] = lock
+	}
+	lock.refs++
+	dirLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		dirLocks.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(dirLocks.locks, key)
+		}
+		dirLocks.Unlock()
+	}
+}
+
+// placeFiles moves each successful download from its scratch path into dir
+// under its chosen filename. Names repeated within the batch always get a
+// suffix; a clash with a file already in dir is resolved by the request's
+// onConflict: "rename" (the default) suffixes the new file, "overwrite"
+// replaces the existing one, and "skip" leaves it untouched. "content" names
+// clashing files with a hash of their content instead, reusing any file that
+// already holds the same bytes, so a shared directory keeps every distinct
+// image exactly once.
+//
+// Naming is deterministic: results are placed in request order, so the same
+// request against the same directory contents always yields the same names.
+// Suffixes are "_1", "_2", ... or, when the request sets a seed, a hash of the
+// seed and the entry's URL, which does not depend on the other entries.
+// Each file is handed to the post-download hook once it is in place, outside
+// the directory lock.
+func placeFiles(dir string, results []*downloadResult, request *downloadRequest) {
+	placer := newFilePlacer(dir, request)
+	for _, result := range results {
+		unlock := lockDir(dir)
+		placer.place(result)
+		unlock()
+		runPlacedHook(result)
+	}
+}
+
+// filePlacer places the downloads of one request, remembering the names it
+// has used so later entries of the batch never take them. Callers hold the
+// directory's lock around each place.
+type filePlacer struct {
+	dir     string
+	request *downloadRequest
+	taken   map[string]bool
+}
+
+func newFilePlacer(dir string, request *downloadRequest) *filePlacer {
+	return &filePlacer{dir: dir, request: request, taken: make(map[string]bool)}
+}
+
+// place moves result from its scratch path into the directory as described
+// for placeFiles.
+func (p *filePlacer) place(result *downloadResult) {
+	if result.original != nil {
+		result.shareOriginal()
+		return
+	}
+	if result.Error != "" || result.UploadStatus != 0 {
+		return
+	}
+	if p.request.WindowsSafe == nil || *p.request.WindowsSafe {
+		result.Filename = windowsSafeName(result.Filename)
+	}
+
+	suffix := collisionSuffix(p.request.Seed, result.URL)
+	name := uniqueFilename(result.Filename, suffix, func(name string) bool { return p.taken[name] })
+	if p.request.OnConflict == "content" {
+		digest, err := fileDigest(result.path)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to hash %s: %v", result.Filename, err)
+			return
+		}
+		// A name taken earlier in the batch is reused too when it holds the
+		// same bytes, so identical images of one batch are kept once.
+		name = uniqueFilename(result.Filename, contentSuffix(digest), func(name string) bool {
+			existing := filepath.Join(p.dir, filepath.FromSlash(name))
+			return fileExists(existing) && !hasDigest(existing, digest) || p.taken[name] && !fileExists(existing)
+		})
+		if existing := filepath.Join(p.dir, filepath.FromSlash(name)); fileExists(existing) {
+			os.Remove(result.path)
+			result.Filename = name
+			result.path = existing
+			result.Existing = true
+			p.taken[name] = true
+			return
+		}
+	} else if fileExists(filepath.Join(p.dir, filepath.FromSlash(name))) {
+		switch p.request.OnConflict {
+		case "skip":
+			result.Filename = name
+			result.Existing = true
+			p.taken[name] = true
+			return
+		case "overwrite":
+		default:
+			name = uniqueFilename(result.Filename, suffix, func(name string) bool {
+				return p.taken[name] || fileExists(filepath.Join(p.dir, filepath.FromSlash(name)))
+			})
+		}
+	}
+
+	target := filepath.Join(p.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err == nil {
+		err = moveFile(result.path, target)
+	}
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to save %s: %v", name, err)
+		return
+	}
+	result.Filename = name
+	result.path = target
+	p.taken[name] = true
+}
+
+// moveFile renames src to dst, copying it instead when they are on
+// different file systems, as when scratch files live under a tempProfile.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// uniqueFilename returns name, or name with the first suffix(n) inserted
+// before its extension for which used reports false. Candidates are fitted to
+// MAX_FILENAME_BYTES before they are checked, so shortened names stay unique.
+func uniqueFilename(name string, suffix func(int) string, used func(string) bool) string {
+	candidate := fitFilename(name, "")
+	for n := 1; used(candidate); n++ {
+		candidate = fitFilename(name, suffix(n))
+	}
+	return candidate
+}
+
+// fitFilename inserts suffix before the extension of the slash-separated
+// name, shortening its components to at most MAX_FILENAME_BYTES. The
+// extension and suffix are kept whole; only the base and directory names are
+// cut.
+func fitFilename(name, suffix string) string {
+	limit := cfg.MaxFilenameBytes
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if limit <= 0 {
+		return dir + stem + suffix + ext
+	}
+
+	var fitted []string
+	if dir != "" {
+		for _, segment := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+			fitted = append(fitted, truncateUTF8(segment, limit))
+		}
+	}
+	stem = truncateUTF8(stem, max(limit-len(suffix)-len(ext), 1))
+	return strings.Join(append(fitted, stem+suffix+ext), "/")
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// collisionSuffix returns the suffix generator for an entry: "_n" without a
+// seed, otherwise "_" followed by a short hash of the seed, URL and n.
+func collisionSuffix(seed, imageURL string) func(int) string {
+	if seed == "" {
+		return func(n int) string { return fmt.Sprintf("_%d", n) }
+	}
+	return func(n int) string {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", seed, imageURL, n)))
+		return fmt.Sprintf("_%x", hash[:4])
+	}
+}
+
+// contentSuffix returns the suffix generator for "content" conflicts: "_"
+// followed by a short content digest, then a counter should that collide too.
+func contentSuffix(digest string) func(int) string {
+	return func(n int) string {
+		if n == 1 {
+			return "_" + digest[:8]
+		}
+		return fmt.Sprintf("_%s_%d", digest[:8], n-1)
+	}
+}
+
+// fileDigest returns the hex SHA-256 of the file at path.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hasDigest(path, digest string) bool {
+	d, err := fileDigest(path)
+	return err == nil && d == digest
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDirectoryErrorResponse(t *testing.T) {
+	tests := []struct {
+		err     error
+		message string
+		status  int
+	}{
+		{&fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.ENOSPC}, "Insufficient storage to create directory", http.StatusInsufficientStorage},
+		{&fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.EDQUOT}, "Insufficient storage to create directory", http.StatusInsufficientStorage},
+		{&fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.EACCES}, "Permission denied creating directory", http.StatusInternalServerError},
+		{&fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.ENOTDIR}, "Invalid directory path", http.StatusInternalServerError},
+		{fmt.Errorf("wrapped: %w", &fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.ENAMETOOLONG}), "Invalid directory path", http.StatusInternalServerError},
+		{&fs.PathError{Op: "mkdir", Path: "/data/x", Err: syscall.EIO}, "Failed to create directory", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		message, status := directoryErrorResponse(tt.err)
+		if message != tt.message || status != tt.status {
+			t.Errorf("%v: got %q %d, want %q %d", tt.err, message, status, tt.message, tt.status)
+		}
+	}
+}
+
+func TestDownloadReportsInvalidDestDirPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, func(c *config) { c.DestRoot = root })
+
+	rec := postDownload(t, `{"destDir":"file/sub","imageURLs":["https://example.com/a.png"]}`)
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "Invalid directory path\n" {
+		t.Errorf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDownloadRejectsDestDirOutsideRoot(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"destDir":"../escape","imageURLs":["https://example.com/a.png"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDownloadReportsPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root is never denied permission")
+	}
+	root := t.TempDir()
+	if err := os.Chmod(root, 0555); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(t, func(c *config) { c.DestRoot = root })
+
+	rec := postDownload(t, `{"destDir":"out","imageURLs":["https://example.com/a.png"]}`)
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "Permission denied creating directory\n" {
+		t.Errorf("status = %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConcurrentRequestsShareDestDir(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	images := [][]byte{pngImage(t, 3, 3), pngImage(t, 30, 30)}
+	var upstreams []string
+	for _, image := range images {
+		upstreams = append(upstreams, serveBytes(t, "image/png", image).URL)
+	}
+
+	reports := make([]downloadReport, len(images))
+	done := make(chan int)
+	for i := range images {
+		go func() {
+			rec := httptest.NewRecorder()
+			downloadHandler(rec, httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(`{"output":"local","destDir":"shared","imageURLs":["`+upstreams[i]+`/same.png"]}`)))
+			json.Unmarshal(rec.Body.Bytes(), &reports[i])
+			done <- i
+		}()
+	}
+	<-done
+	<-done
+
+	names := make(map[string]bool)
+	for i, report := range reports {
+		if report.Succeeded != 1 {
+			t.Fatalf("request %d: report = %+v", i, report)
+		}
+		name := report.Entries[0].Filename
+		names[name] = true
+		saved, err := os.ReadFile(filepath.Join(cfg.DestRoot, "shared", name))
+		if err != nil || !bytes.Equal(saved, images[i]) {
+			t.Errorf("request %d: %s does not hold its image: %v", i, name, err)
+		}
+	}
+	if len(names) != 2 {
+		t.Errorf("both requests wrote %v", names)
+	}
+}
+
+// placedNames downloads body's URLs into destDir and returns the names the
+// entries were given, in request order.
+func placedNames(t *testing.T, destDir, body string) []string {
+	t.Helper()
+	rec := postDownload(t, `{"output":"local","destDir":"`+destDir+`",`+body+`}`)
+	report := decodeReport(t, rec)
+	var names []string
+	for _, entry := range report.Entries {
+		if entry.Error != "" {
+			t.Fatalf("%s failed: %s", entry.URL, entry.Error)
+		}
+		names = append(names, entry.Filename)
+	}
+	return names
+}
+
+func TestSeedMakesCollisionNamesRepeatable(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	a := serveBytes(t, "image/png", pngImage(t, 1, 1)).URL
+	b := serveBytes(t, "image/png", pngImage(t, 2, 2)).URL
+	urls := `"imageURLs":["` + a + `/x/logo.png","` + b + `/y/logo.png","` + a + `/z/logo.png"]`
+
+	first := placedNames(t, "run1", `"seed":"s1",`+urls)
+	second := placedNames(t, "run2", `"seed":"s1",`+urls)
+	if !slices.Equal(first, second) {
+		t.Errorf("same seed gave %v, then %v", first, second)
+	}
+	if first[0] != "logo.png" || len(first[1]) != len("logo_12345678.png") || first[1] == first[2] {
+		t.Errorf("seeded names %v", first)
+	}
+
+	// A seeded suffix depends only on the seed and the entry's own URL.
+	reordered := placedNames(t, "run3", `"seed":"s1","imageURLs":["`+b+`/other.png","`+a+`/q/logo.png","`+a+`/z/logo.png"]`)
+	if reordered[2] != first[2] {
+		t.Errorf("suffix of %s/z/logo.png changed with the other entries: %s, then %s", a, first[2], reordered[2])
+	}
+
+	unseeded := placedNames(t, "run4", urls)
+	if want := []string{"logo.png", "logo_1.png", "logo_2.png"}; !slices.Equal(unseeded, want) {
+		t.Errorf("unseeded names %v, want %v", unseeded, want)
+	}
+}
+
+func TestFitFilename(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxFilenameBytes = 10 })
+	tests := []struct{ name, suffix, want string }{
+		{"short.png", "", "short.png"},
+		{"averyverylongname.png", "", "averyv.png"},
+		{"averyverylongname.png", "_2", "aver_2.png"},
+		{"directoryname/averyverylongname.png", "", "directoryn/averyv.png"},
+		{"ééééééé.png", "", "ééé.png"},
+		{"aéééééé.png", "", "aéé.png"},
+		{"a.verylongextension", "", "a.verylongextension"},
+	}
+	for _, tt := range tests {
+		if got := fitFilename(tt.name, tt.suffix); got != tt.want {
+			t.Errorf("fitFilename(%q, %q) = %q, want %q", tt.name, tt.suffix, got, tt.want)
+		}
+	}
+
+	setConfig(t, func(c *config) { c.MaxFilenameBytes = 0 })
+	if got := fitFilename("averyverylongname.png", "_2"); got != "averyverylongname_2.png" {
+		t.Errorf("with the limit disabled, got %q", got)
+	}
+}
+
+func TestLongNamesTruncatedAndUnique(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir(); c.MaxFilenameBytes = 40 })
+	long := strings.Repeat("x", 100)
+	a := serveBytes(t, "image/png", pngImage(t, 1, 1)).URL
+	b := serveBytes(t, "image/png", pngImage(t, 2, 2)).URL
+
+	names := placedNames(t, "out", `"imageURLs":["`+a+`/`+long+`.png","`+b+`/`+long+`.png"]`)
+	if names[0] == names[1] {
+		t.Fatalf("both entries named %q", names[0])
+	}
+	for _, name := range names {
+		if len(name) > 40 || !strings.HasSuffix(name, ".png") {
+			t.Errorf("name %q is longer than 40 bytes or lost its extension", name)
+		}
+	}
+}
+
+func TestContentConflictsAcrossRequests(t *testing.T) {
+	root := t.TempDir()
+	setConfig(t, func(c *config) { c.DestRoot = root })
+	first, second := pngImage(t, 1, 1), pngImage(t, 2, 2)
+	a := serveBytes(t, "image/png", first).URL
+	b := serveBytes(t, "image/png", second).URL
+
+	download := func(url string) *downloadResult {
+		rec := postDownload(t, `{"output":"local","destDir":"shared","onConflict":"content","imageURLs":["`+url+`/logo.png"]}`)
+		entry := decodeReport(t, rec).Entries[0]
+		if entry.Error != "" {
+			t.Fatalf("%s failed: %s", url, entry.Error)
+		}
+		return entry
+	}
+	one, two, again := download(a), download(b), download(a+"/again")
+
+	if one.Filename != "logo.png" || two.Filename == one.Filename {
+		t.Fatalf("names %q and %q, want logo.png and a distinct name", one.Filename, two.Filename)
+	}
+	for name, want := range map[string][]byte{one.Filename: first, two.Filename: second} {
+		if got, _ := os.ReadFile(filepath.Join(root, "shared", name)); !bytes.Equal(got, want) {
+			t.Errorf("%s does not hold its download", name)
+		}
+	}
+	if !again.Existing || again.Filename != one.Filename {
+		t.Errorf("repeated content placed as %q (existing %v), want reuse of %q", again.Filename, again.Existing, one.Filename)
+	}
+	if files, _ := os.ReadDir(filepath.Join(root, "shared")); len(files) != 2 {
+		t.Errorf("shared destDir holds %d files, want 2", len(files))
+	}
+}
+
+func TestTempProfileHoldsScratchFiles(t *testing.T) {
+	profile := t.TempDir()
+	setConfig(t, func(c *config) {
+		c.DestRoot = t.TempDir()
+		c.TempProfiles = map[string]string{"ssd": profile}
+		c.TrustedAPIKeys = []string{"secret"}
+	})
+	image := pngImage(t, 3, 3)
+	var scratch []string
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// A request without a destDir keeps its whole temporary directory
+		// in the profile.
+		scratch, _ = filepath.Glob(filepath.Join(profile, ".download-*"))
+		nested, _ := filepath.Glob(filepath.Join(profile, "request-*", ".download-*"))
+		scratch = append(scratch, nested...)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+
+	for _, body := range []string{
+		`{"tempProfile":"ssd","output":"local","destDir":"out","imageURLs":["` + upstream.URL + `/a.png"]}`,
+		`{"tempProfile":"ssd","imageURLs":["` + upstream.URL + `/a.png"]}`,
+	} {
+		scratch = nil
+		rec := postWithKey(t, "secret", body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %q", body, rec.Code, rec.Body.String())
+		}
+		if len(scratch) != 1 {
+			t.Errorf("%s: scratch directories in the profile while downloading: %q, want one", body, scratch)
+		}
+		if left, _ := os.ReadDir(profile); len(left) != 0 {
+			t.Errorf("%s: profile still holds %d entries", body, len(left))
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.DestRoot, "out", "a.png")); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("placed file: %d bytes, %v", len(data), err)
+	}
+}
+
+func TestTempProfileRejected(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.TempProfiles = map[string]string{"ssd": t.TempDir()}
+		c.TrustedAPIKeys = []string{"secret"}
+	})
+
+	tests := []struct {
+		key, profile string
+		status       int
+	}{
+		{"", "ssd", http.StatusForbidden},
+		{"secret", "hdd", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := postWithKey(t, tt.key, `{"tempProfile":"`+tt.profile+`","imageURLs":["https://example.com/a.png"]}`)
+		if rec.Code != tt.status {
+			t.Errorf("key %q, tempProfile %q: status = %d, want %d", tt.key, tt.profile, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestDefaultDestDir(t *testing.T) {
+	now := time.Date(2025, 3, 7, 23, 30, 0, 0, time.FixedZone("EST", -5*60*60))
+	tests := []struct {
+		root, template, want string
+	}{
+		{"/srv/images", "{yyyy}/{mm}/{dd}", "2025/03/08"},
+		{"/srv/images", "shared/{yyyy}-{mm}-{dd}", "shared/2025-03-08"},
+		{"/srv/images", "../{yyyy}//./{mm}", "2025/03"},
+		{"/srv/images", "", ""},
+		{"", "{yyyy}", ""},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.DestRoot, c.DefaultDestDir = tt.root, tt.template })
+		if got := defaultDestDir(now); got != tt.want {
+			t.Errorf("DEFAULT_DEST_DIR=%q under %q: %q, want %q", tt.template, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultDestDirUsed(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	root := t.TempDir()
+	setConfig(t, func(c *config) { c.DestRoot, c.DefaultDestDir = root, "shared/{yyyy}-{mm}" })
+	today := "shared/" + time.Now().UTC().Format("2006-01")
+	urls := `"imageURLs":["` + upstream.URL + `/a.png"]`
+
+	rec := postDownload(t, `{`+urls+`}`)
+	if got := rec.Header().Get("X-Dest-Dir"); got != today {
+		t.Errorf("X-Dest-Dir = %q, want %q", got, today)
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(today), "a.png")); err != nil {
+		t.Errorf("archived download not kept in the default destDir: %v", err)
+	}
+
+	report := decodeReport(t, postDownload(t, `{"output":"local",`+urls+`}`))
+	if report.DestDir != today || report.Entries[0].Filename != "a_1.png" {
+		t.Errorf("local output: destDir %q, filename %q; want %q and a_1.png", report.DestDir, report.Entries[0].Filename, today)
+	}
+
+	report = decodeReport(t, postDownload(t, `{"output":"local","destDir":"mine",`+urls+`}`))
+	if report.DestDir != "" || report.Entries[0].Error != "" {
+		t.Errorf("explicit destDir: report destDir %q, error %q", report.DestDir, report.Entries[0].Error)
+	}
+
+	rec = postDownload(t, `{"ephemeral":true,`+urls+`}`)
+	if got := rec.Header().Get("X-Dest-Dir"); got != "" || len(zipEntries(t, rec)) != 1 {
+		t.Errorf("ephemeral: X-Dest-Dir %q", got)
+	}
+	if files, _ := os.ReadDir(filepath.Join(root, filepath.FromSlash(today))); len(files) != 2 {
+		t.Errorf("default destDir holds %d files after an ephemeral request, want 2", len(files))
+	}
+
+	if rec := postDownload(t, `{"ephemeral":true,"destDir":"mine",`+urls+`}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("ephemeral with destDir: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
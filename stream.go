@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// streamedResult is one element of a streamed report: a result and the
+// position of its entry in the request.
+type streamedResult struct {
+	Index int `json:"index"`
+	*downloadResult
+}
+
+// responseFlusher returns w as an http.Flusher if flushing it reaches the
+// client, or nil. Wrappers that provide Flush but expose their underlying
+// writer through Unwrap, such as the gzip middleware, can only flush as far
+// as that writer does.
+func responseFlusher(w io.Writer) http.Flusher {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	for inner := w; ; {
+		unwrapper, ok := inner.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return flusher
+		}
+		inner = unwrapper.Unwrap()
+		if _, ok := inner.(http.Flusher); !ok {
+			return nil
+		}
+	}
+}
+
+// streamResults writes a JSON array of results as their downloads complete,
+// flushing after each element, with the final tally in trailers. Each file is
+// placed in dir as soon as it completes, so when names collide within the
+// batch the suffixes follow completion order rather than request order.
+func streamResults(w http.ResponseWriter, dir string, request *downloadRequest, results []*downloadResult, completed <-chan int, timer *phaseTimer) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", "X-Succeeded, X-Failed, X-Total-Bytes, X-Budget-Exceeded, X-Required-Failed, Server-Timing")
+	flusher := responseFlusher(w)
+
+	placer := newFilePlacer(dir, request)
+	succeeded, failed, requiredFailed := 0, 0, 0
+	separator := "[\n"
+	for i := range completed {
+		result := results[i]
+		result.Filename = applyPathTemplate(request.PathTemplate, result.URL, result.Filename, result.lastModified)
+		unlock := lockDir(dir)
+		placer.place(result)
+		unlock()
+		runPlacedHook(result)
+		if result.Error != "" {
+			failed++
+			if result.Required {
+				requiredFailed++
+			}
+		} else {
+			succeeded++
+		}
+
+		element, err := json.Marshal(streamedResult{i, result})
+		if err != nil {
+			continue
+		}
+		w.Write([]byte(separator))
+		w.Write(element)
+		separator = ",\n"
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if separator == "[\n" {
+		w.Write([]byte(separator))
+	}
+	w.Write([]byte("\n]\n"))
+
+	w.Header().Set("X-Succeeded", strconv.Itoa(succeeded))
+	w.Header().Set("X-Failed", strconv.Itoa(failed))
+	w.Header().Set("X-Total-Bytes", strconv.FormatInt(request.budget.used.Load(), 10))
+	w.Header().Set("X-Budget-Exceeded", strconv.FormatBool(request.budget.exhausted()))
+	w.Header().Set("X-Required-Failed", strconv.Itoa(requiredFailed))
+	timer.downloaded()
+	w.Header().Set("Server-Timing", timer.serverTiming())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// streamedElement decodes an element of a streamed report.
+type streamedElement struct {
+	Index int `json:"index"`
+	downloadResult
+}
+
+func TestStreamEmitsResultsAsTheyComplete(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	image := pngImage(t, 2, 2)
+	release := make(chan struct{})
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.png" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	server := httptestServer(t, downloadHandler)
+
+	body := `{"output":"stream","destDir":"out","imageURLs":["` + upstream.URL + `/slow.png","` + upstream.URL + `/fast.png"]}`
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		t.Fatalf("first token = %v, %v; want [", token, err)
+	}
+	var first streamedElement
+	if err := decoder.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	// The slow download is still blocked, so this element was flushed on
+	// its own.
+	if first.Index != 1 || first.Error != "" || first.Filename != "fast.png" {
+		t.Errorf("first element = index %d %+v, want the fast download", first.Index, first.downloadResult)
+	}
+
+	unblock()
+	var second streamedElement
+	if err := decoder.Decode(&second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Index != 0 || second.Error != "" {
+		t.Errorf("second element = index %d %+v, want the slow download", second.Index, second.downloadResult)
+	}
+	if token, err := decoder.Token(); err != nil || token != json.Delim(']') {
+		t.Fatalf("last token = %v, %v; want ]", token, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		t.Errorf("data after the array: %v", err)
+	}
+	if got := resp.Trailer.Get("X-Succeeded"); got != "2" {
+		t.Errorf("X-Succeeded trailer = %q, want 2", got)
+	}
+}
+
+func TestStreamIsValidJSON(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	missing := httptestServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+
+	rec := postDownload(t, `{"output":"stream","destDir":"out","imageURLs":["`+upstream.URL+`/a.png","`+missing.URL+`/b.png","`+upstream.URL+`/c.png"]}`)
+	var streamed []streamedElement
+	if err := json.Unmarshal(rec.Body.Bytes(), &streamed); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	failed := 0
+	seen := make(map[int]bool)
+	for _, element := range streamed {
+		seen[element.Index] = true
+		if element.Error != "" {
+			failed++
+		}
+	}
+	if len(streamed) != 3 || len(seen) != 3 || failed != 1 {
+		t.Errorf("streamed %d elements for %d entries with %d failures, want 3, 3 and 1", len(streamed), len(seen), failed)
+	}
+}
+
+func TestStreamRequiresDestDir(t *testing.T) {
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	upstream := serveBytes(t, "image/png", pngImage(t, 1, 1))
+	if rec := postDownload(t, `{"output":"stream","imageURLs":["`+upstream.URL+`/a.png"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+}
+
+// plainWriter is a ResponseWriter with no optional capabilities, like those
+// of some proxies and test harnesses.
+type plainWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newPlainWriter() *plainWriter { return &plainWriter{header: make(http.Header)} }
+
+func (p *plainWriter) Header() http.Header { return p.header }
+
+func (p *plainWriter) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.status = http.StatusOK
+	}
+	return p.body.Write(b)
+}
+
+func (p *plainWriter) WriteHeader(status int) {
+	if p.status == 0 {
+		p.status = status
+	}
+}
+
+// flushingWrapper claims to flush, but only as far as the writer it wraps.
+type flushingWrapper struct{ http.ResponseWriter }
+
+func (f flushingWrapper) Flush() {}
+
+func (f flushingWrapper) Unwrap() http.ResponseWriter { return f.ResponseWriter }
+
+func TestResponseFlusher(t *testing.T) {
+	tests := []struct {
+		name      string
+		w         http.ResponseWriter
+		flushable bool
+	}{
+		{"recorder", httptest.NewRecorder(), true},
+		{"plain", newPlainWriter(), false},
+		{"wrapped recorder", flushingWrapper{httptest.NewRecorder()}, true},
+		{"wrapped plain", flushingWrapper{newPlainWriter()}, false},
+		{"doubly wrapped plain", flushingWrapper{flushingWrapper{newPlainWriter()}}, false},
+	}
+	for _, tt := range tests {
+		if got := responseFlusher(tt.w) != nil; got != tt.flushable {
+			t.Errorf("%s: flushable %v, want %v", tt.name, got, tt.flushable)
+		}
+	}
+}
+
+func TestNonFlushingWriter(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 3, 3))
+	serve := func(body string) *plainWriter {
+		req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := newPlainWriter()
+		downloadHandler(w, req)
+		return w
+	}
+
+	w := serve(`{"imageURLs":["` + upstream.URL + `/a.png","` + upstream.URL + `/b.png"]}`)
+	if w.status != http.StatusOK || w.header.Get("Content-Length") != strconv.Itoa(w.body.Len()) || w.header.Get("X-Succeeded") != "2" {
+		t.Errorf("status %d, Content-Length %q for %d bytes, X-Succeeded %q; want a buffered archive",
+			w.status, w.header.Get("Content-Length"), w.body.Len(), w.header.Get("X-Succeeded"))
+	}
+	if reader, err := zip.NewReader(bytes.NewReader(w.body.Bytes()), int64(w.body.Len())); err != nil || len(reader.File) != 2 {
+		t.Errorf("archive unreadable (%v) or missing entries", err)
+	}
+
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	w = serve(`{"output":"stream","destDir":"out","imageURLs":["` + upstream.URL + `/a.png","` + upstream.URL + `/b.png"]}`)
+	var elements []streamedElement
+	if err := json.Unmarshal(w.body.Bytes(), &elements); err != nil || len(elements) != 2 {
+		t.Errorf("streamed report %q: %v", w.body.String(), err)
+	}
+}
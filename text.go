@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+var (
+	utf8BOM    = []byte("\xef\xbb\xbf")
+	utf16LEBOM = []byte("\xff\xfe")
+	utf16BEBOM = []byte("\xfe\xff")
+)
+
+// xmlEncoding matches the encoding attribute of a leading XML declaration.
+var xmlEncoding = regexp.MustCompile(`^(<\?xml[^>]*?encoding\s*=\s*["'])([^"']*)(["'])`)
+
+// normalizeText rewrites the text-based image at path as UTF-8 without a byte
+// order mark and returns its resulting size. UTF-16 is recognized by its BOM
+// and Latin-1 by the XML declaration, which is updated to name UTF-8. Binary
+// formats, and text in other encodings, are left untouched.
+func normalizeText(path, mediaType string, size int64) (int64, error) {
+	if mediaType != "image/svg+xml" {
+		return size, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return size, err
+	}
+	text, ok := decodeText(data)
+	if !ok || text == string(data) {
+		return size, nil
+	}
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		return size, err
+	}
+	return int64(len(text)), nil
+}
+
+// decodeText returns data as UTF-8 text without a BOM, or false if its
+// encoding is not one decodeText understands.
+func decodeText(data []byte) (string, bool) {
+	var text string
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		text = string(data[len(utf8BOM):])
+	case bytes.HasPrefix(data, utf16LEBOM):
+		text = decodeUTF16(data[len(utf16LEBOM):], binary.LittleEndian)
+	case bytes.HasPrefix(data, utf16BEBOM):
+		text = decodeUTF16(data[len(utf16BEBOM):], binary.BigEndian)
+	default:
+		match := xmlEncoding.FindSubmatch(data)
+		if match == nil {
+			return string(data), true
+		}
+		switch strings.ToLower(string(match[2])) {
+		case "utf-8", "utf8", "us-ascii", "ascii":
+			text = string(data)
+		case "iso-8859-1", "latin1", "latin-1":
+			text = decodeLatin1(data)
+		default:
+			return "", false
+		}
+	}
+	return xmlEncoding.ReplaceAllString(text, "${1}UTF-8${3}"), true
+}
+
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
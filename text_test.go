@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+const svgDocument = `<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"/>`
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		ok   bool
+	}{
+		{"utf-8 bom", "\xef\xbb\xbf" + svgDocument, svgDocument, true},
+		{"utf-16le bom", "\xff\xfe<\x00s\x00v\x00g\x00/\x00>\x00", "<svg/>", true},
+		{"utf-16be bom", "\xfe\xff\x00<\x00s\x00v\x00g\x00/\x00>", "<svg/>", true},
+		{"latin-1", `<?xml version="1.0" encoding="ISO-8859-1"?><svg>` + "\xe9</svg>", `<?xml version="1.0" encoding="UTF-8"?><svg>é</svg>`, true},
+		{"plain", svgDocument, svgDocument, true},
+		{"unknown encoding", `<?xml version="1.0" encoding="Shift_JIS"?><svg/>`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := decodeText([]byte(tt.data))
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("%s: decodeText = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeTextStripsBOM(t *testing.T) {
+	svg := serveBytes(t, "image/svg+xml", append([]byte("\xef\xbb\xbf"), svgDocument...))
+	image := pngImage(t, 2, 2)
+	binary := serveBytes(t, "image/png", image)
+
+	entries := zipEntries(t, postDownload(t, `{"normalizeText":true,"imageURLs":["`+svg.URL+`/logo.svg","`+binary.URL+`/photo.png"]}`))
+	if got := string(entries["logo.svg"]); got != svgDocument {
+		t.Errorf("logo.svg = %q, want %q", got, svgDocument)
+	}
+	if !bytes.Equal(entries["photo.png"], image) {
+		t.Error("photo.png was modified")
+	}
+
+	entries = zipEntries(t, postDownload(t, `{"imageURLs":["`+svg.URL+`/logo.svg"]}`))
+	if !bytes.HasPrefix(entries["logo.svg"], []byte("\xef\xbb\xbf")) {
+		t.Error("BOM stripped without normalizeText")
+	}
+}
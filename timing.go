@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// phaseTimer measures the wall-clock time of a batch and of its download
+// and archive phases, reported in the Server-Timing header and the JSON
+// report.
+type phaseTimer struct {
+	start         time.Time
+	downloadStart time.Time
+	download      time.Duration
+	archive       time.Duration
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now()}
+}
+
+// startDownloads begins the download phase, which covers placing the files
+// as well as fetching them.
+func (t *phaseTimer) startDownloads() { t.downloadStart = time.Now() }
+
+// downloaded ends the download phase.
+func (t *phaseTimer) downloaded() { t.download = time.Since(t.downloadStart) }
+
+// archived ends the archive phase begun at since.
+func (t *phaseTimer) archived(since time.Time) { t.archive = time.Since(since) }
+
+// serverTiming formats the phases measured so far, and the time since the
+// batch started, as a Server-Timing value with durations in milliseconds.
+func (t *phaseTimer) serverTiming() string {
+	value := fmt.Sprintf("download;dur=%.1f", milliseconds(t.download))
+	if t.archive > 0 {
+		value += fmt.Sprintf(", archive;dur=%.1f", milliseconds(t.archive))
+	}
+	return value + fmt.Sprintf(", total;dur=%.1f", milliseconds(time.Since(t.start)))
+}
+
+// batchTimings is the report's view of a phaseTimer. Reports are written
+// before any archive, so they carry no archive time.
+type batchTimings struct {
+	DownloadMs int64 `json:"downloadMs"`
+	TotalMs    int64 `json:"totalMs"`
+}
+
+func (t *phaseTimer) timings() *batchTimings {
+	return &batchTimings{DownloadMs: t.download.Milliseconds(), TotalMs: time.Since(t.start).Milliseconds()}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
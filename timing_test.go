@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseServerTiming returns the durations of a Server-Timing value by
+// metric name.
+func parseServerTiming(t *testing.T, value string) map[string]float64 {
+	t.Helper()
+	durations := make(map[string]float64)
+	for _, metric := range strings.Split(value, ",") {
+		name, dur, ok := strings.Cut(strings.TrimSpace(metric), ";dur=")
+		if !ok {
+			t.Fatalf("Server-Timing %q: metric %q has no duration", value, metric)
+		}
+		ms, err := strconv.ParseFloat(dur, 64)
+		if err != nil {
+			t.Fatalf("Server-Timing %q: %v", value, err)
+		}
+		durations[name] = ms
+	}
+	return durations
+}
+
+func TestBatchTimings(t *testing.T) {
+	image := pngImage(t, 4, 4)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	})
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+	urls := `"` + upstream.URL + `/a.png","` + upstream.URL + `/b.png"`
+
+	tests := []struct {
+		name    string
+		body    string
+		trailer bool
+		archive bool
+	}{
+		{"local", `{"output":"local","destDir":"out","imageURLs":[` + urls + `]}`, false, false},
+		{"stream", `{"output":"stream","destDir":"streamed","imageURLs":[` + urls + `]}`, true, false},
+		{"streamed archive", `{"imageURLs":[` + urls + `]}`, true, true},
+		{"buffered archive", `{"delivery":"buffered","imageURLs":[` + urls + `]}`, false, true},
+	}
+	for _, tt := range tests {
+		resp := postDownload(t, tt.body).Result()
+		value := resp.Header.Get("Server-Timing")
+		if tt.trailer {
+			value = resp.Trailer.Get("Server-Timing")
+		}
+		if value == "" {
+			t.Errorf("%s: no Server-Timing (trailer %t)", tt.name, tt.trailer)
+			continue
+		}
+		// Each duration is rounded to 0.1ms on its own, so the phases may
+		// add up to a shade over the total.
+		timing := parseServerTiming(t, value)
+		if timing["download"] < 30 || timing["total"]+0.1 < timing["download"]+timing["archive"] {
+			t.Errorf("%s: Server-Timing %q, want download of at least 30ms within total", tt.name, value)
+		}
+		if _, ok := timing["archive"]; ok != tt.archive {
+			t.Errorf("%s: Server-Timing %q has archive %t, want %t", tt.name, value, ok, tt.archive)
+		}
+	}
+
+	rec := postDownload(t, `{"output":"local","destDir":"report","imageURLs":[`+urls+`]}`)
+	timings := decodeReport(t, rec).Timings
+	if timings == nil || timings.DownloadMs < 30 || timings.TotalMs < timings.DownloadMs {
+		t.Errorf("report timings %+v, want a download of at least 30ms within the total", timings)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// uiPage is the minimal browser front end served at / when ENABLE_UI is set.
+// It posts the pasted URLs to /download and saves the returned archive.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Image Download</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 48em; }
+textarea { width: 100%; height: 16em; }
+#status { margin-top: 1em; }
+</style>
+</head>
+<body>
+<h1>Image Download</h1>
+<form id="form">
+<p><label for="urls">Image URLs, one per line:</label></p>
+<textarea id="urls" required></textarea>
+<p><button type="submit">Download ZIP</button></p>
+</form>
+<div id="status"></div>
+<script>
+document.getElementById("form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const status = document.getElementById("status");
+  const urls = document.getElementById("urls").value.split("\n").map((u) => u.trim()).filter(Boolean);
+  status.textContent = "Downloading " + urls.length + " images...";
+  const response = await fetch("download", {
+    method: "POST",
+    headers: {"Content-Type": "application/json"},
+    body: JSON.stringify({imageURLs: urls}),
+  });
+  if (!response.ok) {
+    status.textContent = "Failed: " + await response.text();
+    return;
+  }
+  const link = document.createElement("a");
+  link.href = URL.createObjectURL(await response.blob());
+  link.download = "images.zip";
+  link.click();
+  URL.revokeObjectURL(link.href);
+  status.textContent = "Done.";
+});
+</script>
+</body>
+</html>
+`
+
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, uiPage)
+}
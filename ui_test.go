@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getRoot(t *testing.T, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rootHandler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestRootServesUIWhenEnabled(t *testing.T) {
+	setConfig(t, func(c *config) { c.EnableUI = true })
+
+	rec := getRoot(t, "/")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "<form") || !strings.Contains(body, `fetch("download"`) {
+		t.Error("UI page lacks the URL form posting to /download")
+	}
+
+	status := httptest.NewRecorder()
+	statusHandler(status, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var report map[string]interface{}
+	if err := json.Unmarshal(status.Body.Bytes(), &report); err != nil || report["status"] != "active" {
+		t.Errorf("/status = %q, %v", status.Body.String(), err)
+	}
+}
+
+func TestRootServesJSONByDefault(t *testing.T) {
+	setConfig(t, func(c *config) { c.EnableUI = false })
+
+	rec := getRoot(t, "/")
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Content-Type %q, want application/json", rec.Header().Get("Content-Type"))
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil || report["status"] != "active" {
+		t.Errorf("/ = %q, %v", rec.Body.String(), err)
+	}
+	if rec := getRoot(t, "/elsewhere"); rec.Code != http.StatusNotFound {
+		t.Errorf("/elsewhere status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var errManifestTooLarge = errors.New("URL list exceeds the size limit")
+
+// decodeJSON decodes the JSON document in r into v, skipping a UTF-8 byte
+// order mark some clients prepend. UTF-16 and UTF-32 documents are refused
+// with an error saying so, and syntax and type errors name where the
+// document went wrong.
+func decodeJSON(r io.Reader, v any) error {
+	buffered := bufio.NewReader(r)
+	head, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, utf8BOM):
+		buffered.Discard(len(utf8BOM))
+	case bytes.HasPrefix(head, []byte("\x00\x00\xfe\xff")), bytes.HasPrefix(head, []byte("\xff\xfe\x00\x00")):
+		return errors.New("body is UTF-32, send UTF-8")
+	case bytes.HasPrefix(head, utf16BEBOM), bytes.HasPrefix(head, utf16LEBOM):
+		return errors.New("body is UTF-16, send UTF-8")
+	case len(head) >= 2 && (head[0] == 0 || head[1] == 0):
+		return errors.New("body is not UTF-8, send UTF-8")
+	}
+
+	err := json.NewDecoder(buffered).Decode(v)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("invalid JSON at byte %d: %v", syntaxErr.Offset, err)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("%s must be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// decodeDownloadRequest reads a download request from a JSON body or, for
+// multipart/form-data, from an uploaded "urls" file. The file may be gzip- or
+// zip-compressed and holds a JSON request, a JSON array of entries, or one
+// URL per line. Options can accompany it in a JSON "request" form field.
+func decodeDownloadRequest(r *http.Request) (*downloadRequest, error) {
+	var request downloadRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := decodeJSON(r.Body, &request); err != nil {
+			return nil, err
+		}
+		return &request, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var urls []imageEntry
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch part.FormName() {
+		case "request":
+			if err := decodeJSON(io.LimitReader(part, cfg.MaxURLListBytes), &request); err != nil {
+				return nil, fmt.Errorf("invalid request field: %v", err)
+			}
+		case "urls":
+			data, err := readURLList(part)
+			if err != nil {
+				return nil, err
+			}
+			if urls, err = parseURLList(data); err != nil {
+				return nil, err
+			}
+		}
+		part.Close()
+	}
+	request.ImageURLs = append(request.ImageURLs, urls...)
+	return &request, nil
+}
+
+// readURLList reads an uploaded URL list, transparently decompressing gzip
+// and zip files. The decompressed size is limited to MAX_URL_LIST_BYTES.
+func readURLList(r io.Reader) ([]byte, error) {
+	limit := cfg.MaxURLListBytes
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+
+	var content io.Reader = buffered
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip file: %v", err)
+		}
+		defer gz.Close()
+		content = gz
+
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		archive, err := readLimited(buffered, limit)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zip file: %v", err)
+		}
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				return nil, fmt.Errorf("invalid zip file: %v", err)
+			}
+			defer rc.Close()
+			content = rc
+			break
+		}
+		if content == buffered {
+			return nil, errors.New("zip file contains no URL list")
+		}
+	}
+
+	return readLimited(content, limit)
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errManifestTooLarge
+	}
+	return data, nil
+}
+
+// parseURLList accepts a JSON request object, a JSON array of entries, or
+// plain text with one URL per line.
+func parseURLList(data []byte) ([]imageEntry, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, utf8BOM))
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var request downloadRequest
+		if err := json.Unmarshal(trimmed, &request); err != nil {
+			return nil, fmt.Errorf("invalid URL list: %v", err)
+		}
+		return request.ImageURLs, nil
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		var entries []imageEntry
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("invalid URL list: %v", err)
+		}
+		return entries, nil
+	}
+
+	var entries []imageEntry
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, imageEntry{URL: line})
+		}
+	}
+	return entries, nil
+}
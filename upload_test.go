@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// multipartRequest builds a /download request uploading urls as the "urls"
+// file, with options as the "request" field when it is not empty.
+func multipartRequest(t *testing.T, urls []byte, options string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if options != "" {
+		form.WriteField("request", options)
+	}
+	file, _ := form.CreateFormFile("urls", "urls.txt")
+	file.Write(urls)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/download", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipped(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create("manifests/")
+	w, _ := zw.Create(name)
+	w.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func entryURLs(entries []imageEntry) []string {
+	var urls []string
+	for _, entry := range entries {
+		urls = append(urls, entry.URL)
+	}
+	return urls
+}
+
+func TestCompressedURLLists(t *testing.T) {
+	want := []string{"https://example.com/a.png", "https://example.com/b.png"}
+	text := []byte("# images\nhttps://example.com/a.png\r\n\n  https://example.com/b.png\n")
+	array := []byte(`[{"url":"https://example.com/a.png"},{"url":"https://example.com/b.png"}]`)
+
+	tests := map[string][]byte{
+		"plain":      text,
+		"gzip":       gzipped(text),
+		"zip":        zipped("urls.txt", text),
+		"gzip array": gzipped(array),
+		"zip object": zipped("request.json", []byte(`{"imageURLs":`+string(array)+`}`)),
+	}
+	for name, upload := range tests {
+		request, err := decodeDownloadRequest(multipartRequest(t, upload, `{"format":"tar"}`))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := entryURLs(request.ImageURLs); !slices.Equal(got, want) {
+			t.Errorf("%s: URLs %v, want %v", name, got, want)
+		}
+		if request.Format != "tar" {
+			t.Errorf("%s: request field ignored, format %q", name, request.Format)
+		}
+	}
+}
+
+func TestURLListLimits(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxURLListBytes = 64 })
+	large := bytes.Repeat([]byte("https://example.com/a.png\n"), 100)
+
+	for name, upload := range map[string][]byte{"plain": large, "gzip": gzipped(large), "zip": zipped("urls.txt", large)} {
+		rec := httptest.NewRecorder()
+		downloadHandler(rec, multipartRequest(t, upload, ""))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status = %d, want %d", name, rec.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	if _, err := decodeDownloadRequest(multipartRequest(t, nil, "")); err != nil {
+		t.Errorf("empty upload: %v", err)
+	}
+	if _, err := readURLList(bytes.NewReader([]byte("\x1f\x8bnot gzip"))); err == nil {
+		t.Error("corrupt gzip accepted")
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"plain", `{"format":"tar"}`, ""},
+		{"UTF-8 BOM", "\xef\xbb\xbf" + `{"format":"tar"}`, ""},
+		{"UTF-16LE", "\xff\xfe{\x00\"\x00", "body is UTF-16, send UTF-8"},
+		{"UTF-16BE", "\xfe\xff\x00{\x00\"", "body is UTF-16, send UTF-8"},
+		{"UTF-32LE", "\xff\xfe\x00\x00{\x00\x00\x00", "body is UTF-32, send UTF-8"},
+		{"UTF-16 without BOM", "{\x00\"\x00", "body is not UTF-8, send UTF-8"},
+		{"syntax error", `{"format":"tar",}`, "invalid JSON at byte 17"},
+		{"wrong type", `{"maxImages":"ten"}`, "maxImages must be int, not string"},
+	}
+	for _, tt := range tests {
+		var request downloadRequest
+		err := decodeJSON(strings.NewReader(tt.body), &request)
+		switch {
+		case tt.wantErr == "" && (err != nil || request.Format != "tar"):
+			t.Errorf("%s: format %q, err %v", tt.name, request.Format, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: err %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBOMPrefixedBodies(t *testing.T) {
+	upstream := serveBytes(t, "image/png", pngImage(t, 2, 2))
+	body := "\xef\xbb\xbf" + `{"imageURLs":["` + upstream.URL + `/a.png"]}`
+	if entries := zipEntries(t, postDownload(t, body)); len(entries) != 1 {
+		t.Errorf("BOM-prefixed request archived %v", keys(entries))
+	}
+
+	request, err := decodeDownloadRequest(multipartRequest(t, []byte("\xef\xbb\xbfhttps://example.com/a.png\n"), "\xef\xbb\xbf"+`{"format":"tar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryURLs(request.ImageURLs); !slices.Equal(got, []string{"https://example.com/a.png"}) || request.Format != "tar" {
+		t.Errorf("BOM-prefixed upload: URLs %v, format %q", got, request.Format)
+	}
+
+	rec := postDownload(t, "\xff\xfe{\x00}\x00")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "UTF-16") {
+		t.Errorf("UTF-16 body: %d %q", rec.Code, rec.Body.String())
+	}
+}
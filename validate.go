@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// defaultAllowedTypes is the content-type allowlist used by strict mode when
+// ALLOWED_TYPES is not configured.
+var defaultAllowedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+	"image/bmp", "image/tiff", "image/svg+xml", "image/x-icon", "image/vnd.microsoft.icon",
+}
+
+// checkError reports which validation check rejected a download.
+type checkError struct {
+	check  string
+	detail string
+}
+
+func (e *checkError) Error() string {
+	return fmt.Sprintf("%s check failed: %s", e.check, e.detail)
+}
+
+// checkMediaType enforces the content-type allowlist against a download's
+// resolved media type: the request's allowedTypes, else ALLOWED_TYPES when it
+// is configured, or the default image types in strict mode.
+func checkMediaType(mediaType string, request *downloadRequest) error {
+	allowed := request.AllowedTypes
+	if len(allowed) == 0 {
+		allowed = cfg.AllowedTypes
+	}
+	if len(allowed) == 0 {
+		if !request.Strict {
+			return nil
+		}
+		allowed = defaultAllowedTypes
+	}
+
+	if mediaType == "" {
+		return &checkError{"content-type", "content type could not be determined"}
+	}
+	if !slices.Contains(allowed, mediaType) {
+		return &checkError{"content-type", fmt.Sprintf("%s is not an allowed type", mediaType)}
+	}
+	return nil
+}
+
+// checkAllowedTypesOverride validates a request's allowedTypes against the
+// server's ceiling, canonicalizing them in place.
+func checkAllowedTypesOverride(request *downloadRequest) error {
+	ceiling := cfg.AllowedTypesCeiling
+	if len(ceiling) == 0 {
+		ceiling = cfg.AllowedTypes
+	}
+	if len(ceiling) == 0 {
+		ceiling = defaultAllowedTypes
+	}
+	for i, requested := range request.AllowedTypes {
+		mediaType := baseMediaType(requested)
+		if mediaType == "" {
+			return fmt.Errorf("%q is not a media type", requested)
+		}
+		if !slices.Contains(ceiling, mediaType) {
+			return fmt.Errorf("%s is beyond the allowed types ceiling", mediaType)
+		}
+		request.AllowedTypes[i] = mediaType
+	}
+	return nil
+}
+
+// checkStrictFile verifies that a downloaded file is a non-empty, well-formed
+// image within the configured size and dimension bounds.
+func checkStrictFile(path string, size int64) error {
+	if size == 0 {
+		return &checkError{"body", "response body is empty"}
+	}
+	if cfg.StrictMaxBytes > 0 && size > cfg.StrictMaxBytes {
+		return &checkError{"size", fmt.Sprintf("%d bytes exceeds the %d byte limit", size, cfg.StrictMaxBytes)}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	width, height, err := imageDimensions(file, head)
+	if err != nil {
+		return &checkError{"decode", err.Error()}
+	}
+	if limit := cfg.StrictMaxDimension; limit > 0 && (width > limit || height > limit) {
+		return &checkError{"dimensions", fmt.Sprintf("%dx%d exceeds the %d pixel limit", width, height, limit)}
+	}
+
+	if width > 0 && height > 0 {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, _, err := image.Decode(file); err != nil {
+			return &checkError{"decode", fmt.Sprintf("not a valid image: %v", err)}
+		}
+	}
+	return nil
+}
+
+// imageDimensions decodes the header of an image to validate it. Formats the
+// standard library cannot decode are checked by signature only and report
+// zero dimensions.
+func imageDimensions(r io.Reader, head []byte) (int, int, error) {
+	switch sniffImageType(head) {
+	case "image/svg+xml":
+		if err := xml.NewDecoder(r).Decode(new(struct{})); err != nil {
+			return 0, 0, fmt.Errorf("invalid SVG: %v", err)
+		}
+		return 0, 0, nil
+	case "image/webp", "image/avif", "image/bmp", "image/tiff", "image/x-icon":
+		return 0, 0, nil
+	}
+
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("not a valid image: %v", err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// isSVG reports whether head looks like the start of an SVG document.
+func isSVG(head []byte) bool {
+	text := strings.ToLower(string(bytes.TrimSpace(bytes.TrimPrefix(head, utf8BOM))))
+	return strings.HasPrefix(text, "<svg") ||
+		(strings.HasPrefix(text, "<?xml") || strings.HasPrefix(text, "<!doctype svg")) && strings.Contains(text, "<svg")
+}
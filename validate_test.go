@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// strictUpstream serves each test case's response under its own path.
+func strictUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	image := pngImage(t, 5, 5)
+	mux := http.NewServeMux()
+	serve := func(path, contentType string, status int, body []byte) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			w.Write(body)
+		})
+	}
+	serve("/valid.png", "image/png", http.StatusOK, image)
+	serve("/partial.png", "image/png", http.StatusPartialContent, image)
+	serve("/doc.pdf", "application/pdf", http.StatusOK, []byte("%PDF-1.4 not an image"))
+	serve("/empty.png", "image/png", http.StatusOK, nil)
+	serve("/broken.png", "image/png", http.StatusOK, image[:40])
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestStrictRejectionReasons(t *testing.T) {
+	upstream := strictUpstream(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		change func(c *config)
+		reason string
+	}{
+		{"status", "/partial.png", nil, "bad status code for " + upstream.URL + "/partial.png: 206"},
+		{"content type", "/doc.pdf", nil, "content-type check failed: application/pdf is not an allowed type"},
+		{"empty body", "/empty.png", nil, "body check failed: response body is empty"},
+		{"decode", "/broken.png", nil, "decode check failed: not a valid image"},
+		{"size", "/valid.png", func(c *config) { c.StrictMaxBytes = 10 }, "size check failed"},
+		{"dimensions", "/valid.png", func(c *config) { c.StrictMaxDimension = 4 }, "dimensions check failed: 5x5 exceeds the 4 pixel limit"},
+		{"accepted", "/valid.png", func(c *config) { c.StrictMaxBytes, c.StrictMaxDimension = 1<<20, 5 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+			if tt.change != nil {
+				setConfig(t, tt.change)
+			}
+
+			rec := postDownload(t, `{"strict":true,"output":"local","destDir":"out","imageURLs":["`+upstream.URL+tt.path+`"]}`)
+			entry := decodeReport(t, rec).Entries[0]
+			if tt.reason == "" && entry.Error != "" || !strings.Contains(entry.Error, tt.reason) {
+				t.Errorf("error %q, want %q", entry.Error, tt.reason)
+			}
+		})
+	}
+}
+
+func TestStrictOffAcceptsAnyType(t *testing.T) {
+	upstream := strictUpstream(t)
+	setConfig(t, func(c *config) { c.DestRoot = t.TempDir() })
+
+	rec := postDownload(t, `{"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/doc.pdf"]}`)
+	if entry := decodeReport(t, rec).Entries[0]; entry.Error != "" {
+		t.Errorf("non-strict download failed: %s", entry.Error)
+	}
+}
+
+// postWithKey sends body to downloadHandler with key as a Bearer token.
+func postWithKey(t *testing.T, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/download", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, req)
+	return rec
+}
+
+func TestAllowedTypesOverride(t *testing.T) {
+	upstream := strictUpstream(t)
+
+	tests := []struct {
+		name    string
+		key     string
+		ceiling []string
+		types   string
+		status  int
+		pdfOK   bool
+	}{
+		{"within ceiling", "secret", []string{"image/png", "application/pdf"}, `["application/pdf"]`, http.StatusOK, true},
+		{"parameters ignored", "secret", []string{"application/pdf"}, `["Application/PDF; x=1"]`, http.StatusOK, true},
+		{"beyond ceiling", "secret", []string{"image/png"}, `["application/pdf"]`, http.StatusBadRequest, false},
+		{"no ceiling only narrows", "secret", nil, `["application/pdf"]`, http.StatusBadRequest, false},
+		{"untrusted", "", []string{"application/pdf"}, `["application/pdf"]`, http.StatusForbidden, false},
+		{"wrong key", "guess", []string{"application/pdf"}, `["application/pdf"]`, http.StatusForbidden, false},
+		{"default allowlist", "secret", nil, `[]`, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *config) {
+				c.DestRoot = t.TempDir()
+				c.TrustedAPIKeys = []string{"secret"}
+				c.AllowedTypes = []string{"image/png"}
+				c.AllowedTypesCeiling = tt.ceiling
+			})
+			rec := postWithKey(t, tt.key, `{"allowedTypes":`+tt.types+`,"output":"local","destDir":"out","imageURLs":["`+upstream.URL+`/doc.pdf"]}`)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			if entry := decodeReport(t, rec).Entries[0]; (entry.Error == "") != tt.pdfOK {
+				t.Errorf("pdf error %q, want accepted %v", entry.Error, tt.pdfOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// verifyReport answers a verifyFirst request some of whose entries cannot be
+// reached.
+type verifyReport struct {
+	Unreachable []*downloadResult `json:"unreachable"`
+}
+
+// unreachableEntries probes each entry of request, by its URL and then its
+// mirrors, and returns a result for every entry none of them could serve,
+// in request order. Nothing is downloaded.
+func unreachableEntries(request *downloadRequest) []*downloadResult {
+	results := make([]*downloadResult, len(request.ImageURLs))
+	limiter := make(fixedLimiter, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, entry := range request.ImageURLs {
+		limiter.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limiter.release(0, false)
+			var failures []string
+			result := &downloadResult{URL: entry.URL, Filename: entryFilename(entry, request.FilenameEncoding)}
+			for _, imageURL := range append([]string{entry.URL}, entry.Mirrors...) {
+				_, err := probeURL(request, imageURL, true)
+				if err == nil {
+					return
+				}
+				failures = append(failures, err.Error())
+				var policy *policyError
+				if errors.As(err, &policy) {
+					result.BlockedBy = policy.rule
+				}
+			}
+			result.Error = strings.Join(failures, "; ")
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	var unreachable []*downloadResult
+	for _, result := range results {
+		if result != nil {
+			unreachable = append(unreachable, result)
+		}
+	}
+	return unreachable
+}
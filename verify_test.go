@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probedUpstream serves an image at every path but /missing.png, refusing
+// HEAD under /nohead/, and records each request's method, path and Range.
+func probedUpstream(t *testing.T) (url string, requests func() []string) {
+	t.Helper()
+	image := pngImage(t, 3, 3)
+	var mu sync.Mutex
+	var seen []string
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.Path+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing.png":
+			http.NotFound(w, r)
+		case r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/nohead/"):
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(image))
+		}
+	})
+	return upstream.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestVerifyFirstDownloadsNothingWhenUnreachable(t *testing.T) {
+	upstream, requests := probedUpstream(t)
+
+	rec := postDownload(t, `{"verifyFirst":true,"imageURLs":["`+upstream+`/a.png","`+upstream+`/missing.png"]}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	var report verifyReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0].URL != upstream+"/missing.png" || report.Unreachable[0].Error == "" {
+		t.Errorf("unreachable = %+v, want only missing.png with its error", report.Unreachable)
+	}
+	for _, request := range requests() {
+		if !strings.HasPrefix(request, "HEAD ") {
+			t.Errorf("%s sent before every entry was verified", request)
+		}
+	}
+}
+
+func TestVerifyFirstProbes(t *testing.T) {
+	upstream, requests := probedUpstream(t)
+
+	body := `{"verifyFirst":true,"imageURLs":["` + upstream + `/nohead/a.png",{"url":"` + upstream + `/missing.png","mirrors":["` + upstream + `/b.png"]}]}`
+	if entries := zipEntries(t, postDownload(t, body)); len(entries) != 2 {
+		t.Errorf("archive has %v, want both entries", keys(entries))
+	}
+	seen := requests()
+	want := []string{
+		"HEAD /nohead/a.png ",
+		"GET /nohead/a.png bytes=0-0",
+		"HEAD /missing.png ",
+		"HEAD /b.png ",
+	}
+	for _, request := range want {
+		if !slices.Contains(seen[:4], request) {
+			t.Errorf("probes %q, missing %q", seen[:4], request)
+		}
+	}
+}
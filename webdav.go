@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// webdavExporter uploads a request's placed files to WEBDAV_URL, creating
+// the collections their paths need. Collections are created once per
+// batch, and a file shared by deduplicated entries is uploaded once.
+type webdavExporter struct {
+	base        *url.URL
+	client      *http.Client
+	collections map[string]bool
+	uploaded    map[string]error
+}
+
+// exportWebDAV uploads the successful downloads of results to WEBDAV_URL,
+// each under its filename, recording the path in WebDAVPath. A result whose
+// upload fails keeps its local file but is marked failed.
+func exportWebDAV(results []*downloadResult, request *downloadRequest) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.WebDAVURL, "/"))
+	if err != nil {
+		for _, result := range results {
+			if result.Error == "" && result.UploadStatus == 0 {
+				result.Error = fmt.Sprintf("webdav upload failed: invalid WEBDAV_URL: %v", err)
+			}
+		}
+		return
+	}
+	e := &webdavExporter{
+		base: base,
+		client: &http.Client{
+			Transport: request.connections.transportFor(base.Hostname()),
+			Timeout:   cfg.DownloadTimeout,
+		},
+		collections: make(map[string]bool),
+		uploaded:    make(map[string]error),
+	}
+	for _, result := range results {
+		if result.Error != "" || result.UploadStatus != 0 {
+			continue
+		}
+		err, ok := e.uploaded[result.Filename]
+		if !ok {
+			err = e.upload(result)
+			e.uploaded[result.Filename] = err
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("webdav upload failed: %v", err)
+			continue
+		}
+		result.WebDAVPath = result.Filename
+	}
+}
+
+// upload PUTs result's file to its path under the base URL, after creating
+// the collections above it.
+func (e *webdavExporter) upload(result *downloadResult) error {
+	if dir := path.Dir(result.Filename); dir != "." {
+		if err := e.mkcol(dir); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(result.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := e.newRequest(http.MethodPut, result.Filename, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if result.ContentType != "" {
+		req.Header.Set("Content-Type", result.ContentType)
+	}
+	status, err := e.do(req)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("PUT %s returned status %d", result.Filename, status)
+	}
+	return nil
+}
+
+// mkcol creates the collection dir and its parents. A collection that
+// already exists answers 405, which is accepted.
+func (e *webdavExporter) mkcol(dir string) error {
+	if e.collections[dir] {
+		return nil
+	}
+	if parent := path.Dir(dir); parent != "." {
+		if err := e.mkcol(parent); err != nil {
+			return err
+		}
+	}
+	req, err := e.newRequest("MKCOL", dir+"/", nil)
+	if err != nil {
+		return err
+	}
+	status, err := e.do(req)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusMethodNotAllowed && (status < 200 || status > 299) {
+		return fmt.Errorf("MKCOL %s returned status %d", dir, status)
+	}
+	e.collections[dir] = true
+	return nil
+}
+
+// newRequest builds a request for name, a slash-separated path under the
+// base URL, with the configured basic auth credentials.
+func (e *webdavExporter) newRequest(method, name string, body io.Reader) (*http.Request, error) {
+	target := *e.base
+	target.Path, target.RawPath = e.base.Path+"/"+name, ""
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.WebDAVUsername != "" {
+		req.SetBasicAuth(cfg.WebDAVUsername, cfg.WebDAVPassword)
+	}
+	return req, nil
+}
+
+func (e *webdavExporter) do(req *http.Request) (int, error) {
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// davServer is a mock WebDAV server recording the requests it receives and
+// the files PUT to it. MKCOL of an existing collection answers 405, and a
+// PUT of a name containing "full" answers 507.
+type davServer struct {
+	mu          sync.Mutex
+	requests    []string
+	files       map[string][]byte
+	collections map[string]bool
+	auth        []string
+}
+
+func newDAVServer(t *testing.T, existing ...string) (*davServer, string) {
+	t.Helper()
+	dav := &davServer{files: make(map[string][]byte), collections: make(map[string]bool)}
+	for _, collection := range existing {
+		dav.collections[collection] = true
+	}
+	server := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		dav.mu.Lock()
+		defer dav.mu.Unlock()
+		dav.requests = append(dav.requests, r.Method+" "+r.URL.Path)
+		user, password, _ := r.BasicAuth()
+		dav.auth = append(dav.auth, user+":"+password)
+		switch {
+		case r.Method == "MKCOL" && dav.collections[r.URL.Path]:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Method == "MKCOL":
+			dav.collections[r.URL.Path] = true
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "full"):
+			w.WriteHeader(http.StatusInsufficientStorage)
+		case r.Method == http.MethodPut:
+			dav.files[r.URL.Path] = body
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	return dav, server.URL
+}
+
+func TestWebDAVOutput(t *testing.T) {
+	a, b := pngImage(t, 2, 2), pngImage(t, 3, 3)
+	upstream := httptestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if strings.HasSuffix(r.URL.Path, "b.png") {
+			w.Write(b)
+			return
+		}
+		w.Write(a)
+	})
+	dav, davURL := newDAVServer(t, "/files/me/127.0.0.1/")
+	setConfig(t, func(c *config) {
+		c.WebDAVURL = davURL + "/files/me/"
+		c.WebDAVUsername = "me"
+		c.WebDAVPassword = "secret"
+	})
+
+	body := `{"output":"webdav","pathTemplate":"{host}/{ext}","duplicates":"collapse","imageURLs":["` +
+		upstream.URL + `/a.png","` + upstream.URL + `/b.png","` + upstream.URL + `/a.png#again","` + upstream.URL + `/full.png"]}`
+	rec := postDownload(t, body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	report := decodeReport(t, rec)
+
+	dav.mu.Lock()
+	defer dav.mu.Unlock()
+	wantRequests := []string{
+		"MKCOL /files/me/127.0.0.1/",
+		"MKCOL /files/me/127.0.0.1/png/",
+		"PUT /files/me/127.0.0.1/png/a.png",
+		"PUT /files/me/127.0.0.1/png/b.png",
+		"PUT /files/me/127.0.0.1/png/full.png",
+	}
+	if !slices.Equal(dav.requests, wantRequests) {
+		t.Errorf("WebDAV requests %q, want %q", dav.requests, wantRequests)
+	}
+	for _, auth := range dav.auth {
+		if auth != "me:secret" {
+			t.Errorf("WebDAV request authenticated as %q", auth)
+		}
+	}
+	if !bytes.Equal(dav.files["/files/me/127.0.0.1/png/a.png"], a) || !bytes.Equal(dav.files["/files/me/127.0.0.1/png/b.png"], b) {
+		t.Error("uploaded files do not match the downloads")
+	}
+
+	for i, want := range []string{"127.0.0.1/png/a.png", "127.0.0.1/png/b.png", "127.0.0.1/png/a.png"} {
+		if entry := report.Entries[i]; entry.Error != "" || entry.WebDAVPath != want {
+			t.Errorf("entry %d: webdavPath %q, error %q; want %q", i, entry.WebDAVPath, entry.Error, want)
+		}
+	}
+	if entry := report.Entries[3]; !strings.Contains(entry.Error, "webdav upload failed: PUT 127.0.0.1/png/full.png returned status 507") || entry.WebDAVPath != "" {
+		t.Errorf("rejected upload: webdavPath %q, error %q", entry.WebDAVPath, entry.Error)
+	}
+}
+
+func TestWebDAVOutputRequiresURL(t *testing.T) {
+	setConfig(t, func(c *config) { c.WebDAVURL = "" })
+	if rec := postDownload(t, `{"output":"webdav","imageURLs":["https://example.com/a.png"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}